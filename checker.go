@@ -0,0 +1,259 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default health check settings used when a HealthCheck leaves them unset.
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+)
+
+// serviceKey gets a key identifying a single service replicant.
+func serviceKey(service Service) string {
+	return service.Name + "\x00" + service.Host
+}
+
+// parseServiceKey gets the name and host of the replicant identified by a key.
+func parseServiceKey(key string) (string, string) {
+	parts := strings.SplitN(key, "\x00", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// checker runs the health checks declared by registered services.
+type checker struct {
+	registry Registry
+	checks   map[string]HealthCheck
+	results  map[string]CheckResult
+	running  map[string]bool
+	mutex    *sync.RWMutex
+	notify   func(service Service) // notify is called when health changes.
+	clock    Clock
+	done     chan struct{}
+	once     *sync.Once
+}
+
+// newChecker creates a checker for the services in the registry.
+func newChecker(registry Registry) *checker {
+	return &checker{
+		registry: registry,
+		checks:   make(map[string]HealthCheck),
+		results:  make(map[string]CheckResult),
+		running:  make(map[string]bool),
+		mutex:    &sync.RWMutex{},
+		clock:    SystemClock,
+		done:     make(chan struct{}),
+		once:     &sync.Once{},
+	}
+}
+
+// stop stops running health checks.
+func (c *checker) stop() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// setClock sets the clock checks are timed by.
+func (c *checker) setClock(clock Clock) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clock = clock
+}
+
+// watch starts or updates the health check declared by the service. If the
+// service no longer declares a check any running check is stopped.
+func (c *checker) watch(service Service) {
+	key := serviceKey(service)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if service.Check == nil {
+		delete(c.checks, key)
+		delete(c.results, key)
+		return
+	}
+	c.checks[key] = *service.Check
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if !c.running[key] {
+		c.running[key] = true
+		go c.run(Service{Name: service.Name, Host: service.Host})
+	}
+}
+
+// forget stops checking the service.
+func (c *checker) forget(service Service) {
+	c.watch(Service{Name: service.Name, Host: service.Host})
+}
+
+// registered returns true if the service is held by the registry.
+func registered(registry Registry, service Service) bool {
+	return len(registry.ListMatching(Filter{Name: service.Name,
+		Selector: Selector{Eq("host", service.Host)}})) > 0
+}
+
+// run checks the service on its interval until the check is removed, the
+// service leaves the registry or the checker is stopped.
+func (c *checker) run(service Service) {
+	key := serviceKey(service)
+	for {
+		c.mutex.Lock()
+		check, ok := c.checks[key]
+		if !ok {
+			delete(c.running, key)
+			c.mutex.Unlock()
+			return
+		}
+		clock := c.clock
+		c.mutex.Unlock()
+		if !registered(c.registry, service) {
+			c.forget(service)
+			continue
+		}
+		result := runCheck(service.Host, check)
+		result.Checked = clock.Now()
+		c.mutex.Lock()
+		changed := false
+		if _, ok := c.checks[key]; ok {
+			previous, checked := c.results[key]
+			changed = result.Healthy != (!checked || previous.Healthy)
+			c.results[key] = result
+		}
+		c.mutex.Unlock()
+		if changed && c.notify != nil {
+			c.notify(service)
+		}
+		interval := time.Duration(check.Interval)
+		if interval <= 0 {
+			interval = defaultCheckInterval
+		}
+		select {
+		case <-clock.After(interval):
+		case <-c.done:
+			c.mutex.Lock()
+			delete(c.running, key)
+			c.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// result gets the most recent check result of the service, or nil if the
+// service has not been checked.
+func (c *checker) result(service Service) *CheckResult {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if result, ok := c.results[serviceKey(service)]; ok {
+		return &result
+	}
+	return nil
+}
+
+// annotate gets the service with the result of its most recent check. A
+// service failing its check is given a critical status.
+func (c *checker) annotate(service Service) Service {
+	service.Health = c.result(service)
+	if service.Health != nil && !service.Health.Healthy &&
+		service.Status != StatusMaintenance {
+		service.Status = StatusCritical
+		service.Reason = "health check failed: " + service.Health.Output
+	}
+	return service
+}
+
+// healthy gets the services that are unchecked or passed their last check.
+func (c *checker) healthy(services []Service) []Service {
+	var healthy []Service
+	for _, service := range services {
+		if result := c.result(service); result == nil || result.Healthy {
+			healthy = append(healthy, service)
+		}
+	}
+	return healthy
+}
+
+// runCheck performs a single health check against the host. The HTTP path is
+// always requested from the host and redirects are not followed, so that a
+// check cannot be pointed at another address. The time of the check is left
+// for the caller to set.
+func runCheck(host string, check HealthCheck) CheckResult {
+	timeout := time.Duration(check.Timeout)
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	result := CheckResult{}
+	if check.TCP {
+		conn, err := net.DialTimeout("tcp", host, timeout)
+		if err != nil {
+			result.Output = err.Error()
+			return result
+		}
+		conn.Close()
+	}
+	if check.HTTP != "" {
+		uri := fmt.Sprintf("http://%s/%s", host,
+			strings.TrimPrefix(check.HTTP, "/"))
+		client := http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Get(uri)
+		if err != nil {
+			result.Output = err.Error()
+			return result
+		}
+		resp.Body.Close()
+		expected := check.Status
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+		if resp.StatusCode != expected {
+			result.Output = fmt.Sprintf("expected status %d, got %d",
+				expected, resp.StatusCode)
+			return result
+		}
+	}
+	result.Healthy = true
+	return result
+}
@@ -0,0 +1,202 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDurationJSON tests reading and writing durations as JSON.
+func TestDurationJSON(t *testing.T) {
+	raw, err := json.Marshal(Duration(1500 * time.Millisecond))
+	if err != nil || string(raw) != `"1.5s"` {
+		t.Fatalf("expected: \"1.5s\", got: %s, %v", raw, err)
+	}
+	table := []struct {
+		raw         string
+		expected    Duration
+		expectedErr bool
+	}{
+		{raw: `"10s"`, expected: Duration(10 * time.Second)},
+		{raw: `1000`, expected: Duration(1000)},
+		{raw: `"ten"`, expectedErr: true},
+		{raw: `true`, expectedErr: true},
+	}
+	for _, row := range table {
+		var d Duration
+		err := json.Unmarshal([]byte(row.raw), &d)
+		if (err != nil) != row.expectedErr {
+			t.Fatalf("expected error: %t, got: %v; %v", row.expectedErr, err,
+				row)
+		}
+		if !row.expectedErr && d != row.expected {
+			t.Fatalf("expected: %v, got: %v", row.expected, d)
+		}
+	}
+}
+
+// TestRunCheck tests the runCheck function.
+func TestRunCheck(t *testing.T) {
+	mock := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				http.Error(w, "not found", http.StatusNotFound)
+			}
+		}))
+	defer mock.Close()
+	host := strings.TrimPrefix(mock.URL, "http://")
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to reserve port: %v", err)
+	}
+	closedHost := closed.Addr().String()
+	closed.Close()
+	table := []struct {
+		host     string
+		check    HealthCheck
+		expected bool
+	}{
+		{host: host, check: HealthCheck{HTTP: "/health"}, expected: true},
+		{host: host, check: HealthCheck{HTTP: "health"}, expected: true},
+		{host: host, check: HealthCheck{HTTP: "/missing"}, expected: false},
+		{host: host, check: HealthCheck{HTTP: "/missing", Status: 404},
+			expected: true},
+		{host: host, check: HealthCheck{HTTP: "http://127.0.0.1:1/health"},
+			expected: false},
+		{host: host, check: HealthCheck{TCP: true}, expected: true},
+		{host: closedHost, check: HealthCheck{TCP: true}, expected: false},
+		{host: closedHost, check: HealthCheck{HTTP: "/health"},
+			expected: false},
+	}
+	for _, row := range table {
+		result := runCheck(row.host, row.check)
+		if result.Healthy != row.expected {
+			t.Fatalf("expected: %t, got: %v; %v", row.expected, result, row)
+		}
+		if !result.Healthy && result.Output == "" {
+			t.Fatalf("expected failure output; %v", row)
+		}
+	}
+}
+
+// TestChecker tests running health checks for registered services.
+func TestChecker(t *testing.T) {
+	var unhealthy int32
+	mock := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&unhealthy) == 1 {
+				http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			}
+		}))
+	defer mock.Close()
+	registry := NewRandomRegistry(time.Minute, time.Hour)
+	checker := newChecker(registry)
+	service := Service{Name: "service1",
+		Host: strings.TrimPrefix(mock.URL, "http://"),
+		Check: &HealthCheck{HTTP: "/",
+			Interval: Duration(10 * time.Millisecond)}}
+	unchecked := Service{Name: "service1", Host: "host2"}
+	registry.Add(service)
+	registry.Add(unchecked)
+	checker.watch(service)
+	checker.watch(unchecked)
+	time.Sleep(50 * time.Millisecond)
+	if length := len(checker.healthy(registry.Active(Filter{}))); length != 2 {
+		t.Fatalf("expected: 2, got: %d", length)
+	}
+	atomic.StoreInt32(&unhealthy, 1)
+	time.Sleep(50 * time.Millisecond)
+	services := checker.healthy(registry.Active(Filter{}))
+	if len(services) != 1 || services[0].Host != "host2" {
+		t.Fatalf("expected only unchecked service, got: %v", services)
+	}
+	if result := checker.result(service); result == nil || result.Healthy {
+		t.Fatalf("expected failing result, got: %v", result)
+	}
+	if annotated := checker.annotate(service); annotated.Status !=
+		StatusCritical || annotated.Reason == "" {
+		t.Fatalf("expected critical status, got: %v", annotated)
+	}
+	registry.Remove(service)
+	time.Sleep(50 * time.Millisecond)
+	if result := checker.result(service); result != nil {
+		t.Fatalf("expected removed service to be forgotten, got: %v", result)
+	}
+}
+
+// TestHealthCheckValid tests rejecting health checks that name their own host.
+func TestHealthCheckValid(t *testing.T) {
+	table := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "", expected: true},
+		{path: "/health", expected: true},
+		{path: "health?verbose=1", expected: true},
+		{path: "http://10.0.0.1/health", expected: false},
+		{path: "https://example.com/health", expected: false},
+		{path: "//example.com/health", expected: false},
+		{path: "file:///etc/passwd", expected: false},
+	}
+	for _, row := range table {
+		if valid := (HealthCheck{HTTP: row.path}).valid(); valid !=
+			row.expected {
+			t.Fatalf("expected: %t, got: %t; %v", row.expected, valid, row)
+		}
+	}
+}
+
+// TestCheckerStop tests that stopping a checker ends its running checks.
+func TestCheckerStop(t *testing.T) {
+	registry := NewRandomRegistry(time.Minute, time.Hour)
+	checker := newChecker(registry)
+	service := Service{Name: "service1", Host: "127.0.0.1:1",
+		Check: &HealthCheck{TCP: true,
+			Interval: Duration(10 * time.Millisecond)}}
+	registry.Add(service)
+	checker.watch(service)
+	checker.stop()
+	waitFor(t, func() bool {
+		checker.mutex.RLock()
+		defer checker.mutex.RUnlock()
+		return len(checker.running) == 0
+	})
+	checker.watch(service)
+	checker.mutex.RLock()
+	defer checker.mutex.RUnlock()
+	if len(checker.running) != 0 {
+		t.Fatalf("expected no checks after stop, got: %v", checker.running)
+	}
+}
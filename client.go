@@ -28,6 +28,7 @@
 package discovery
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -46,39 +47,116 @@ type Client struct {
 	token string
 }
 
-// Discover gets the host of the target service by name or an error.
-func (client *Client) Discover(name string) (string, error) {
+// QueryOption narrows the services considered by a Client request.
+type QueryOption func(query url.Values)
+
+// MatchTag restricts a request to services carrying the specified tag.
+func MatchTag(tag string) QueryOption {
+	return func(query url.Values) {
+		query.Add("tag", tag)
+	}
+}
+
+// MatchMeta restricts a request to services with the specified metadata value.
+func MatchMeta(key, value string) QueryOption {
+	return func(query url.Values) {
+		query.Set("meta."+key, value)
+	}
+}
+
+// Where restricts a request to services satisfying every requirement. See
+// ParseSelector for the equivalent selector syntax.
+func Where(requirements ...Requirement) QueryOption {
+	return func(query url.Values) {
+		query.Set("q", Selector(requirements).String())
+	}
+}
+
+// FromZone sets the region and zone of the caller so that discovery prefers
+// replicants in the same zone, then the same region.
+func FromZone(region, zone string) QueryOption {
+	return func(query url.Values) {
+		query.Set("region", region)
+		query.Set("zone", zone)
+	}
+}
+
+// WithConsistency sets the consistency a clustered server reads with, instead
+// of its default.
+func WithConsistency(consistency Consistency) QueryOption {
+	return func(query url.Values) {
+		query.Set("consistency", string(consistency))
+	}
+}
+
+// newQuery builds the query parameters for a request by name and options.
+func newQuery(name string, options []QueryOption) url.Values {
 	values := url.Values{}
 	values.Add("name", name)
+	for _, option := range options {
+		option(values)
+	}
+	return values
+}
+
+// Discover gets the host of the target service by name or an error. Options
+// may be supplied to restrict discovery to services with matching tags or
+// metadata.
+func (client *Client) Discover(name string,
+	options ...QueryOption) (string, error) {
+	service, err := client.DiscoverService(name, options...)
+	if err != nil {
+		return "", err
+	}
+	return service.Host, nil
+}
+
+// DiscoverForKey gets the host of the target service by name for the key or an
+// error. A server using a hash balancer returns the same host for the same key
+// for as long as that host remains active.
+func (client *Client) DiscoverForKey(name, key string,
+	options ...QueryOption) (string, error) {
+	options = append(options, func(query url.Values) {
+		query.Set("key", key)
+	})
+	return client.Discover(name, options...)
+}
+
+// DiscoverService gets the target service by name including any metadata and
+// tags it registered with or an error.
+func (client *Client) DiscoverService(name string,
+	options ...QueryOption) (Service, error) {
+	values := newQuery(name, options)
 	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "discover"))
 	uri.RawQuery = values.Encode()
 	req, err := http.NewRequest("GET", uri.String(), nil)
 	req.Header.Set("Authorization", client.token)
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return Service{}, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return "", err
+			return Service{}, err
 		}
-		return "", errors.New(string(body))
+		return Service{}, errors.New(string(body))
 	}
 	service := Service{}
 	decoder := json.NewDecoder(resp.Body)
 	err = decoder.Decode(&service)
 	if err != nil {
-		return "", err
+		return Service{}, err
 	}
-	return service.Host, nil
+	return service, nil
 }
 
-// List lists all services filtered by name.
-func (client *Client) List(name string) ([]Service, error) {
-	values := url.Values{}
-	values.Add("name", name)
+// List lists all services filtered by name. Options may be supplied to further
+// filter services by tags or metadata.
+func (client *Client) List(name string,
+	options ...QueryOption) ([]Service, error) {
+	values := newQuery(name, options)
 	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "list"))
 	uri.RawQuery = values.Encode()
 	req, err := http.NewRequest("GET", uri.String(), nil)
@@ -106,6 +184,110 @@ func (client *Client) List(name string) ([]Service, error) {
 	return services.Services, nil
 }
 
+// Policies lists all traffic policies filtered by name.
+func (client *Client) Policies(name string) ([]TrafficPolicy, error) {
+	values := url.Values{}
+	values.Add("name", name)
+	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "policy"))
+	uri.RawQuery = values.Encode()
+	req, err := http.NewRequest("GET", uri.String(), nil)
+	req.Header.Set("Authorization", client.token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return []TrafficPolicy{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return []TrafficPolicy{}, err
+		}
+		return []TrafficPolicy{}, errors.New(string(body))
+	}
+	policies := struct {
+		Policies []TrafficPolicy `json:"policies"`
+	}{}
+	decoder := json.NewDecoder(resp.Body)
+	err = decoder.Decode(&policies)
+	if err != nil {
+		return []TrafficPolicy{}, err
+	}
+	return policies.Policies, nil
+}
+
+// SetPolicy adds or replaces the traffic policy for a service name.
+func (client *Client) SetPolicy(policy TrafficPolicy) error {
+	raw, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "policy"))
+	req, err := http.NewRequest("POST", uri.String(), bytes.NewBuffer(raw))
+	req.Header.Set("Authorization", client.token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+// RemovePolicy removes the traffic policy for a service name.
+func (client *Client) RemovePolicy(name string) error {
+	values := url.Values{}
+	values.Add("name", name)
+	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "policy"))
+	uri.RawQuery = values.Encode()
+	req, err := http.NewRequest("DELETE", uri.String(), nil)
+	req.Header.Set("Authorization", client.token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+// ReportFailure reports that a request to the service at the host failed, such
+// as with a connection error or a 5xx response. The server stops discovering a
+// service that is reported failing too often for a time.
+func (client *Client) ReportFailure(service, host string) error {
+	raw, err := json.Marshal(Service{Name: service, Host: host})
+	if err != nil {
+		return err
+	}
+	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "report"))
+	req, err := http.NewRequest("POST", uri.String(), bytes.NewBuffer(raw))
+	req.Header.Set("Authorization", client.token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return errors.New(string(body))
+	}
+	return nil
+}
+
 // Ping pings the discovery service.
 func (client *Client) Ping() error {
 	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "ping"))
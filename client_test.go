@@ -29,9 +29,12 @@ package discovery
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -64,13 +67,21 @@ func handleMockServiceListInvalid(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"services":]}`))
 }
 
+// handleMockPolicyList mocks response that returns a policy list.
+func handleMockPolicyList(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{"policies":[]}`))
+}
+
 // getMockSuccessMux gets a mux that mocks success responses.
 func getMockSuccessMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/register", handleMockSuccess)
 	mux.HandleFunc("/deregister", handleMockSuccess)
+	mux.HandleFunc("/drain", handleMockSuccess)
+	mux.HandleFunc("/report", handleMockSuccess)
 	mux.HandleFunc("/discover", handleMockService)
 	mux.HandleFunc("/list", handleMockServiceList)
+	mux.HandleFunc("/policy", handleMockPolicyList)
 	mux.HandleFunc("/ping", handleMockSuccess)
 	return mux
 }
@@ -80,8 +91,11 @@ func getMockErrorMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/register", handleMockError)
 	mux.HandleFunc("/deregister", handleMockError)
+	mux.HandleFunc("/drain", handleMockError)
+	mux.HandleFunc("/report", handleMockError)
 	mux.HandleFunc("/discover", handleMockError)
 	mux.HandleFunc("/list", handleMockError)
+	mux.HandleFunc("/policy", handleMockError)
 	mux.HandleFunc("/ping", handleMockSuccess)
 	return mux
 }
@@ -91,12 +105,29 @@ func getMockInvalidMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/register", handleMockError)
 	mux.HandleFunc("/deregister", handleMockError)
+	mux.HandleFunc("/drain", handleMockError)
+	mux.HandleFunc("/report", handleMockError)
 	mux.HandleFunc("/discover", handleMockServiceInvalid)
 	mux.HandleFunc("/list", handleMockServiceListInvalid)
+	mux.HandleFunc("/policy", handleMockServiceListInvalid)
 	mux.HandleFunc("/ping", handleMockSuccess)
 	return mux
 }
 
+// serveMock starts serving a mock server once its address is bound, serving
+// TLS if a certificate and key are specified.
+func serveMock(t *testing.T, mock *http.Server, certFile, keyFile string) {
+	listener, err := net.Listen("tcp", mock.Addr)
+	if err != nil {
+		t.Fatalf("failed to start mock server: %v", err)
+	}
+	if certFile != "" {
+		go mock.ServeTLS(listener, certFile, keyFile)
+	} else {
+		go mock.Serve(listener)
+	}
+}
+
 // setupClientTest starts test servers representing different server responses.
 func setupClientTest(t *testing.T) func(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
@@ -106,9 +137,9 @@ func setupClientTest(t *testing.T) func(t *testing.T) {
 	successMock := &http.Server{Addr: "localhost:64646", Handler: successMux}
 	errorMock := &http.Server{Addr: "localhost:46464", Handler: errorMux}
 	invalidMock := &http.Server{Addr: "localhost:47474", Handler: invalidMux}
-	go successMock.ListenAndServe()
-	go errorMock.ListenAndServe()
-	go invalidMock.ListenAndServe()
+	serveMock(t, successMock, "", "")
+	serveMock(t, errorMock, "", "")
+	serveMock(t, invalidMock, "", "")
 	return func(t *testing.T) {
 		successMock.Shutdown(context.Background())
 		errorMock.Shutdown(context.Background())
@@ -121,7 +152,7 @@ func setupClientTLSTest(t *testing.T) func(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	successMux := getMockSuccessMux()
 	successMock := &http.Server{Addr: "localhost:64646", Handler: successMux}
-	go successMock.ListenAndServeTLS("test.crt", "test.key")
+	serveMock(t, successMock, "test.crt", "test.key")
 	return func(t *testing.T) {
 		successMock.Shutdown(context.Background())
 	}
@@ -176,6 +207,13 @@ func TestClientDiscover(t *testing.T) {
 		} else if err == nil && !row.success {
 			t.Fatalf("expected return failure")
 		}
+		// test discover for key function
+		_, err = client.DiscoverForKey("", "key")
+		if err != nil && row.success {
+			t.Fatalf("expected return success: %v", err)
+		} else if err == nil && !row.success {
+			t.Fatalf("expected return failure")
+		}
 	}
 }
 
@@ -215,6 +253,63 @@ func TestClientList(t *testing.T) {
 	}
 }
 
+// TestClientPolicy tests calling the policy endpoint with a client.
+func TestClientPolicy(t *testing.T) {
+	teardown := setupClientTest(t)
+	defer teardown(t)
+	table := []struct {
+		target  string // target server host
+		success bool   // whether the list call should return success.
+		write   bool   // whether the set and remove calls should succeed.
+	}{
+		{"http://localhost:64646", true, true},   // success mock
+		{"http://localhost:46464", false, false}, // error mock
+		{"http://localhost:47474", false, true},  // invalid mock
+	}
+	for _, row := range table {
+		client, err := NewClient(row.target, "", time.Second)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		_, err = client.Policies("")
+		if (err == nil) != row.success {
+			t.Fatalf("expected success: %t, got: %v", row.success, err)
+		}
+		err = client.SetPolicy(TrafficPolicy{Name: "service1"})
+		if (err == nil) != row.write {
+			t.Fatalf("expected success: %t, got: %v", row.write, err)
+		}
+		err = client.RemovePolicy("service1")
+		if (err == nil) != row.write {
+			t.Fatalf("expected success: %t, got: %v", row.write, err)
+		}
+	}
+}
+
+// TestClientReportFailure tests calling the report endpoint with a client.
+func TestClientReportFailure(t *testing.T) {
+	teardown := setupClientTest(t)
+	defer teardown(t)
+	table := []struct {
+		target  string // target server host
+		success bool   // whether the report call should return success.
+	}{
+		{"http://localhost:64646", true},  // success mock
+		{"http://localhost:46464", false}, // error mock
+		{"http://localhost:47474", false}, // invalid mock
+	}
+	for _, row := range table {
+		client, err := NewClient(row.target, "", time.Second)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		err = client.ReportFailure("service1", "host1")
+		if (err == nil) != row.success {
+			t.Fatalf("expected success: %t, got: %v", row.success, err)
+		}
+	}
+}
+
 // TestClientRegister tests calling the register endpoint with a registry
 // client.
 func TestClientRegister(t *testing.T) {
@@ -249,6 +344,13 @@ func TestClientRegister(t *testing.T) {
 		} else if err == nil && !row.success {
 			t.Fatalf("expected return failure")
 		}
+		// test set status function
+		err = client.SetStatus(StatusWarning, "high latency")
+		if err != nil && row.success {
+			t.Fatalf("expected return success: %v", err)
+		} else if err == nil && !row.success {
+			t.Fatalf("expected return failure")
+		}
 	}
 }
 
@@ -289,6 +391,31 @@ func TestClientDeregister(t *testing.T) {
 	}
 }
 
+// TestClientDrain tests calling the drain endpoint with a registry client.
+func TestClientDrain(t *testing.T) {
+	teardown := setupClientTest(t)
+	defer teardown(t)
+	table := []struct {
+		target  string // target server host
+		success bool   // whether the client calls should return success.
+	}{
+		{"http://localhost:64646", true},  // success mock
+		{"http://localhost:46464", false}, // error mock
+	}
+	for _, row := range table {
+		client, err := NewRegistryClient("", "", row.target, "", time.Second)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		if err := client.Drain(); (err == nil) != row.success {
+			t.Fatalf("expected success: %t, got: %v", row.success, err)
+		}
+		if err := client.Undrain(); (err == nil) != row.success {
+			t.Fatalf("expected success: %t, got: %v", row.success, err)
+		}
+	}
+}
+
 // TestClientAuto tests automatic registration with a registry client.
 func TestClientAuto(t *testing.T) {
 	teardown := setupClientTest(t)
@@ -312,3 +439,154 @@ func TestClientAuto(t *testing.T) {
 		t.Fatal("expected client to be stopped.")
 	}
 }
+
+// TestServiceOptions tests applying options to a registry client service.
+func TestServiceOptions(t *testing.T) {
+	service := newService("name", "host", []ServiceOption{
+		WithMeta("env", "prod"),
+		WithMeta("version", "2.1"),
+		WithTags("canary"),
+		WithTags("blue", "green"),
+	})
+	if service.Name != "name" || service.Host != "host" {
+		t.Fatalf("unexpected service identity: %v", service)
+	}
+	if len(service.Meta) != 2 || service.Meta["env"] != "prod" ||
+		service.Meta["version"] != "2.1" {
+		t.Fatalf("unexpected service metadata: %v", service.Meta)
+	}
+	if len(service.Tags) != 3 || service.Tags[0] != "canary" {
+		t.Fatalf("unexpected service tags: %v", service.Tags)
+	}
+}
+
+// TestNewQuery tests building request query parameters from options.
+func TestNewQuery(t *testing.T) {
+	query := newQuery("service1", []QueryOption{
+		MatchTag("canary"),
+		MatchTag("blue"),
+		MatchMeta("env", "prod"),
+		FromZone("east", "east-a"),
+		WithConsistency(ConsistencyLeader),
+	})
+	expected := "consistency=leader&meta.env=prod&name=service1&region=east&" +
+		"tag=canary&tag=blue&zone=east-a"
+	if encoded := query.Encode(); encoded != expected {
+		t.Fatalf("expected: %s, got: %s", expected, encoded)
+	}
+}
+
+// TestWhere tests building a selector query parameter from requirements.
+func TestWhere(t *testing.T) {
+	query := newQuery("billing", []QueryOption{
+		Where(In("env", "prod", "staging"), Gte("version", "2.1")),
+	})
+	expected := "env in (prod,staging),version>=2.1"
+	if q := query.Get("q"); q != expected {
+		t.Fatalf("expected: %s, got: %s", expected, q)
+	}
+}
+
+// TestClientReportLoad tests reporting load with each registration.
+func TestClientReportLoad(t *testing.T) {
+	var reported []float64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", handleMockSuccess)
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		service := Service{}
+		json.NewDecoder(r.Body).Decode(&service)
+		reported = append(reported, service.Load)
+	})
+	mock := &http.Server{Addr: "localhost:48484", Handler: mux}
+	serveMock(t, mock, "", "")
+	defer mock.Shutdown(context.Background())
+	client, err := NewRegistryClient("name", "host", "http://localhost:48484",
+		"", time.Second)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.SetLoad(3)
+	client.Register()
+	load := 0.0
+	client.ReportLoad(func() float64 {
+		load++
+		return load
+	})
+	client.Register()
+	client.Register()
+	expected := []float64{3, 1, 2}
+	if len(reported) != len(expected) {
+		t.Fatalf("expected: %v, got: %v", expected, reported)
+	}
+	for i := range expected {
+		if reported[i] != expected[i] {
+			t.Fatalf("expected: %v, got: %v", expected, reported)
+		}
+	}
+}
+
+// TestClientTTL tests deriving the automatic registration interval from the
+// TTL granted by the server.
+func TestClientTTL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", handleMockSuccess)
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		service := Service{}
+		json.NewDecoder(r.Body).Decode(&service)
+		service.TTL = service.TTL / 2
+		json.NewEncoder(w).Encode(service)
+	})
+	mock := &http.Server{Addr: "localhost:48484", Handler: mux}
+	serveMock(t, mock, "", "")
+	defer mock.Shutdown(context.Background())
+	client, err := NewRegistryClient("name", "host", "http://localhost:48484",
+		"", time.Second, WithTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if interval := client.renewInterval(); interval != defaultRenewInterval {
+		t.Fatalf("expected: %v, got: %v", defaultRenewInterval, interval)
+	}
+	if err := client.Register(); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if ttl := client.TTL(); ttl != 30*time.Second {
+		t.Fatalf("expected: %v, got: %v", 30*time.Second, ttl)
+	}
+	if interval := client.renewInterval(); interval != 10*time.Second {
+		t.Fatalf("expected: %v, got: %v", 10*time.Second, interval)
+	}
+}
+
+// TestClientAutoClock tests timing automatic registration by the client clock.
+func TestClientAutoClock(t *testing.T) {
+	var registrations int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", handleMockSuccess)
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&registrations, 1)
+	})
+	mux.HandleFunc("/deregister", handleMockSuccess)
+	mock := &http.Server{Addr: "localhost:48484", Handler: mux}
+	serveMock(t, mock, "", "")
+	defer mock.Shutdown(context.Background())
+	client, err := NewRegistryClient("name", "host", "http://localhost:48484",
+		"", time.Second)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	clock := NewFakeClock(time.Now())
+	client.SetClock(clock)
+	client.Auto(time.Minute)
+	for expected := int32(1); expected <= 3; expected++ {
+		waitFor(t, func() bool {
+			return atomic.LoadInt32(&registrations) == expected &&
+				clock.Waiters() == 1
+		})
+		clock.Advance(time.Minute)
+	}
+	if err := client.Deregister(); err != nil {
+		t.Fatalf("failed to deregister: %v", err)
+	}
+	waitFor(t, func() bool { return !client.IsRunning() })
+}
@@ -0,0 +1,216 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for time to pass. Registries, the server and
+// registry clients read time through a Clock so that tests can control it.
+type Clock interface {
+	Now() time.Time                         // Now gets the current time.
+	After(d time.Duration) <-chan time.Time // After sends the time once the duration has passed.
+	NewTimer(d time.Duration) Timer         // NewTimer creates a timer that fires once the duration has passed.
+}
+
+// Timer sends the time on its channel once, when it fires. A Timer can be reset
+// so that a goroutine waiting on changing deadlines reuses one timer.
+type Timer interface {
+	C() <-chan time.Time        // C gets the channel the time is sent on.
+	Reset(d time.Duration) bool // Reset stops the timer and has it fire after the duration, returning true if it had not fired.
+	Stop() bool                 // Stop prevents the timer from firing, returning true if it had not fired.
+}
+
+// systemClock implements Clock with the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+// systemTimer implements Timer with a time.Timer.
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Reset(d time.Duration) bool {
+	active := t.timer.Stop()
+	if !active {
+		// drop a time sent but not received so it is not mistaken for the
+		// reset timer firing
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+	t.timer.Reset(d)
+	return active
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// SystemClock is the Clock used unless another is set, reading the system
+// time.
+var SystemClock Clock = systemClock{}
+
+// fakeWaiter is a channel waiting for a FakeClock to reach a time.
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// FakeClock is a Clock for tests that only moves when it is advanced.
+type FakeClock struct {
+	now     time.Time
+	waiters []*fakeWaiter
+	mutex   *sync.Mutex
+}
+
+// Now gets the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// After sends the time once the clock has been advanced by the duration.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	waiter := &fakeWaiter{c: make(chan time.Time, 1)}
+	c.wait(waiter, d)
+	return waiter.c
+}
+
+// NewTimer creates a timer that fires once the clock has been advanced by the
+// duration.
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &fakeTimer{clock: c,
+		waiter: &fakeWaiter{c: make(chan time.Time, 1)}}
+	c.wait(timer.waiter, d)
+	return timer
+}
+
+// wait has the waiter receive the time once the clock is advanced by the
+// duration. The clock mutex must be held.
+func (c *FakeClock) wait(waiter *fakeWaiter, d time.Duration) {
+	waiter.at = c.now.Add(d)
+	if d <= 0 {
+		waiter.c <- c.now
+	} else {
+		c.waiters = append(c.waiters, waiter)
+	}
+}
+
+// unwait stops the waiter from receiving the time, returning true if it was
+// waiting. The clock mutex must be held.
+func (c *FakeClock) unwait(waiter *fakeWaiter) bool {
+	for i, w := range c.waiters {
+		if w == waiter {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by the duration, waking any waiters whose
+// time has come.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			waiting = append(waiting, waiter)
+			continue
+		}
+		waiter.c <- c.now
+	}
+	c.waiters = waiting
+}
+
+// fakeTimer implements Timer for a FakeClock.
+type fakeTimer struct {
+	clock  *FakeClock
+	waiter *fakeWaiter
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.waiter.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.clock.unwait(t.waiter)
+	select {
+	case <-t.waiter.c:
+	default:
+	}
+	t.clock.wait(t.waiter, d)
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.unwait(t.waiter)
+}
+
+// Waiters gets the number of channels waiting for the clock to advance. Tests
+// can poll it to know that a goroutine is waiting before advancing the clock.
+func (c *FakeClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
+
+// NewFakeClock returns a FakeClock set to the specified time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, mutex: &sync.Mutex{}}
+}
@@ -0,0 +1,157 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+// advanceUntil advances the clock a step at a time until the condition holds,
+// giving goroutines waiting on the clock a chance to run between steps.
+func advanceUntil(t *testing.T, clock *FakeClock, step time.Duration,
+	condition func() bool) {
+	for i := 0; !condition(); i++ {
+		if i == 1000 {
+			t.Fatal("timed out waiting for condition")
+		}
+		clock.Advance(step)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestFakeClock tests advancing a fake clock.
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	short := clock.After(time.Second)
+	long := clock.After(time.Minute)
+	now := clock.After(0)
+	select {
+	case at := <-now:
+		if !at.Equal(start) {
+			t.Fatalf("expected: %v, got: %v", start, at)
+		}
+	default:
+		t.Fatal("expected zero duration to fire immediately")
+	}
+	if waiters := clock.Waiters(); waiters != 2 {
+		t.Fatalf("expected: 2 waiters, got: %d", waiters)
+	}
+	clock.Advance(time.Second)
+	select {
+	case at := <-short:
+		if expected := start.Add(time.Second); !at.Equal(expected) {
+			t.Fatalf("expected: %v, got: %v", expected, at)
+		}
+	default:
+		t.Fatal("expected waiter to fire")
+	}
+	select {
+	case <-long:
+		t.Fatal("expected waiter not to fire")
+	default:
+	}
+	if waiters := clock.Waiters(); waiters != 1 {
+		t.Fatalf("expected: 1 waiter, got: %d", waiters)
+	}
+	clock.Advance(time.Hour)
+	<-long
+	if now := clock.Now(); !now.Equal(start.Add(time.Hour + time.Second)) {
+		t.Fatalf("expected: %v, got: %v", start.Add(time.Hour+time.Second),
+			now)
+	}
+}
+
+// TestFakeClockTimer tests resetting and stopping a fake clock timer.
+func TestFakeClockTimer(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	timer := clock.NewTimer(time.Minute)
+	for i := 0; i < 10; i++ {
+		if active := timer.Reset(time.Duration(i+1) * time.Second); !active {
+			t.Fatalf("expected timer to be active on reset %d", i)
+		}
+	}
+	if waiters := clock.Waiters(); waiters != 1 {
+		t.Fatalf("expected: 1 waiter, got: %d", waiters)
+	}
+	clock.Advance(9 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("expected timer not to fire")
+	default:
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("expected timer to fire")
+	}
+	// a time sent but not received is dropped on reset
+	clock.Advance(0)
+	timer.Reset(0)
+	timer.Reset(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("expected reset timer not to fire")
+	default:
+	}
+	if active := timer.Stop(); !active {
+		t.Fatal("expected timer to be active on stop")
+	}
+	if waiters := clock.Waiters(); waiters != 0 {
+		t.Fatalf("expected: 0 waiters, got: %d", waiters)
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Fatal("expected stopped timer not to fire")
+	default:
+	}
+}
+
+// TestSystemClockTimer tests resetting a system clock timer.
+func TestSystemClockTimer(t *testing.T) {
+	timer := SystemClock.NewTimer(time.Hour)
+	defer timer.Stop()
+	timer.Reset(time.Millisecond)
+	select {
+	case <-timer.C():
+	case <-time.After(time.Second):
+		t.Fatal("expected reset timer to fire")
+	}
+}
+
+// TestSystemClock tests waiting on the system clock.
+func TestSystemClock(t *testing.T) {
+	start := SystemClock.Now()
+	at := <-SystemClock.After(time.Millisecond)
+	if at.Sub(start) < time.Millisecond {
+		t.Fatalf("expected to wait a millisecond, waited: %v", at.Sub(start))
+	}
+}
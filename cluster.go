@@ -0,0 +1,371 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// Consistency is how current a read from a server in a cluster must be.
+type Consistency string
+
+// ConsistencyStale and the following constants are the read consistencies a
+// cluster supports.
+const (
+	ConsistencyStale        Consistency = "stale"        // any server answers from its own registry.
+	ConsistencyLeader       Consistency = "leader"       // the leader answers from its registry.
+	ConsistencyLinearizable Consistency = "linearizable" // the leader answers once it confirms it still leads.
+)
+
+// valid returns true if the consistency is known.
+func (consistency Consistency) valid() bool {
+	switch consistency {
+	case ConsistencyStale, ConsistencyLeader, ConsistencyLinearizable:
+		return true
+	}
+	return false
+}
+
+// forwardedHeader marks a request forwarded to the leader by another server so
+// that it is not forwarded again.
+const forwardedHeader = "X-Discovery-Forwarded"
+
+// EnableCluster makes the server a member of a cluster of discovery servers
+// that replicate registry changes through Raft. Members maps the ID of each
+// server in the cluster, including this one, to its base URL, for example
+// http://localhost:8001. The token is sent in the Authorization header of
+// requests to other members. Changes made through any member are forwarded to
+// the leader and applied by every member once a majority holds them. The
+// member's term, vote and log are saved in the directory, and a member that
+// restarts with the same directory restores the registry from it. Restored
+// services that were active get the grace period to renew before they expire.
+// The cluster state is the only copy of the registry a member keeps, so a
+// cluster cannot be enabled on a server with snapshots enabled.
+func (server *Server) EnableCluster(id string, members map[string]string,
+	token, dir string, grace time.Duration) error {
+	if _, ok := members[id]; !ok {
+		return fmt.Errorf("no member '%s' in cluster", id)
+	}
+	peers := make(map[string]string)
+	for member, base := range members {
+		if member != id {
+			peers[member] = base
+		}
+	}
+	server.mutex.Lock()
+	if server.cluster != nil {
+		server.mutex.Unlock()
+		return errors.New("cluster already enabled")
+	}
+	if server.snapshotter != nil {
+		server.mutex.Unlock()
+		return errors.New("cluster cannot be enabled with snapshots")
+	}
+	node, err := newRaftNode(id, peers, token, dir, server.now,
+		server.applyRecord, server.captureState, server.installState,
+		func(taken time.Time) {
+			server.recoverState(taken, grace)
+		})
+	if err != nil {
+		server.mutex.Unlock()
+		return err
+	}
+	server.cluster = node
+	server.mutex.Unlock()
+	// the saved registry state is installed without the server lock, which
+	// installing takes
+	node.start()
+	return nil
+}
+
+// SetReadConsistency sets how current reads from a server in a cluster must
+// be. A request can choose its own with the consistency query parameter.
+// Defaults to ConsistencyStale.
+func (server *Server) SetReadConsistency(consistency Consistency) error {
+	if !consistency.valid() {
+		return fmt.Errorf("unknown consistency '%s'", consistency)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.consistency = consistency
+	return nil
+}
+
+// getCluster thread-safe way of getting the cluster node of this server, or
+// nil if clustering is not enabled.
+func (server *Server) getCluster() *raftNode {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	return server.cluster
+}
+
+// commit applies a registry change, through the cluster if one is enabled.
+// Without a cluster the change is journaled first, and an error is returned,
+// leaving the registry unchanged, if it could not be.
+func (server *Server) commit(record walRecord) error {
+	node := server.getCluster()
+	if node != nil {
+		return node.commit(record)
+	}
+	if !record.valid() {
+		return nil
+	}
+	if err := server.journal(record); err != nil {
+		return err
+	}
+	server.applyRecord(record)
+	return nil
+}
+
+// applyRecord applies a registry change to this server. In a cluster every
+// member applies each committed change, registering services as of the time
+// the leader accepted the change so that members applying it late, or again
+// after a restart, agree on when the service expires.
+func (server *Server) applyRecord(record walRecord) {
+	switch {
+	case record.Op == walSetPolicy:
+		server.registry.SetPolicy(*record.Policy)
+	case record.Op == walRemovePolicy:
+		server.registry.RemovePolicy(record.Policy.Name)
+	case record.Op == walAdd && record.At.IsZero():
+		service := *record.Service
+		server.observe(service)
+		server.registry.Add(service)
+		server.checker.watch(service)
+		server.observe(service)
+	case record.Op == walAdd:
+		service := *record.Service
+		server.observe(service)
+		if existing, ok := server.lookup(service); ok {
+			service.Drain = existing.Drain
+		}
+		service.Added = record.At
+		server.registry.Restore(service)
+		server.checker.watch(service)
+		server.observe(service)
+	case record.Op == walRemove:
+		server.registry.Remove(*record.Service)
+		server.checker.forget(*record.Service)
+		server.outliers.forget(*record.Service)
+		server.flaps.forget(*record.Service)
+	case record.Op == walDrain || record.Op == walUndrain:
+		server.registry.Drain(*record.Service, record.Op == walDrain)
+	}
+}
+
+// captureState gets the state of the registry to send to a cluster member.
+func (server *Server) captureState() snapshot {
+	return snapshot{
+		Taken:    server.now(),
+		Services: server.registry.Records(),
+		Policies: server.registry.Policies(""),
+	}
+}
+
+// installState replaces the state of the registry with the state sent by the
+// cluster leader.
+func (server *Server) installState(state snapshot) {
+	services := make(map[string]bool)
+	for _, service := range state.Services {
+		server.registry.Restore(service)
+		server.checker.watch(service)
+		services[serviceKey(service)] = true
+	}
+	for _, service := range server.registry.Records() {
+		if !services[serviceKey(service)] {
+			server.registry.Remove(service)
+			server.checker.forget(service)
+			server.outliers.forget(service)
+			server.flaps.forget(service)
+		}
+	}
+	policies := make(map[string]bool)
+	for _, policy := range state.Policies {
+		server.registry.SetPolicy(policy)
+		policies[policy.Name] = true
+	}
+	for _, policy := range server.registry.Policies("") {
+		if !policies[policy.Name] {
+			server.registry.RemovePolicy(policy.Name)
+		}
+	}
+}
+
+// recoverState gives the services restored from the cluster state saved by
+// this member the grace period to renew. Services that had not expired by the
+// last change saved are kept active until the grace period has passed, so that
+// they have time to renew with the restarted cluster.
+func (server *Server) recoverState(taken time.Time, grace time.Duration) {
+	now := server.now()
+	// the registry fills in the TTL of services registered without one
+	for _, service := range server.registry.Records() {
+		restored := restoreWithGrace(service, taken, now, grace)
+		if !restored.Added.Equal(service.Added) {
+			server.registry.Restore(restored)
+		}
+	}
+}
+
+// routeRead forwards a read to the cluster leader if the consistency the
+// request requires cannot be met by this server. Returns true if the request
+// was answered.
+func (server *Server) routeRead(w http.ResponseWriter, r *http.Request) bool {
+	node := server.getCluster()
+	if node == nil {
+		return false
+	}
+	server.mutex.RLock()
+	consistency := server.consistency
+	server.mutex.RUnlock()
+	if requested := r.URL.Query().Get("consistency"); requested != "" {
+		consistency = Consistency(requested)
+	}
+	if !consistency.valid() {
+		log.Printf("bad request query from: %s\n", r.Host)
+		http.Error(w, "unknown consistency", http.StatusBadRequest)
+		return true
+	}
+	if consistency == ConsistencyStale {
+		return false
+	}
+	if node.leading() {
+		if consistency != ConsistencyLinearizable {
+			return false
+		}
+		if err := node.readBarrier(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	}
+	base, ok := node.leaderURL()
+	if !ok || r.Header.Get(forwardedHeader) != "" {
+		http.Error(w, errNoLeader.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	target, err := url.Parse(base)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	r.Header.Set(forwardedHeader, node.id)
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	return true
+}
+
+// handleRaft answers requests between members of a cluster.
+func (server *Server) handleRaft(w http.ResponseWriter, r *http.Request) {
+	node := server.getCluster()
+	if node == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !server.authenticator(r.Header.Get("Authorization")) {
+		log.Printf("unauthorized cluster request from: %s\n", r.Host)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/raft/status" {
+		server.writeJSON(w, node.status())
+		return
+	}
+	if r.Method != "POST" {
+		log.Printf("invalid request method from: %s\n", r.Host)
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Body == nil {
+		log.Printf("bad request body from: %s\n", r.Host)
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	var err error
+	switch r.URL.Path {
+	case "/raft/vote":
+		request := voteRequest{}
+		if err = decoder.Decode(&request); err == nil {
+			server.writeJSON(w, node.vote(request))
+		}
+	case "/raft/append":
+		request := appendRequest{}
+		if err = decoder.Decode(&request); err == nil {
+			server.writeJSON(w, node.appendEntries(request))
+		}
+	case "/raft/install":
+		request := installRequest{}
+		if err = decoder.Decode(&request); err != nil {
+			break
+		}
+		response, err := node.installState(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		server.writeJSON(w, response)
+	case "/raft/propose":
+		record := walRecord{}
+		if err = decoder.Decode(&record); err != nil {
+			break
+		}
+		index, err := node.propose(record)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		server.writeJSON(w, proposeResponse{Index: index})
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("bad request body from: %s\n", r.Host)
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+	}
+}
+
+// writeJSON writes a JSON response.
+func (server *Server) writeJSON(w http.ResponseWriter, value interface{}) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("error writing response to JSON: %s\n", err.Error())
+		http.Error(w, "failed to write response",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
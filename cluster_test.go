@@ -0,0 +1,487 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testMember is a server in a test cluster, keeping its cluster state in
+// the directory.
+type testMember struct {
+	id     string
+	dir    string
+	server *Server
+	http   *httptest.Server
+}
+
+// startCluster creates servers for a cluster of the size, enabling the
+// cluster on the first count of them.
+func startCluster(t *testing.T, size, count int) []*testMember {
+	log.SetOutput(ioutil.Discard)
+	members := make([]*testMember, size)
+	urls := make(map[string]string)
+	for i := range members {
+		server := NewServer(0, NullAuthenticator,
+			NewRandomRegistry(time.Minute, time.Hour), firstBalancer{})
+		members[i] = &testMember{id: fmt.Sprintf("node%d", i+1),
+			dir: tempDir(t), server: server,
+			http: httptest.NewServer(server.Handler)}
+		urls[members[i].id] = members[i].http.URL
+	}
+	for _, member := range members[:count] {
+		if err := member.server.EnableCluster(member.id, urls, "",
+			member.dir, time.Minute); err != nil {
+			t.Fatalf("failed to enable cluster: %v", err)
+		}
+	}
+	return members
+}
+
+// stopMember stops the server of a member, keeping its directory.
+func stopMember(member *testMember) {
+	member.http.Close()
+	member.server.Shutdown(context.Background())
+}
+
+// restartMember starts a stopped member again at the same URL with an empty
+// registry timed by the clock, restoring its cluster state from its directory.
+func restartMember(t *testing.T, member *testMember, urls map[string]string,
+	clock Clock) {
+	listener, err := net.Listen("tcp", member.http.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	member.server = NewServer(0, NullAuthenticator,
+		NewRandomRegistry(time.Minute, time.Hour), firstBalancer{})
+	member.server.SetClock(clock)
+	member.http = httptest.NewUnstartedServer(member.server.Handler)
+	member.http.Listener.Close()
+	member.http.Listener = listener
+	member.http.Start()
+	if err := member.server.EnableCluster(member.id, urls, "",
+		member.dir, time.Minute); err != nil {
+		t.Fatalf("failed to enable cluster: %v", err)
+	}
+}
+
+// stopCluster stops each server of a test cluster and removes its directory.
+func stopCluster(members []*testMember) {
+	for _, member := range members {
+		stopMember(member)
+		os.RemoveAll(member.dir)
+	}
+}
+
+// waitWithin waits for the condition to hold, failing the test after the
+// timeout.
+func waitWithin(t *testing.T, timeout time.Duration, condition func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLeader waits for one of the members to lead the cluster, and for the
+// others to follow it.
+func waitLeader(t *testing.T, members []*testMember) (*testMember,
+	[]*testMember) {
+	var leader *testMember
+	var followers []*testMember
+	waitWithin(t, 10*time.Second, func() bool {
+		leader, followers = nil, nil
+		for _, member := range members {
+			if member.server.getCluster().leading() {
+				leader = member
+			} else {
+				followers = append(followers, member)
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, follower := range followers {
+			if follower.server.getCluster().status().Leader != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader, followers
+}
+
+// send makes a request to a member and returns the response status and body.
+func send(t *testing.T, member *testMember, method, path,
+	body string) (int, string) {
+	req, err := http.NewRequest(method, member.http.URL+path,
+		bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(raw)
+}
+
+// TestEnableCluster tests enabling a cluster with a bad configuration.
+func TestEnableCluster(t *testing.T) {
+	server := NewRandomServer(64646, NullAuthenticator)
+	defer server.Shutdown(context.Background())
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	members := map[string]string{"node1": "http://localhost:64646"}
+	if err := server.EnableCluster("node2", members, "", dir,
+		time.Minute); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	snapshots := NewRandomServer(64647, NullAuthenticator)
+	defer snapshots.Shutdown(context.Background())
+	if _, err := snapshots.EnableSnapshots(dir, time.Hour,
+		time.Minute); err != nil {
+		t.Fatalf("failed to enable snapshots: %v", err)
+	}
+	if err := snapshots.EnableCluster("node1", members, "",
+		filepath.Join(dir, "raft"), time.Minute); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil,
+		0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := server.EnableCluster("node1", members, "",
+		filepath.Join(dir, "file"), time.Minute); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if err := server.EnableCluster("node1", members, "",
+		filepath.Join(dir, "raft"), time.Minute); err != nil {
+		t.Fatalf("failed to enable cluster: %v", err)
+	}
+	if err := server.EnableCluster("node1", members, "",
+		filepath.Join(dir, "raft"), time.Minute); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if _, err := server.EnableSnapshots(dir, time.Hour,
+		time.Minute); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if err := server.SetReadConsistency("eventual"); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+// TestCluster tests replicating changes made through any member.
+func TestCluster(t *testing.T) {
+	members := startCluster(t, 3, 3)
+	defer stopCluster(members)
+	_, followers := waitLeader(t, members)
+	table := []struct {
+		member   *testMember
+		method   string
+		path     string
+		body     string
+		status   int
+		expected []string
+	}{
+		{member: followers[0], method: "POST", path: "/register",
+			body:     `{"name":"service1","host":"host1"}`,
+			status:   http.StatusOK,
+			expected: []string{"host1"}},
+		{member: followers[1], method: "POST", path: "/register",
+			body:     `{"name":"service1","host":"host2"}`,
+			status:   http.StatusOK,
+			expected: []string{"host1", "host2"}},
+		{member: followers[0], method: "POST", path: "/drain",
+			body:     `{"name":"service1","host":"host1"}`,
+			status:   http.StatusOK,
+			expected: []string{"host2"}},
+		{member: followers[0], method: "POST", path: "/drain",
+			body:     `{"name":"service1","host":"hostX"}`,
+			status:   http.StatusNotFound,
+			expected: []string{"host2"}},
+		{member: followers[1], method: "DELETE", path: "/deregister",
+			body:     `{"name":"service1","host":"host2"}`,
+			status:   http.StatusOK,
+			expected: []string{}},
+		{member: followers[1], method: "DELETE", path: "/drain",
+			body:     `{"name":"service1","host":"host1"}`,
+			status:   http.StatusOK,
+			expected: []string{"host1"}},
+	}
+	for i, row := range table {
+		status, body := send(t, row.member, row.method, row.path, row.body)
+		if status != row.status {
+			t.Fatalf("expected: %d, got: %d %s; row %d", row.status, status,
+				body, i)
+		}
+		active := row.member.server.registry.Active(Filter{})
+		if fmt.Sprint(hostsOf(active)) != fmt.Sprint(row.expected) {
+			t.Fatalf("expected hosts: %v, got: %v; row %d", row.expected,
+				active, i)
+		}
+		for _, member := range members {
+			waitWithin(t, 5*time.Second, func() bool {
+				active := member.server.registry.Active(Filter{})
+				return fmt.Sprint(hostsOf(active)) == fmt.Sprint(row.expected)
+			})
+		}
+	}
+	status, body := send(t, followers[0], "POST", "/policy",
+		`{"name":"service1","splits":[{"tag":"canary","weight":1}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d %s", http.StatusOK, status, body)
+	}
+	for _, member := range members {
+		waitWithin(t, 5*time.Second, func() bool {
+			return len(member.server.registry.Policies("service1")) == 1
+		})
+	}
+}
+
+// hostsOf gets the host of each service.
+func hostsOf(services []Service) []string {
+	hosts := []string{}
+	for _, service := range services {
+		hosts = append(hosts, service.Host)
+	}
+	return hosts
+}
+
+// TestClusterReadConsistency tests answering reads from the leader when the
+// consistency requires it.
+func TestClusterReadConsistency(t *testing.T) {
+	members := startCluster(t, 3, 3)
+	defer stopCluster(members)
+	leader, followers := waitLeader(t, members)
+	// a change made to the leader alone shows which member answered
+	leader.server.registry.Add(Service{Name: "service1", Host: "host1"})
+	table := []struct {
+		query    string
+		status   int
+		expected int
+	}{
+		{query: "", status: http.StatusNotFound},
+		{query: "&consistency=stale", status: http.StatusNotFound},
+		{query: "&consistency=leader", status: http.StatusOK},
+		{query: "&consistency=linearizable", status: http.StatusOK},
+		{query: "&consistency=eventual", status: http.StatusBadRequest},
+	}
+	for i, row := range table {
+		status, body := send(t, followers[0], "GET",
+			"/discover?name=service1"+row.query, "")
+		if status != row.status {
+			t.Fatalf("expected: %d, got: %d %s; row %d", row.status, status,
+				body, i)
+		}
+	}
+	if err := followers[1].server.SetReadConsistency(
+		ConsistencyLeader); err != nil {
+		t.Fatalf("failed to set read consistency: %v", err)
+	}
+	if status, body := send(t, followers[1], "GET", "/list",
+		""); status != http.StatusOK || !bytes.Contains([]byte(body),
+		[]byte("host1")) {
+		t.Fatalf("expected list from leader, got: %d %s", status, body)
+	}
+	if status, _ := send(t, leader, "GET",
+		"/discover?name=service1&consistency=linearizable",
+		""); status != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, status)
+	}
+}
+
+// TestClusterFailover tests electing a new leader when the leader stops.
+func TestClusterFailover(t *testing.T) {
+	members := startCluster(t, 3, 3)
+	defer stopCluster(members)
+	leader, followers := waitLeader(t, members)
+	leader.http.Close()
+	leader.server.getCluster().stop()
+	leader, followers = waitLeader(t, followers)
+	status, body := send(t, followers[0], "POST", "/register",
+		`{"name":"service1","host":"host1"}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d %s", http.StatusOK, status, body)
+	}
+	waitWithin(t, 5*time.Second, func() bool {
+		return len(leader.server.registry.Active(Filter{})) == 1
+	})
+}
+
+// TestClusterCatchUp tests sending the registry state to a member that joins
+// after the entries it is missing were dropped from the log.
+func TestClusterCatchUp(t *testing.T) {
+	members := startCluster(t, 3, 2)
+	defer stopCluster(members)
+	for _, member := range members[:2] {
+		node := member.server.getCluster()
+		node.mutex.Lock()
+		node.compactAt = 2
+		node.mutex.Unlock()
+	}
+	leader, _ := waitLeader(t, members[:2])
+	for i := 1; i <= 5; i++ {
+		status, body := send(t, leader, "POST", "/register",
+			fmt.Sprintf(`{"name":"service1","host":"host%d"}`, i))
+		if status != http.StatusOK {
+			t.Fatalf("expected: %d, got: %d %s", http.StatusOK, status, body)
+		}
+	}
+	send(t, leader, "DELETE", "/deregister",
+		`{"name":"service1","host":"host1"}`)
+	late := members[2]
+	late.server.registry.Add(Service{Name: "service2", Host: "host1"})
+	urls := make(map[string]string)
+	for _, member := range members {
+		urls[member.id] = member.http.URL
+	}
+	if err := late.server.EnableCluster(late.id, urls, "", late.dir,
+		time.Minute); err != nil {
+		t.Fatalf("failed to enable cluster: %v", err)
+	}
+	waitWithin(t, 5*time.Second, func() bool {
+		active := late.server.registry.Active(Filter{})
+		return len(active) == 4 && active[0].Name == "service1"
+	})
+	if status := late.server.getCluster().status(); status.Leader !=
+		leader.id {
+		t.Fatalf("expected to follow %s, got: %v", leader.id, status)
+	}
+}
+
+// TestClusterRestart tests that committed registrations survive a majority of
+// members restarting while the remaining member is down.
+func TestClusterRestart(t *testing.T) {
+	members := startCluster(t, 3, 3)
+	defer stopCluster(members)
+	for _, member := range members {
+		node := member.server.getCluster()
+		node.mutex.Lock()
+		node.compactAt = 2
+		node.mutex.Unlock()
+	}
+	leader, followers := waitLeader(t, members)
+	for i := 1; i <= 5; i++ {
+		status, body := send(t, leader, "POST", "/register",
+			fmt.Sprintf(`{"name":"service1","host":"host%d"}`, i))
+		if status != http.StatusOK {
+			t.Fatalf("expected: %d, got: %d %s", http.StatusOK, status, body)
+		}
+	}
+	urls := make(map[string]string)
+	for _, member := range members {
+		urls[member.id] = member.http.URL
+	}
+	down := followers[1]
+	restarted := []*testMember{leader, followers[0]}
+	stopMember(down)
+	for _, member := range restarted {
+		stopMember(member)
+	}
+	for _, member := range restarted {
+		restartMember(t, member, urls, SystemClock)
+	}
+	leader, _ = waitLeader(t, restarted)
+	for _, member := range restarted {
+		waitWithin(t, 5*time.Second, func() bool {
+			return len(member.server.registry.Active(Filter{})) == 5
+		})
+	}
+	status, body := send(t, leader, "POST", "/register",
+		`{"name":"service1","host":"host6"}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d %s", http.StatusOK, status, body)
+	}
+	restartMember(t, down, urls, SystemClock)
+	waitWithin(t, 5*time.Second, func() bool {
+		return len(down.server.registry.Active(Filter{})) == 6
+	})
+}
+
+// TestClusterRestartExpired tests that a member restores services as of the
+// time their registrations were accepted, so that services which expired
+// before it restarted stay expired while active ones get the grace period.
+func TestClusterRestartExpired(t *testing.T) {
+	members := startCluster(t, 1, 1)
+	defer stopCluster(members)
+	member := members[0]
+	clock := NewFakeClock(time.Now())
+	member.server.SetClock(clock)
+	waitLeader(t, members)
+	registered := clock.Now()
+	for _, host := range []string{"host1", "host2"} {
+		status, body := send(t, member, "POST", "/register",
+			fmt.Sprintf(`{"name":"service1","host":"%s"}`, host))
+		if status != http.StatusOK {
+			t.Fatalf("expected: %d, got: %d %s", http.StatusOK, status, body)
+		}
+	}
+	clock.Advance(2 * time.Minute)
+	renewed := clock.Now()
+	send(t, member, "POST", "/register",
+		`{"name":"service1","host":"host2"}`)
+	clock.Advance(50 * time.Second)
+	urls := map[string]string{member.id: member.http.URL}
+	stopMember(member)
+	restartMember(t, member, urls, clock)
+	waitLeader(t, members)
+	hosts := make(map[string]Service)
+	waitWithin(t, 5*time.Second, func() bool {
+		for _, service := range member.server.registry.List("service1") {
+			hosts[service.Host] = service
+		}
+		return hosts["host2"].Added.Equal(clock.Now())
+	})
+	if host1 := hosts["host1"]; !host1.Added.Equal(registered) ||
+		host1.Status.Active() {
+		t.Fatalf("expected host1 expired since %v, got: %v", registered,
+			host1)
+	}
+	if active := member.server.registry.Active(Filter{}); len(active) != 1 ||
+		active[0].Host != "host2" {
+		t.Fatalf("expected host2 active after renewing at %v, got: %v",
+			renewed, active)
+	}
+}
@@ -2,10 +2,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bsladewski/discovery"
 )
@@ -19,6 +26,23 @@ func main() {
 	passPtr := flag.String("pass", "", "specifies password for basic auth")
 	certPtr := flag.String("cert", "", "specifies TLS certificate file")
 	keyPtr := flag.String("key", "", "specifies TLS key file")
+	balancerPtr := flag.String("balancer", "random",
+		"specifies load balancing: random, roundrobin, weighted, hash, "+
+			"leastload or twochoice")
+	dbPtr := flag.String("db", "",
+		"specifies file for a registry kept on disk")
+	dataPtr := flag.String("data-dir", "",
+		"specifies directory for registry snapshots and cluster state")
+	snapshotPtr := flag.Duration("snapshot-interval", time.Minute,
+		"specifies how often the registry is snapshotted")
+	gracePtr := flag.Duration("restore-grace", 30*time.Second,
+		"specifies how long restored services have to renew")
+	nodePtr := flag.String("node-id", "",
+		"specifies this server's id within a cluster")
+	peersPtr := flag.String("peers", "",
+		"specifies cluster members as id=url pairs separated by commas")
+	consistencyPtr := flag.String("read-consistency", "stale",
+		"specifies default read consistency: stale, leader or linearizable")
 	flag.Parse()
 	if (*certPtr != "" && *keyPtr == "") || (*certPtr == "" && *keyPtr != "") {
 		fmt.Fprintf(os.Stderr, "TLS requires both certificate and key!\n")
@@ -30,6 +54,53 @@ func main() {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	if (*nodePtr != "" && *peersPtr == "") || (*nodePtr == "" && *peersPtr != "") {
+		fmt.Fprintf(os.Stderr, "Clustering requires both node id and peers!\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *nodePtr != "" && *dataPtr == "" {
+		fmt.Fprintf(os.Stderr, "Clustering requires a data directory!\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *nodePtr != "" && *dbPtr != "" {
+		fmt.Fprintf(os.Stderr, "Clustering keeps the registry in the data "+
+			"directory and cannot use a registry on disk!\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	members := make(map[string]string)
+	if *peersPtr != "" {
+		for _, pair := range strings.Split(*peersPtr, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				fmt.Fprintf(os.Stderr, "Invalid peer: %s!\n", pair)
+				flag.PrintDefaults()
+				os.Exit(1)
+			}
+			members[parts[0]] = parts[1]
+		}
+	}
+	var balancer discovery.Balancer
+	switch *balancerPtr {
+	case "random":
+		balancer = discovery.NewRandomBalancer()
+	case "roundrobin":
+		balancer = discovery.NewRoundRobinBalancer()
+	case "weighted":
+		balancer = discovery.NewWeightedRoundRobinBalancer()
+	case "hash":
+		balancer = discovery.NewHashBalancer()
+	case "leastload":
+		balancer = discovery.NewLeastLoadBalancer()
+	case "twochoice":
+		balancer = discovery.NewTwoChoiceBalancer()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown balancer: %s!\n", *balancerPtr)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
 
 	// configure logging
 	if *logPtr != "" {
@@ -49,12 +120,70 @@ func main() {
 	if *userPtr != "" {
 		auth = discovery.NewBasicAuthenticator(*userPtr, *passPtr)
 	}
-	server := discovery.NewRandomServer(*portPtr, auth)
+	var registry discovery.Registry
+	if *dbPtr == "" {
+		registry = discovery.NewRandomRegistry(time.Minute, 12*time.Hour)
+	} else {
+		var err error
+		registry, err = discovery.NewDiskRegistry(*dbPtr, time.Minute,
+			12*time.Hour)
+		if err != nil {
+			log.Printf("failed to open registry: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	server := discovery.NewServer(*portPtr, auth, registry, balancer)
+	// a cluster member keeps the registry in its cluster state instead of
+	// snapshots
+	if *dataPtr != "" && *nodePtr == "" {
+		count, err := server.EnableSnapshots(*dataPtr, *snapshotPtr, *gracePtr)
+		if err != nil {
+			log.Printf("failed to restore snapshot: %s\n", err.Error())
+			os.Exit(1)
+		}
+		log.Printf("restored %d services from %s\n", count, *dataPtr)
+	}
+	if err := server.SetReadConsistency(
+		discovery.Consistency(*consistencyPtr)); err != nil {
+		log.Printf("failed to set read consistency: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *nodePtr != "" {
+		token := ""
+		if *userPtr != "" {
+			token = *userPtr + ":" + *passPtr
+		}
+		if err := server.EnableCluster(*nodePtr, members, token,
+			filepath.Join(*dataPtr, "raft"), *gracePtr); err != nil {
+			log.Printf("failed to join cluster: %s\n", err.Error())
+			os.Exit(1)
+		}
+		log.Printf("joined cluster as %s with %d members\n", *nodePtr,
+			len(members))
+	}
+
+	// shut down gracefully on interrupt
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		trap := make(chan os.Signal, 1)
+		signal.Notify(trap, os.Interrupt, syscall.SIGTERM)
+		<-trap
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("failed to shut down cleanly: %s\n", err.Error())
+		}
+	}()
 	var err error
-	if *certPtr != "" {
+	if *certPtr == "" {
 		err = server.ListenAndServe()
 	} else {
 		err = server.ListenAndServeTLS(*certPtr, *keyPtr)
 	}
+	if err == http.ErrServerClosed {
+		<-stopped
+	}
 	log.Printf("stopping service on port %d: %s\n", *portPtr, err.Error())
 }
@@ -0,0 +1,77 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+package discovery_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bsladewski/discovery"
+	"github.com/bsladewski/discovery/discoverytest"
+)
+
+// TestRandomRegistryConformance runs the conformance suite against the random
+// registry.
+func TestRandomRegistryConformance(t *testing.T) {
+	discoverytest.RunRegistryConformance(t, func(t *testing.T, timeout,
+		keep time.Duration) discovery.Registry {
+		return discovery.NewRandomRegistry(timeout, keep)
+	})
+}
+
+// TestShardedRegistryConformance runs the conformance suite against the
+// sharded registry.
+func TestShardedRegistryConformance(t *testing.T) {
+	discoverytest.RunRegistryConformance(t, func(t *testing.T, timeout,
+		keep time.Duration) discovery.Registry {
+		return discovery.NewShardedRegistry(timeout, keep)
+	})
+}
+
+// TestDiskRegistryConformance runs the conformance suite against the disk
+// registry.
+func TestDiskRegistryConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatalf("failed to create data directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	count := 0
+	discoverytest.RunRegistryConformance(t, func(t *testing.T, timeout,
+		keep time.Duration) discovery.Registry {
+		count++
+		registry, err := discovery.NewDiskRegistry(filepath.Join(dir,
+			fmt.Sprintf("registry%d.db", count)), timeout, keep)
+		if err != nil {
+			t.Fatalf("failed to open registry: %v", err)
+		}
+		return registry
+	})
+}
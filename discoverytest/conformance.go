@@ -0,0 +1,487 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discoverytest provides a conformance test suite for implementations
+// of the discovery Registry interface.
+package discoverytest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bsladewski/discovery"
+)
+
+// Factory creates an empty registry with the specified default timeout and
+// keep durations. Each conformance test stops the registry it creates.
+type Factory func(t *testing.T, timeout, keep time.Duration) discovery.Registry
+
+// RunRegistryConformance tests that the registries created by the factory
+// behave like the registries included in the discovery package. Services and
+// policies may be listed in any order. Time is controlled through a fake clock set on each
+// registry, so expiry must be driven by the clock passed to SetClock.
+func RunRegistryConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, factory Factory)
+	}{
+		{name: "Empty", test: testEmpty},
+		{name: "Add", test: testAdd},
+		{name: "Renew", test: testRenew},
+		{name: "Remove", test: testRemove},
+		{name: "Drain", test: testDrain},
+		{name: "Expire", test: testExpire},
+		{name: "ServiceLifetime", test: testServiceLifetime},
+		{name: "SetTimeout", test: testSetTimeout},
+		{name: "SetKeep", test: testSetKeep},
+		{name: "Filter", test: testFilter},
+		{name: "Policies", test: testPolicies},
+		{name: "Restore", test: testRestore},
+		{name: "Concurrency", test: testConcurrency},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, factory)
+		})
+	}
+}
+
+// start creates a registry timed by a fake clock.
+func start(t *testing.T, factory Factory, timeout,
+	keep time.Duration) (discovery.Registry, *discovery.FakeClock) {
+	registry := factory(t, timeout, keep)
+	clock := discovery.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0,
+		time.UTC))
+	registry.SetClock(clock)
+	return registry, clock
+}
+
+// advanceUntil advances the clock by the step until the condition holds,
+// giving the registry time to react to each step.
+func advanceUntil(t *testing.T, clock *discovery.FakeClock,
+	step time.Duration, condition func() bool) {
+	for i := 0; !condition(); i++ {
+		if i == 1000 {
+			t.Fatal("timed out waiting for condition")
+		}
+		clock.Advance(step)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// hosts gets the name and host of each service in order.
+func hosts(services []discovery.Service) []string {
+	keys := make([]string, len(services))
+	for i, service := range services {
+		keys[i] = service.Name + "/" + service.Host
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expectHosts fails the test unless the services are exactly those expected,
+// given as name/host in any order.
+func expectHosts(t *testing.T, services []discovery.Service,
+	expected ...string) {
+	t.Helper()
+	actual := hosts(services)
+	sort.Strings(expected)
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Fatalf("expected services: %v, got: %v", expected, actual)
+	}
+}
+
+// find gets the service with the name and host.
+func find(services []discovery.Service, name,
+	host string) (discovery.Service, bool) {
+	for _, service := range services {
+		if service.Name == name && service.Host == host {
+			return service, true
+		}
+	}
+	return discovery.Service{}, false
+}
+
+// testEmpty tests reading a registry without services.
+func testEmpty(t *testing.T, factory Factory) {
+	registry, _ := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	expectHosts(t, registry.Active(discovery.Filter{}))
+	expectHosts(t, registry.Active(discovery.Filter{Name: "service1"}))
+	expectHosts(t, registry.List(""))
+	expectHosts(t, registry.Records())
+	if policies := registry.Policies(""); len(policies) != 0 {
+		t.Fatalf("expected no policies, got: %v", policies)
+	}
+}
+
+// testAdd tests adding services and reading them back.
+func testAdd(t *testing.T, factory Factory) {
+	registry, clock := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	registry.Add(discovery.Service{Name: "service1", Host: "host1"})
+	registry.Add(discovery.Service{Name: "service1", Host: "host2"})
+	registry.Add(discovery.Service{Name: "service2", Host: "host1"})
+	expectHosts(t, registry.List(""), "service1/host1", "service1/host2",
+		"service2/host1")
+	expectHosts(t, registry.List("service1"), "service1/host1",
+		"service1/host2")
+	expectHosts(t, registry.Active(discovery.Filter{Name: "service2"}),
+		"service2/host1")
+	expectHosts(t, registry.List("serviceX"))
+	for _, service := range registry.List("") {
+		if !service.Added.Equal(clock.Now()) ||
+			service.Status != discovery.StatusPassing {
+			t.Fatalf("expected passing service added at %v, got: %v",
+				clock.Now(), service)
+		}
+	}
+	for _, record := range registry.Records() {
+		if time.Duration(record.TTL) != time.Minute ||
+			time.Duration(record.Keep) != time.Hour {
+			t.Fatalf("expected record with the default TTL and Keep, got: %v",
+				record)
+		}
+	}
+}
+
+// testRenew tests that adding a registered service renews it, replacing its
+// details and Added time but keeping Drain.
+func testRenew(t *testing.T, factory Factory) {
+	registry, clock := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	registry.Add(discovery.Service{Name: "service1", Host: "host1"})
+	if err := registry.Drain(discovery.Service{Name: "service1",
+		Host: "host1"}, true); err != nil {
+		t.Fatalf("failed to drain service: %v", err)
+	}
+	clock.Advance(30 * time.Second)
+	registry.Add(discovery.Service{Name: "service1", Host: "host1",
+		Tags: []string{"canary"}})
+	services := registry.List("service1")
+	expectHosts(t, services, "service1/host1")
+	service := services[0]
+	if !service.Added.Equal(clock.Now()) || !service.Drain ||
+		len(service.Tags) != 1 {
+		t.Fatalf("expected draining canary renewed at %v, got: %v",
+			clock.Now(), service)
+	}
+	clock.Advance(45 * time.Second)
+	if services := registry.List("service1"); len(services) != 1 ||
+		services[0].Status != discovery.StatusMaintenance {
+		t.Fatalf("expected renewed service in maintenance, got: %v",
+			services)
+	}
+}
+
+// testRemove tests removing services.
+func testRemove(t *testing.T, factory Factory) {
+	registry, _ := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	registry.Add(discovery.Service{Name: "service1", Host: "host1"})
+	registry.Add(discovery.Service{Name: "service1", Host: "host2"})
+	registry.Remove(discovery.Service{Name: "service1", Host: "host1"})
+	registry.Remove(discovery.Service{Name: "service1", Host: "hostX"})
+	registry.Remove(discovery.Service{Name: "serviceX", Host: "host1"})
+	expectHosts(t, registry.List(""), "service1/host2")
+	expectHosts(t, registry.Records(), "service1/host2")
+	if err := registry.Drain(discovery.Service{Name: "service1",
+		Host: "host1"}, true); err == nil {
+		t.Fatal("expected error draining removed service, got nil")
+	}
+}
+
+// testDrain tests that draining services keeps them listed but not active.
+func testDrain(t *testing.T, factory Factory) {
+	registry, _ := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	registry.Add(discovery.Service{Name: "service1", Host: "host1"})
+	registry.Add(discovery.Service{Name: "service1", Host: "host2"})
+	service := discovery.Service{Name: "service1", Host: "host1"}
+	if err := registry.Drain(service, true); err != nil {
+		t.Fatalf("failed to drain service: %v", err)
+	}
+	expectHosts(t, registry.Active(discovery.Filter{Name: "service1"}),
+		"service1/host2")
+	services := registry.List("service1")
+	expectHosts(t, services, "service1/host1", "service1/host2")
+	if drained, _ := find(services, "service1", "host1"); !drained.Drain ||
+		drained.Status != discovery.StatusMaintenance {
+		t.Fatalf("expected service in maintenance, got: %v", drained)
+	}
+	if err := registry.Drain(service, false); err != nil {
+		t.Fatalf("failed to undrain service: %v", err)
+	}
+	expectHosts(t, registry.Active(discovery.Filter{Name: "service1"}),
+		"service1/host1", "service1/host2")
+	if err := registry.Drain(discovery.Service{Name: "service1",
+		Host: "hostX"}, true); err == nil {
+		t.Fatal("expected error draining unknown service, got nil")
+	}
+}
+
+// testExpire tests that a service without renewal becomes critical once its
+// TTL passes and is removed once its keep duration passes, that each is
+// reported to expiry observers and that reads do not remove services.
+func testExpire(t *testing.T, factory Factory) {
+	registry, clock := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	started := clock.Now()
+	events := make(chan discovery.Expiry, 10)
+	registry.OnExpire(func(expiry discovery.Expiry) {
+		events <- expiry
+	})
+	registry.Add(discovery.Service{Name: "service1", Host: "host1"})
+	table := []struct {
+		removed  bool
+		deadline time.Duration
+		listed   bool
+	}{
+		{removed: false, deadline: time.Minute, listed: true},
+		{removed: true, deadline: time.Hour},
+	}
+	for _, row := range table {
+		var expiry discovery.Expiry
+		advanceUntil(t, clock, time.Minute, func() bool {
+			select {
+			case expiry = <-events:
+				return true
+			default:
+				return false
+			}
+		})
+		if expiry.Removed != row.removed || expiry.Service.Host != "host1" ||
+			expiry.Service.Status != discovery.StatusCritical {
+			t.Fatalf("expected critical host1 with removed: %t, got: %v",
+				row.removed, expiry)
+		}
+		if elapsed := clock.Now().Sub(started); elapsed < row.deadline {
+			t.Fatalf("expected event after: %v, got: %v", row.deadline,
+				elapsed)
+		}
+		expectHosts(t, registry.Active(discovery.Filter{}))
+		for i := 0; i < 2; i++ {
+			services := registry.List("service1")
+			if row.listed && (len(services) != 1 ||
+				services[0].Status != discovery.StatusCritical) {
+				t.Fatalf("expected critical service listed, got: %v",
+					services)
+			} else if !row.listed && len(services) != 0 {
+				t.Fatalf("expected service removed, got: %v", services)
+			}
+		}
+	}
+}
+
+// testServiceLifetime tests that a service's own TTL and Keep take precedence
+// over the registry defaults.
+func testServiceLifetime(t *testing.T, factory Factory) {
+	registry, clock := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	started := clock.Now()
+	registry.Add(discovery.Service{Name: "service1", Host: "host1",
+		TTL:  discovery.Duration(10 * time.Minute),
+		Keep: discovery.Duration(20 * time.Minute)})
+	registry.Add(discovery.Service{Name: "service1", Host: "host2"})
+	clock.Advance(2 * time.Minute)
+	advanceUntil(t, clock, 0, func() bool {
+		return len(registry.Active(discovery.Filter{})) == 1
+	})
+	expectHosts(t, registry.Active(discovery.Filter{}), "service1/host1")
+	if record, _ := find(registry.Records(), "service1",
+		"host1"); time.Duration(record.TTL) != 10*time.Minute {
+		t.Fatalf("expected record with TTL: 10m, got: %v", record)
+	}
+	advanceUntil(t, clock, time.Minute, func() bool {
+		_, ok := find(registry.List("service1"), "service1", "host1")
+		return !ok
+	})
+	if elapsed := clock.Now().Sub(started); elapsed < 20*time.Minute ||
+		elapsed >= time.Hour {
+		t.Fatalf("expected removal after its keep of 20m, got: %v", elapsed)
+	}
+	expectHosts(t, registry.List(""), "service1/host2")
+}
+
+// testSetTimeout tests changing the default timeout of registered services.
+func testSetTimeout(t *testing.T, factory Factory) {
+	registry, clock := start(t, factory, time.Hour, 2*time.Hour)
+	defer registry.Stop()
+	registry.Add(discovery.Service{Name: "service1", Host: "host1"})
+	clock.Advance(time.Minute)
+	expectHosts(t, registry.Active(discovery.Filter{}), "service1/host1")
+	registry.SetTimeout(time.Second)
+	expectHosts(t, registry.Active(discovery.Filter{}))
+	expectHosts(t, registry.List(""), "service1/host1")
+	registry.SetTimeout(time.Hour)
+	expectHosts(t, registry.Active(discovery.Filter{}), "service1/host1")
+}
+
+// testSetKeep tests changing the default keep duration of registered
+// services.
+func testSetKeep(t *testing.T, factory Factory) {
+	registry, clock := start(t, factory, time.Second, time.Hour)
+	defer registry.Stop()
+	registry.Add(discovery.Service{Name: "service1", Host: "host1"})
+	clock.Advance(time.Minute)
+	expectHosts(t, registry.List(""), "service1/host1")
+	registry.SetKeep(30 * time.Second)
+	advanceUntil(t, clock, 0, func() bool {
+		return len(registry.Records()) == 0
+	})
+	expectHosts(t, registry.List(""))
+}
+
+// testFilter tests selecting services by name, tags, metadata and selector.
+func testFilter(t *testing.T, factory Factory) {
+	registry, _ := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	registry.Add(discovery.Service{Name: "service1", Host: "host1",
+		Tags: []string{"canary"}, Meta: map[string]string{"env": "prod"}})
+	registry.Add(discovery.Service{Name: "service1", Host: "host2",
+		Meta: map[string]string{"env": "staging"}})
+	registry.Add(discovery.Service{Name: "service2", Host: "host1",
+		Tags: []string{"canary"}, Meta: map[string]string{"env": "prod"}})
+	registry.Drain(discovery.Service{Name: "service2", Host: "host1"}, true)
+	table := []struct {
+		filter   discovery.Filter
+		active   []string
+		expected []string
+	}{
+		{filter: discovery.Filter{Name: "service1"},
+			active:   []string{"service1/host1", "service1/host2"},
+			expected: []string{"service1/host1", "service1/host2"}},
+		{filter: discovery.Filter{Tags: []string{"canary"}},
+			active:   []string{"service1/host1"},
+			expected: []string{"service1/host1", "service2/host1"}},
+		{filter: discovery.Filter{Name: "service1",
+			Meta: map[string]string{"env": "staging"}},
+			active:   []string{"service1/host2"},
+			expected: []string{"service1/host2"}},
+		{filter: discovery.Filter{Selector: discovery.Selector{
+			discovery.In("env", "prod", "staging"),
+			discovery.NotEq("name", "service1")}},
+			expected: []string{"service2/host1"}},
+		{filter: discovery.Filter{Tags: []string{"stable"}}},
+	}
+	for _, row := range table {
+		expectHosts(t, registry.Active(row.filter), row.active...)
+		expectHosts(t, registry.ListMatching(row.filter), row.expected...)
+	}
+}
+
+// testPolicies tests setting, replacing and removing traffic policies.
+func testPolicies(t *testing.T, factory Factory) {
+	registry, _ := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	registry.SetPolicy(discovery.TrafficPolicy{Name: "service2"})
+	registry.SetPolicy(discovery.TrafficPolicy{Name: "service1"})
+	registry.SetPolicy(discovery.TrafficPolicy{Name: "service1",
+		Splits: []discovery.Split{{Tag: "canary", Weight: 1}}})
+	policies := registry.Policies("")
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+	if len(policies) != 2 || policies[0].Name != "service1" ||
+		policies[1].Name != "service2" {
+		t.Fatalf("expected policies for service1 and service2, got: %v",
+			policies)
+	}
+	policies = registry.Policies("service1")
+	if len(policies) != 1 || len(policies[0].Splits) != 1 {
+		t.Fatalf("expected replaced policy for service1, got: %v", policies)
+	}
+	registry.RemovePolicy("service1")
+	registry.RemovePolicy("serviceX")
+	if policies := registry.Policies("service1"); len(policies) != 0 {
+		t.Fatalf("expected policy removed, got: %v", policies)
+	}
+	if policies := registry.Policies(""); len(policies) != 1 {
+		t.Fatalf("expected policy for service2, got: %v", policies)
+	}
+}
+
+// testRestore tests that restored services keep their Added time and Drain.
+func testRestore(t *testing.T, factory Factory) {
+	registry, clock := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	added := clock.Now().Add(-2 * time.Minute)
+	registry.Add(discovery.Service{Name: "service1", Host: "host1"})
+	registry.Restore(discovery.Service{Name: "service1", Host: "host1",
+		Added: added, Drain: true})
+	registry.Restore(discovery.Service{Name: "service1", Host: "host2",
+		Added: added, TTL: discovery.Duration(time.Hour)})
+	records := registry.Records()
+	expectHosts(t, records, "service1/host1", "service1/host2")
+	for _, record := range records {
+		if !record.Added.Equal(added) || record.Drain != (record.Host ==
+			"host1") {
+			t.Fatalf("expected record restored as is, got: %v", record)
+		}
+	}
+	expectHosts(t, registry.Active(discovery.Filter{}), "service1/host2")
+}
+
+// testConcurrency tests adding, draining, removing and reading services from
+// many goroutines at once.
+func testConcurrency(t *testing.T, factory Factory) {
+	registry, _ := start(t, factory, time.Minute, time.Hour)
+	defer registry.Stop()
+	const workers, count = 8, 20
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				service := discovery.Service{Name: name,
+					Host: fmt.Sprintf("host%d", j)}
+				registry.Add(service)
+				registry.Add(service)
+				registry.Active(discovery.Filter{Name: name})
+				registry.List("")
+				if j%2 == 0 {
+					registry.Drain(service, true)
+					registry.Remove(service)
+				}
+			}
+		}(fmt.Sprintf("service%d", i))
+	}
+	wg.Wait()
+	services := registry.List("")
+	if len(services) != workers*count/2 {
+		t.Fatalf("expected %d services, got: %d", workers*count/2,
+			len(services))
+	}
+	if active := registry.Active(discovery.Filter{}); len(active) !=
+		len(services) {
+		t.Fatalf("expected every service active, got: %d of %d",
+			len(active), len(services))
+	}
+}
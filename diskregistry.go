@@ -0,0 +1,379 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// servicePrefix and policyPrefix begin the keys under which a disk registry
+// stores services and traffic policies.
+const (
+	servicePrefix = "services/"
+	policyPrefix  = "policies/"
+)
+
+// diskRegistry implements Registry by keeping services and traffic policies in
+// an embedded key/value store on disk, so that registrations survive a restart
+// without an external database. Services and policies are also held in memory,
+// so reads do not touch the disk; the store is only written to and read back
+// when the registry is opened. Memory is only changed once the store has been
+// written, so a change that fails to reach the store is not served either. It
+// behaves like randomRegistry, except that services are listed in order of
+// name and host.
+type diskRegistry struct {
+	kv        *kvStore
+	services  map[string]Service // services holds each service by its key, see serviceKey.
+	keys      []string           // keys holds the keys of the services in order.
+	policies  map[string]TrafficPolicy
+	timeout   time.Duration
+	keep      time.Duration
+	mutex     *sync.RWMutex
+	reaper    *reaper
+	observers []func(expiry Expiry)
+	clock     Clock
+}
+
+// load reads the services and policies in the store into memory.
+func (r *diskRegistry) load() error {
+	for _, key := range r.kv.keys("") {
+		raw, _, err := r.kv.get(key)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(key, servicePrefix):
+			service := Service{}
+			if err := json.Unmarshal(raw, &service); err != nil {
+				return fmt.Errorf("failed to read service %s: %s", key,
+					err.Error())
+			}
+			r.services[serviceKey(service)] = service
+			r.keys = append(r.keys, serviceKey(service))
+		case strings.HasPrefix(key, policyPrefix):
+			policy := TrafficPolicy{}
+			if err := json.Unmarshal(raw, &policy); err != nil {
+				return fmt.Errorf("failed to read policy %s: %s", key,
+					err.Error())
+			}
+			r.policies[policy.Name] = policy
+		}
+	}
+	sort.Strings(r.keys)
+	return nil
+}
+
+// store writes a service to the store and, once written, to memory. A lazy
+// write does not wait for the service to reach disk. Returns an error, leaving
+// memory unchanged, if the service could not be written.
+func (r *diskRegistry) store(service Service, lazy bool) error {
+	key := serviceKey(service)
+	raw, err := json.Marshal(service)
+	if err == nil && lazy {
+		err = r.kv.putLazy(servicePrefix+key, raw)
+	} else if err == nil {
+		err = r.kv.put(servicePrefix+key, raw)
+	}
+	if err != nil {
+		log.Printf("failed to write service %s at %s: %s\n", service.Name,
+			service.Host, err.Error())
+		return err
+	}
+	if _, ok := r.services[key]; !ok {
+		idx := sort.SearchStrings(r.keys, key)
+		r.keys = append(r.keys, "")
+		copy(r.keys[idx+1:], r.keys[idx:])
+		r.keys[idx] = key
+	}
+	r.services[key] = service
+	return nil
+}
+
+// remove deletes the service with the key from the store and, once deleted,
+// from memory. Returns false if the service is still held.
+func (r *diskRegistry) remove(key string) bool {
+	if _, ok := r.services[key]; !ok {
+		return true
+	}
+	if err := r.kv.delete(servicePrefix + key); err != nil {
+		log.Printf("failed to remove service: %s\n", err.Error())
+		return false
+	}
+	delete(r.services, key)
+	idx := sort.SearchStrings(r.keys, key)
+	r.keys = append(r.keys[:idx], r.keys[idx+1:]...)
+	return true
+}
+
+// schedule sets the deadlines at which the service expires and is removed.
+func (r *diskRegistry) schedule(service Service) {
+	ttl, keep := service.lifetime(r.timeout, r.keep)
+	key := serviceKey(service)
+	r.reaper.schedule(key, service.Added.Add(ttl), false)
+	r.reaper.schedule(key, service.Added.Add(keep), true)
+}
+
+// reap raises an expiry event for the service with the key if its deadline has
+// passed, removing the service if remove is true.
+func (r *diskRegistry) reap(key string, remove bool) {
+	r.mutex.Lock()
+	service, ok := r.services[key]
+	if !ok {
+		r.mutex.Unlock()
+		return
+	}
+	ttl, keep := service.lifetime(r.timeout, r.keep)
+	age := r.clock.Now().Sub(service.Added)
+	if (!remove && age < ttl) || (remove && age < keep) {
+		r.mutex.Unlock()
+		return
+	}
+	if remove {
+		if !r.remove(key) {
+			r.mutex.Unlock()
+			return
+		}
+		r.reaper.cancel(key)
+	}
+	expiry := Expiry{Service: deriveStatus(service, r.timeout, r.keep,
+		r.clock.Now()), Removed: remove}
+	observers := r.observers
+	r.mutex.Unlock()
+	for _, observer := range observers {
+		observer(expiry)
+	}
+}
+
+// getAll gets all active services matching the filter. Optionally includes
+// inactive services if inactive is true. Services past their keep duration
+// that have yet to be removed are left out.
+func (r *diskRegistry) getAll(filter Filter, inactive bool) []Service {
+	var services []Service
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	now := r.clock.Now()
+	for _, key := range r.keys {
+		service := r.services[key]
+		_, keep := service.lifetime(r.timeout, r.keep)
+		if now.Sub(service.Added) > keep {
+			continue
+		}
+		service = deriveStatus(service, r.timeout, r.keep, now)
+		if filter.Matches(service) && (inactive || service.Status.Active()) {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// Add registers or renews a service. A new service is synced to disk before
+// Add returns, while a renewal is written lazily: a crash may lose the most
+// recent renewals, restoring those services with an earlier Added time until
+// they renew again.
+func (r *diskRegistry) Add(service Service) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	service.Added = r.clock.Now()
+	existing, renew := r.services[serviceKey(service)]
+	if renew {
+		service.Drain = existing.Drain
+	}
+	if r.store(service, renew) == nil {
+		r.schedule(service)
+	}
+}
+
+func (r *diskRegistry) Remove(service Service) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.remove(serviceKey(service)) {
+		r.reaper.cancel(serviceKey(service))
+	}
+}
+
+func (r *diskRegistry) Restore(service Service) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.store(service, false) == nil {
+		r.schedule(service)
+	}
+}
+
+func (r *diskRegistry) Records() []Service {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	services := make([]Service, 0, len(r.keys))
+	for _, key := range r.keys {
+		service := r.services[key]
+		ttl, keep := service.lifetime(r.timeout, r.keep)
+		service.TTL, service.Keep = Duration(ttl), Duration(keep)
+		services = append(services, service)
+	}
+	return services
+}
+
+func (r *diskRegistry) Drain(service Service, drain bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	existing, ok := r.services[serviceKey(service)]
+	if !ok {
+		return fmt.Errorf("no such service '%s' on '%s'", service.Name,
+			service.Host)
+	}
+	existing.Drain = drain
+	return r.store(existing, false)
+}
+
+func (r *diskRegistry) Active(filter Filter) []Service {
+	return r.getAll(filter, false)
+}
+
+func (r *diskRegistry) List(name string) []Service {
+	return r.ListMatching(Filter{Name: name})
+}
+
+func (r *diskRegistry) ListMatching(filter Filter) []Service {
+	return r.getAll(filter, true)
+}
+
+func (r *diskRegistry) SetPolicy(policy TrafficPolicy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	raw, err := json.Marshal(policy)
+	if err == nil {
+		err = r.kv.put(policyPrefix+policy.Name, raw)
+	}
+	if err != nil {
+		log.Printf("failed to write policy %s: %s\n", policy.Name, err.Error())
+		return
+	}
+	r.policies[policy.Name] = policy
+}
+
+func (r *diskRegistry) RemovePolicy(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.kv.delete(policyPrefix + name); err != nil {
+		log.Printf("failed to remove policy %s: %s\n", name, err.Error())
+		return
+	}
+	delete(r.policies, name)
+}
+
+func (r *diskRegistry) Policies(name string) []TrafficPolicy {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var policies []TrafficPolicy
+	for _, policy := range r.policies {
+		if name == "" || name == policy.Name {
+			policies = append(policies, policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+	return policies
+}
+
+func (r *diskRegistry) SetTimeout(timeout time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.timeout = timeout
+	for _, service := range r.services {
+		r.schedule(service)
+	}
+}
+
+func (r *diskRegistry) SetKeep(keep time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.keep = keep
+	for _, service := range r.services {
+		r.schedule(service)
+	}
+}
+
+func (r *diskRegistry) OnExpire(observer func(expiry Expiry)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.observers = append(r.observers, observer)
+}
+
+func (r *diskRegistry) SetClock(clock Clock) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock = clock
+	r.reaper.setClock(clock)
+}
+
+// Stop stops the reaper and closes the store. The registry cannot be used once
+// it is stopped.
+func (r *diskRegistry) Stop() {
+	r.reaper.stop()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.kv.close(); err != nil {
+		log.Printf("failed to close registry: %s\n", err.Error())
+	}
+}
+
+// NewDiskRegistry creates a Registry kept in an embedded key/value store in the
+// file at the specified path, creating the file if it does not exist. Services
+// stored by a previous run are restored as they were, and expire and are
+// removed on schedule.
+func NewDiskRegistry(path string, timeout time.Duration,
+	keep time.Duration) (Registry, error) {
+	kv, err := openKVStore(path)
+	if err != nil {
+		return nil, err
+	}
+	registry := &diskRegistry{
+		kv:       kv,
+		services: make(map[string]Service),
+		policies: make(map[string]TrafficPolicy),
+		timeout:  timeout,
+		keep:     keep,
+		mutex:    &sync.RWMutex{},
+		clock:    SystemClock,
+	}
+	if err := registry.load(); err != nil {
+		kv.close()
+		return nil, err
+	}
+	registry.reaper = newReaper(registry.reap)
+	for _, service := range registry.services {
+		registry.schedule(service)
+	}
+	return registry, nil
+}
@@ -0,0 +1,251 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDiskRegistry tests adding, renewing, draining and removing services kept
+// on disk, and reading them back after the registry is reopened.
+func TestDiskRegistry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.db")
+	registry, err := NewDiskRegistry(path, time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+	for _, host := range []string{"host3", "host1", "host2"} {
+		registry.Add(Service{Name: "service1", Host: host})
+	}
+	registry.Add(Service{Name: "service2", Host: "host1"})
+	if err := registry.Drain(Service{Name: "service1", Host: "host2"},
+		true); err != nil {
+		t.Fatalf("failed to drain service: %v", err)
+	}
+	if err := registry.Drain(Service{Name: "service1", Host: "hostX"},
+		true); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	registry.Add(Service{Name: "service1", Host: "host2",
+		Tags: []string{"canary"}})
+	registry.Remove(Service{Name: "service2", Host: "host1"})
+	registry.SetPolicy(TrafficPolicy{Name: "service1"})
+	registry.SetPolicy(TrafficPolicy{Name: "service2"})
+	registry.RemovePolicy("service2")
+	registry.Stop()
+	registry, err = NewDiskRegistry(path, time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reopen registry: %v", err)
+	}
+	defer registry.Stop()
+	table := []struct {
+		filter        Filter
+		inactive      bool
+		expectedHosts []string
+	}{
+		{filter: Filter{Name: "service1"},
+			expectedHosts: []string{"host1", "host3"}},
+		{filter: Filter{Name: "service1"}, inactive: true,
+			expectedHosts: []string{"host1", "host2", "host3"}},
+		{filter: Filter{Tags: []string{"canary"}}, inactive: true,
+			expectedHosts: []string{"host2"}},
+		{filter: Filter{Name: "service2"}, inactive: true},
+	}
+	for _, row := range table {
+		services := registry.Active(row.filter)
+		if row.inactive {
+			services = registry.ListMatching(row.filter)
+		}
+		if len(services) != len(row.expectedHosts) {
+			t.Fatalf("expected hosts: %v, got: %v", row.expectedHosts,
+				services)
+		}
+		for i, service := range services {
+			if service.Host != row.expectedHosts[i] {
+				t.Fatalf("expected hosts: %v, got: %v", row.expectedHosts,
+					services)
+			}
+		}
+	}
+	if policies := registry.Policies(""); len(policies) != 1 ||
+		policies[0].Name != "service1" {
+		t.Fatalf("expected policy for service1, got: %v", policies)
+	}
+}
+
+// TestDiskRegistryMemory tests reading services and policies without reading
+// the store.
+func TestDiskRegistryMemory(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	registry, err := NewDiskRegistry(filepath.Join(dir, "registry.db"),
+		time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+	defer registry.Stop()
+	registry.Add(Service{Name: "service1", Host: "host1"})
+	registry.SetPolicy(TrafficPolicy{Name: "service1"})
+	registry.(*diskRegistry).kv.close()
+	if active := registry.Active(Filter{Name: "service1"}); len(active) != 1 {
+		t.Fatalf("expected service1 on host1, got: %v", active)
+	}
+	if policies := registry.Policies("service1"); len(policies) != 1 {
+		t.Fatalf("expected policy for service1, got: %v", policies)
+	}
+}
+
+// TestDiskRegistryWriteFailure tests leaving services and policies in memory
+// unchanged when they cannot be written to the store.
+func TestDiskRegistryWriteFailure(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	clock := NewFakeClock(time.Now())
+	registry, err := NewDiskRegistry(filepath.Join(dir, "registry.db"),
+		time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+	registry.SetClock(clock)
+	defer registry.Stop()
+	registry.Add(Service{Name: "service1", Host: "host1"})
+	registry.SetPolicy(TrafficPolicy{Name: "service1"})
+	added := registry.List("")[0].Added
+	// every write fails once the store is closed
+	registry.(*diskRegistry).kv.close()
+	clock.Advance(time.Second)
+	registry.Add(Service{Name: "service1", Host: "host1"})
+	registry.Add(Service{Name: "service1", Host: "host2"})
+	registry.Restore(Service{Name: "service2", Host: "host1",
+		Added: clock.Now()})
+	if err := registry.Drain(Service{Name: "service1", Host: "host1"},
+		true); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	registry.Remove(Service{Name: "service1", Host: "host1"})
+	registry.SetPolicy(TrafficPolicy{Name: "service2"})
+	registry.RemovePolicy("service1")
+	services := registry.List("")
+	if len(services) != 1 || services[0].Host != "host1" ||
+		services[0].Drain || !services[0].Added.Equal(added) {
+		t.Fatalf("expected host1 unchanged, got: %v", services)
+	}
+	policies := registry.Policies("")
+	if len(policies) != 1 || policies[0].Name != "service1" {
+		t.Fatalf("expected policy for service1, got: %v", policies)
+	}
+	// a service that cannot be removed from the store stays held
+	events := make(chan Expiry, 10)
+	registry.OnExpire(func(expiry Expiry) {
+		events <- expiry
+	})
+	clock.Advance(2 * time.Hour)
+	if expiry := <-events; expiry.Removed {
+		t.Fatalf("expected host1 expired, got: %v", expiry)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if records := registry.Records(); len(records) != 1 || len(events) != 0 {
+		t.Fatalf("expected host1 held, got: %v", records)
+	}
+}
+
+// TestDiskRegistryExpire tests expiring and removing services kept on disk,
+// including services stored before the registry was reopened.
+func TestDiskRegistryExpire(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.db")
+	clock := NewFakeClock(time.Now())
+	registry, err := NewDiskRegistry(path, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+	registry.SetClock(clock)
+	registry.Add(Service{Name: "service1", Host: "host1"})
+	registry.Stop()
+	registry, err = NewDiskRegistry(path, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reopen registry: %v", err)
+	}
+	registry.SetClock(clock)
+	defer registry.Stop()
+	events := make(chan Expiry, 10)
+	registry.OnExpire(func(expiry Expiry) {
+		events <- expiry
+	})
+	for _, removed := range []bool{false, true} {
+		var expiry Expiry
+		advanceUntil(t, clock, time.Minute, func() bool {
+			select {
+			case expiry = <-events:
+				return true
+			default:
+				return false
+			}
+		})
+		if expiry.Removed != removed || expiry.Service.Host != "host1" {
+			t.Fatalf("expected removed: %t for host1, got: %v", removed,
+				expiry)
+		}
+	}
+	if services := registry.List(""); len(services) != 0 {
+		t.Fatalf("expected empty registry, got: %v", services)
+	}
+}
+
+// TestDiskRegistryRestore tests restoring services into a disk registry.
+func TestDiskRegistryRestore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	registry, err := NewDiskRegistry(filepath.Join(dir, "registry.db"),
+		time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+	defer registry.Stop()
+	testRestore(t, registry)
+}
+
+// TestDiskRegistryMissing tests opening a registry in a missing directory.
+func TestDiskRegistryMissing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	_, err := NewDiskRegistry(filepath.Join(dir, "missing", "registry.db"),
+		time.Minute, time.Hour)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
@@ -0,0 +1,110 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Filter restricts the services returned by a registry. An empty Name matches
+// every service, each of Tags must be present on a matching service and each
+// entry of Meta must match the service metadata exactly. A matching service
+// must also satisfy the Selector.
+type Filter struct {
+	Name     string
+	Tags     []string
+	Meta     map[string]string
+	Selector Selector
+}
+
+// hasTag returns true if the service carries the specified tag.
+func (service Service) hasTag(tag string) bool {
+	for _, t := range service.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if the service satisfies the filter.
+func (filter Filter) Matches(service Service) bool {
+	if filter.Name != "" && filter.Name != service.Name {
+		return false
+	}
+	for _, tag := range filter.Tags {
+		if !service.hasTag(tag) {
+			return false
+		}
+	}
+	for key, value := range filter.Meta {
+		if actual, ok := service.Meta[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return filter.Selector.Matches(service)
+}
+
+// scope identifies the requests made with the filter, regardless of the order
+// of its tags and metadata.
+func (filter Filter) scope() string {
+	tags := append([]string(nil), filter.Tags...)
+	sort.Strings(tags)
+	meta := make([]string, 0, len(filter.Meta))
+	for key, value := range filter.Meta {
+		meta = append(meta, key+"="+value)
+	}
+	sort.Strings(meta)
+	return strings.Join([]string{filter.Name, strings.Join(tags, ","),
+		strings.Join(meta, ","), filter.Selector.String()}, "\x00")
+}
+
+// parseFilter reads a filter from the query parameters of a request. The name
+// parameter sets the service name, each tag parameter adds a required tag and
+// each meta.<key> parameter adds a required metadata value. The q parameter
+// holds a selector which is parsed into the filter.
+func parseFilter(query url.Values) (Filter, error) {
+	selector, err := ParseSelector(query.Get("q"))
+	if err != nil {
+		return Filter{}, err
+	}
+	filter := Filter{Name: query.Get("name"), Tags: query["tag"],
+		Selector: selector}
+	for key, values := range query {
+		if !strings.HasPrefix(key, "meta.") || len(values) == 0 {
+			continue
+		}
+		if filter.Meta == nil {
+			filter.Meta = make(map[string]string)
+		}
+		filter.Meta[strings.TrimPrefix(key, "meta.")] = values[0]
+	}
+	return filter, nil
+}
@@ -0,0 +1,144 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"net/url"
+	"testing"
+)
+
+// TestFilterMatches tests the Filter.Matches function.
+func TestFilterMatches(t *testing.T) {
+	service := Service{Name: "service1", Host: "host1",
+		Meta: map[string]string{"env": "prod", "zone": "a"},
+		Tags: []string{"canary", "blue"}}
+	table := []struct {
+		filter   Filter
+		expected bool
+	}{
+		{filter: Filter{}, expected: true},
+		{filter: Filter{Name: "service1"}, expected: true},
+		{filter: Filter{Name: "service2"}, expected: false},
+		{filter: Filter{Tags: []string{"canary"}}, expected: true},
+		{filter: Filter{Tags: []string{"canary", "green"}}, expected: false},
+		{filter: Filter{Meta: map[string]string{"env": "prod"}},
+			expected: true},
+		{filter: Filter{Meta: map[string]string{"env": "dev"}},
+			expected: false},
+		{filter: Filter{Meta: map[string]string{"version": ""}},
+			expected: false},
+		{filter: Filter{Name: "service1", Tags: []string{"blue"},
+			Meta: map[string]string{"zone": "a"}}, expected: true},
+	}
+	for _, row := range table {
+		if matches := row.filter.Matches(service); matches != row.expected {
+			t.Fatalf("expected: %t, got: %t; %v", row.expected, matches, row)
+		}
+	}
+}
+
+// TestParseFilter tests the parseFilter function.
+func TestParseFilter(t *testing.T) {
+	query, err := url.ParseQuery(
+		"name=service1&tag=canary&tag=blue&meta.env=prod&other=ignored")
+	if err != nil {
+		t.Fatalf("failed to parse query: %s", err.Error())
+	}
+	filter, err := parseFilter(query)
+	if err != nil {
+		t.Fatalf("failed to parse filter: %s", err.Error())
+	}
+	if filter.Name != "service1" {
+		t.Fatalf("expected name: service1, got: %s", filter.Name)
+	}
+	if len(filter.Tags) != 2 || filter.Tags[1] != "blue" {
+		t.Fatalf("unexpected tags: %v", filter.Tags)
+	}
+	if len(filter.Meta) != 1 || filter.Meta["env"] != "prod" {
+		t.Fatalf("unexpected metadata: %v", filter.Meta)
+	}
+}
+
+// TestParseFilterSelector tests parsing the selector query parameter.
+func TestParseFilterSelector(t *testing.T) {
+	table := []struct {
+		query       string
+		expectedLen int
+		expectedErr bool
+	}{
+		{query: "q=env%3Dprod%2Cversion%3E%3D2", expectedLen: 2},
+		{query: "q=", expectedLen: 0},
+		{query: "q=env+in+(prod", expectedErr: true},
+	}
+	for _, row := range table {
+		query, err := url.ParseQuery(row.query)
+		if err != nil {
+			t.Fatalf("failed to parse query: %s", err.Error())
+		}
+		filter, err := parseFilter(query)
+		if row.expectedErr {
+			if err == nil {
+				t.Fatalf("expected error, got nil; %v", row)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to parse filter: %s; %v", err.Error(), row)
+		}
+		if length := len(filter.Selector); length != row.expectedLen {
+			t.Fatalf("expected: %d, got: %d; %v", row.expectedLen, length,
+				row)
+		}
+	}
+}
+
+// TestFilterScope tests identifying the requests made with a filter.
+func TestFilterScope(t *testing.T) {
+	base := Filter{Name: "service1", Tags: []string{"canary", "blue"},
+		Meta: map[string]string{"env": "prod", "zone": "a"}}
+	table := []struct {
+		filter   Filter
+		expected bool
+	}{
+		{filter: Filter{Name: "service1", Tags: []string{"blue", "canary"},
+			Meta: map[string]string{"zone": "a", "env": "prod"}},
+			expected: true},
+		{filter: Filter{Name: "service2", Tags: []string{"canary", "blue"},
+			Meta: map[string]string{"env": "prod", "zone": "a"}}},
+		{filter: Filter{Name: "service1", Tags: []string{"canary"},
+			Meta: map[string]string{"env": "prod", "zone": "a"}}},
+		{filter: Filter{Name: "service1", Tags: []string{"canary", "blue"},
+			Meta: map[string]string{"env": "dev", "zone": "a"}}},
+	}
+	for i, row := range table {
+		if same := row.filter.scope() == base.scope(); same != row.expected {
+			t.Fatalf("expected same scope: %t, got: %t; row %d",
+				row.expected, same, i)
+		}
+	}
+}
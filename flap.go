@@ -0,0 +1,188 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// Default flap detection settings used by a new server.
+const (
+	defaultFlapThreshold = 4
+	defaultFlapWindow    = 5 * time.Minute
+	defaultFlapStable    = 2 * time.Minute
+)
+
+// flapState tracks the changes in whether a single replicant is up.
+type flapState struct {
+	up          bool        // up is whether the replicant was last seen up.
+	seen        time.Time   // seen is when the replicant was last observed.
+	changed     time.Time   // changed is when the replicant last changed.
+	transitions []time.Time // transitions holds the times of recent changes.
+	flapping    bool        // flapping is whether the replicant is held out.
+}
+
+// trim drops transitions older than the window.
+func (state *flapState) trim(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(state.transitions) && now.Sub(state.transitions[i]) > window {
+		i++
+	}
+	state.transitions = state.transitions[i:]
+}
+
+// flapDetector holds out replicants that keep going up and down. A replicant
+// that changes threshold times within the window is flapping until it goes the
+// stable duration without changing.
+type flapDetector struct {
+	threshold int
+	window    time.Duration
+	stable    time.Duration
+	states    map[string]*flapState
+	pruned    time.Time
+	clock     Clock
+	mutex     *sync.Mutex
+}
+
+// newFlapDetector creates a flap detector with the default settings.
+func newFlapDetector() *flapDetector {
+	return &flapDetector{
+		threshold: defaultFlapThreshold,
+		window:    defaultFlapWindow,
+		stable:    defaultFlapStable,
+		states:    make(map[string]*flapState),
+		clock:     SystemClock,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// configure updates the flap detection settings. A threshold of zero or less
+// disables flap detection.
+func (d *flapDetector) configure(threshold int, window, stable time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.threshold, d.window, d.stable = threshold, window, stable
+}
+
+// setClock sets the clock transitions are timed by.
+func (d *flapDetector) setClock(clock Clock) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.clock = clock
+}
+
+// observe records whether the service is up, counting a transition if it
+// changed since it was last observed.
+func (d *flapDetector) observe(service Service, up bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := d.clock.Now()
+	d.prune(now)
+	key := serviceKey(service)
+	state, ok := d.states[key]
+	if !ok {
+		d.states[key] = &flapState{up: up, seen: now}
+		return
+	}
+	state.seen = now
+	d.settle(state, now)
+	if state.up == up {
+		return
+	}
+	state.up = up
+	state.trim(now, d.window)
+	state.transitions = append(state.transitions, now)
+	state.changed = now
+	if d.threshold > 0 && len(state.transitions) >= d.threshold {
+		state.flapping = true
+	}
+}
+
+// prune drops transitions outside the window, ends flapping for replicants
+// that have been stable and forgets replicants not observed within the window.
+// Replicants are pruned at most once per window.
+func (d *flapDetector) prune(now time.Time) {
+	if now.Sub(d.pruned) < d.window {
+		return
+	}
+	d.pruned = now
+	for key, state := range d.states {
+		d.settle(state, now)
+		state.trim(now, d.window)
+		if now.Sub(state.seen) > d.window && !state.flapping {
+			delete(d.states, key)
+		}
+	}
+}
+
+// forget stops tracking the service.
+func (d *flapDetector) forget(service Service) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.states, serviceKey(service))
+}
+
+// flapping returns true if the service is flapping.
+func (d *flapDetector) flapping(service Service) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	state, ok := d.states[serviceKey(service)]
+	if !ok {
+		return false
+	}
+	d.settle(state, d.clock.Now())
+	return state.flapping
+}
+
+// settle ends flapping for a replicant that has not changed for the stable
+// duration, starting its count of transitions over.
+func (d *flapDetector) settle(state *flapState, now time.Time) {
+	if state.flapping &&
+		(d.threshold <= 0 || now.Sub(state.changed) >= d.stable) {
+		state.flapping = false
+		state.transitions = nil
+	}
+}
+
+// steady gets the services that are not flapping.
+func (d *flapDetector) steady(services []Service) []Service {
+	var steady []Service
+	for _, service := range services {
+		if !d.flapping(service) {
+			steady = append(steady, service)
+		}
+	}
+	return steady
+}
+
+// annotate gets the service marked if it is flapping.
+func (d *flapDetector) annotate(service Service) Service {
+	service.Flapping = d.flapping(service)
+	return service
+}
@@ -0,0 +1,87 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+// TestFlapDetector tests holding out services that keep going up and down.
+func TestFlapDetector(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	detector := newFlapDetector()
+	detector.setClock(clock)
+	detector.configure(3, time.Minute, 30*time.Second)
+	service := Service{Name: "service1", Host: "host1"}
+	other := Service{Name: "service1", Host: "host2"}
+	detector.observe(other, true)
+	table := []struct {
+		advance  time.Duration // advance is how far to move the clock first.
+		up       bool          // up is whether the service is observed up.
+		expected bool          // expected is whether the service is flapping.
+	}{
+		{up: true, expected: false},
+		{up: true, expected: false},
+		{up: false, expected: false},
+		{up: true, expected: false},
+		{up: true, expected: false},
+		{up: false, expected: true},
+		{advance: 10 * time.Second, up: false, expected: true},
+		{advance: 30 * time.Second, up: false, expected: false},
+		{up: true, expected: false},
+		{up: false, expected: false},
+	}
+	for i, row := range table {
+		clock.Advance(row.advance)
+		detector.observe(service, row.up)
+		if flapping := detector.flapping(service); flapping != row.expected {
+			t.Fatalf("expected flapping: %t, got: %t; row %d", row.expected,
+				flapping, i)
+		}
+		steady := detector.steady([]Service{service, other})
+		expected := 2
+		if row.expected {
+			expected = 1
+		}
+		if len(steady) != expected {
+			t.Fatalf("expected: %d steady, got: %v; row %d", expected, steady,
+				i)
+		}
+		if annotated := detector.annotate(service); annotated.Flapping !=
+			row.expected {
+			t.Fatalf("expected flapping: %t, got: %v; row %d", row.expected,
+				annotated, i)
+		}
+	}
+	detector.observe(service, true)
+	detector.forget(service)
+	if detector.flapping(service) {
+		t.Fatal("expected forgotten service not to be flapping")
+	}
+}
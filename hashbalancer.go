@@ -0,0 +1,79 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// hashBalancer implements KeyedBalancer with weighted rendezvous hashing. Each
+// replicant is scored against the key and the highest score wins, so adding or
+// removing a replicant only moves the keys that replicant wins or won.
+type hashBalancer struct {
+	randomBalancer
+}
+
+// score gets the weighted rendezvous score of the service for the key.
+func score(service Service, key string) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write([]byte(service.Host))
+	// finalize with splitmix64 so similar hosts still spread evenly
+	x := hash.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	// map the hash into (0, 1) and weight it
+	unit := (float64(x>>11) + 0.5) / (1 << 53)
+	return -float64(service.weight()) / math.Log(unit)
+}
+
+func (b hashBalancer) SelectKey(services []Service, key string) (Service,
+	error) {
+	if len(services) == 0 {
+		return Service{}, errNoServices
+	}
+	best, bestScore := 0, score(services[0], key)
+	for i := 1; i < len(services); i++ {
+		if s := score(services[i], key); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return services[best], nil
+}
+
+// NewHashBalancer creates a KeyedBalancer that consistently selects the same
+// replicant for the same key, in proportion to replicant weight. Requests
+// without a key select a random replicant.
+func NewHashBalancer() KeyedBalancer {
+	return hashBalancer{}
+}
@@ -0,0 +1,87 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestHashBalancer tests the hashBalancer.SelectKey function.
+func TestHashBalancer(t *testing.T) {
+	balancer := NewHashBalancer()
+	if _, err := balancer.SelectKey(nil, "key"); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if _, err := balancer.Select(generateTestServices(3)); err != nil {
+		t.Fatalf("failed to select service: %s", err.Error())
+	}
+	services := generateTestServices(5)
+	assigned := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		service, err := balancer.SelectKey(services, key)
+		if err != nil {
+			t.Fatalf("failed to select service: %s", err.Error())
+		}
+		again, _ := balancer.SelectKey(services, key)
+		if again.Host != service.Host {
+			t.Fatalf("expected: %s, got: %s", service.Host, again.Host)
+		}
+		assigned[key] = service.Host
+		counts[service.Host]++
+	}
+	for host, count := range counts {
+		if count < 100 {
+			t.Fatalf("uneven distribution, %s got: %d", host, count)
+		}
+	}
+	// removing a replicant should only move the keys assigned to it
+	for key, host := range assigned {
+		service, _ := balancer.SelectKey(services[:4], key)
+		if host != "host5" && service.Host != host {
+			t.Fatalf("key %s moved from %s to %s", key, host, service.Host)
+		}
+	}
+}
+
+// TestHashBalancerWeight tests that heavier replicants are assigned more keys.
+func TestHashBalancerWeight(t *testing.T) {
+	balancer := NewHashBalancer()
+	services := generateTestServices(2)
+	services[0].Weight = 4
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		service, _ := balancer.SelectKey(services, fmt.Sprintf("key%d", i))
+		counts[service.Host]++
+	}
+	if counts["host1"] < 700 {
+		t.Fatalf("expected host1 to get most keys, got: %v", counts)
+	}
+}
@@ -0,0 +1,293 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// kvHeader is the size of the frame header, flags and key length preceding the
+// key and value of each record of a key/value store.
+const kvHeader = walHeader + 5
+
+// kvTombstone flags a record that deletes its key.
+const kvTombstone = 1
+
+// kvCompactMin is the number of bytes of overwritten and deleted records a
+// store holds before it is compacted.
+const kvCompactMin = 1 << 20
+
+// errStoreClosed is returned using a key/value store after it is closed.
+var errStoreClosed = errors.New("key/value store closed")
+
+// kvEntry locates the latest value of a key in a key/value store file.
+type kvEntry struct {
+	offset int64
+	length int
+}
+
+// kvStore is an embedded key/value store kept in a single append-only file.
+// Each put or delete appends a record framed like a write-ahead log record and,
+// unless written lazily, is synced to disk before it returns. An index of where
+// the latest value of each key is written is kept in memory and rebuilt when
+// the store is opened. Once overwritten and deleted records make up most of the
+// file it is compacted by rewriting the live records to a new file that
+// replaces it.
+type kvStore struct {
+	path  string
+	file  *os.File
+	index map[string]kvEntry
+	size  int64
+	dead  int64
+}
+
+// openKVStore opens the key/value store at the specified path, creating it if
+// it does not exist. A record torn by a crash ends the store and is truncated.
+func openKVStore(path string) (*kvStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	store := &kvStore{path: path, file: file, index: make(map[string]kvEntry)}
+	if err := store.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// load builds the index from the records in the store file.
+func (s *kvStore) load() error {
+	reader := bufio.NewReader(s.file)
+	for {
+		key, length, tombstone, err := readKVRecord(reader)
+		if err == io.EOF {
+			return nil
+		} else if err == errTornRecord {
+			log.Printf("truncating torn key/value record at offset %d\n",
+				s.size)
+			if err := s.file.Truncate(s.size); err != nil {
+				return err
+			}
+			return s.file.Sync()
+		} else if err != nil {
+			return err
+		}
+		s.track(key, s.size, length, tombstone)
+	}
+}
+
+// track updates the index with a record written at the offset.
+func (s *kvStore) track(key string, offset int64, length int, tombstone bool) {
+	size := int64(kvHeader + len(key) + length)
+	if entry, ok := s.index[key]; ok {
+		s.dead += int64(kvHeader+len(key)) + int64(entry.length)
+	}
+	if tombstone {
+		delete(s.index, key)
+		s.dead += size
+	} else {
+		s.index[key] = kvEntry{offset: offset, length: length}
+	}
+	s.size = offset + size
+}
+
+// readKVRecord reads the key and value length of the next record. Returns
+// io.EOF at the end of the store and errTornRecord if the next record is
+// incomplete or corrupt.
+func readKVRecord(reader io.Reader) (string, int, bool, error) {
+	payload, err := readFrame(reader)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if len(payload) < kvHeader-walHeader {
+		return "", 0, false, errTornRecord
+	}
+	keyLength := int(binary.BigEndian.Uint32(payload[1:]))
+	body := payload[kvHeader-walHeader:]
+	if keyLength > len(body) {
+		return "", 0, false, errTornRecord
+	}
+	return string(body[:keyLength]), len(body) - keyLength,
+		payload[0]&kvTombstone != 0, nil
+}
+
+// encodeKVRecord frames a key and value as a record.
+func encodeKVRecord(key string, value []byte, tombstone bool) []byte {
+	payload := make([]byte, kvHeader-walHeader+len(key)+len(value))
+	if tombstone {
+		payload[0] = kvTombstone
+	}
+	binary.BigEndian.PutUint32(payload[1:], uint32(len(key)))
+	copy(payload[kvHeader-walHeader:], key)
+	copy(payload[kvHeader-walHeader+len(key):], value)
+	return encodeFrame(payload)
+}
+
+// write appends a record to the store. If sync is true the record, and any
+// lazy record before it, is synced to disk before write returns. The store is
+// compacted once enough of it is dead; a failed compaction is only logged as
+// the record is already written.
+func (s *kvStore) write(key string, value []byte, tombstone,
+	sync bool) error {
+	if s.file == nil {
+		return errStoreClosed
+	}
+	if _, err := s.file.WriteAt(encodeKVRecord(key, value, tombstone),
+		s.size); err != nil {
+		return err
+	}
+	if sync {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+	s.track(key, s.size, len(value), tombstone)
+	if s.dead > kvCompactMin && s.dead > s.size/2 {
+		if err := s.compact(); err != nil {
+			log.Printf("failed to compact store: %s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+// get reads the value of a key. Returns false if the key is not set.
+func (s *kvStore) get(key string) ([]byte, bool, error) {
+	if s.file == nil {
+		return nil, false, errStoreClosed
+	}
+	entry, ok := s.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	value := make([]byte, entry.length)
+	_, err := s.file.ReadAt(value, entry.offset+int64(kvHeader+len(key)))
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// put sets the value of a key.
+func (s *kvStore) put(key string, value []byte) error {
+	return s.write(key, value, false, true)
+}
+
+// putLazy sets the value of a key without waiting for it to reach disk. It is
+// synced by the next put, delete or compaction, or when the store is closed.
+func (s *kvStore) putLazy(key string, value []byte) error {
+	return s.write(key, value, false, false)
+}
+
+// delete removes a key. Deleting a key that is not set does nothing.
+func (s *kvStore) delete(key string) error {
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	return s.write(key, nil, true, true)
+}
+
+// keys gets the keys with the prefix in order.
+func (s *kvStore) keys(prefix string) []string {
+	var keys []string
+	for key := range s.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compact rewrites the live records of the store to a new file that replaces
+// the store file once it is complete. The directory is synced after the
+// replacement so that a crash cannot bring back the old file.
+func (s *kvStore) compact() error {
+	if s.file == nil {
+		return errStoreClosed
+	}
+	compacted, err := os.OpenFile(s.path+".compact",
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]kvEntry, len(s.index))
+	writer := bufio.NewWriter(compacted)
+	var size int64
+	for _, key := range s.keys("") {
+		value, _, err := s.get(key)
+		if err == nil {
+			_, err = writer.Write(encodeKVRecord(key, value, false))
+		}
+		if err != nil {
+			compacted.Close()
+			os.Remove(compacted.Name())
+			return err
+		}
+		index[key] = kvEntry{offset: size, length: len(value)}
+		size += int64(kvHeader + len(key) + len(value))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = compacted.Sync()
+	}
+	if err == nil {
+		err = os.Rename(compacted.Name(), s.path)
+	}
+	if err != nil {
+		compacted.Close()
+		os.Remove(compacted.Name())
+		return err
+	}
+	s.file.Close()
+	s.file, s.index, s.size, s.dead = compacted, index, size, 0
+	return syncDir(filepath.Dir(s.path))
+}
+
+// close syncs the store to disk and closes it. Closing a closed store does
+// nothing.
+func (s *kvStore) close() error {
+	if s.file == nil {
+		return nil
+	}
+	file := s.file
+	s.file = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,146 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestKVStore tests setting, deleting and reading keys across reopening.
+func TestKVStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.db")
+	store, err := openKVStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	store.put("a/1", []byte("one"))
+	store.put("a/2", []byte("two"))
+	store.put("b/1", []byte("three"))
+	store.putLazy("a/1", []byte("uno"))
+	store.delete("a/2")
+	store.delete("a/3")
+	store.close()
+	if err := store.put("a/4", nil); err != errStoreClosed {
+		t.Fatalf("expected: %v, got: %v", errStoreClosed, err)
+	}
+	store, err = openKVStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.close()
+	table := []struct {
+		key      string
+		expected string
+		ok       bool
+	}{
+		{key: "a/1", expected: "uno", ok: true},
+		{key: "a/2"},
+		{key: "a/3"},
+		{key: "b/1", expected: "three", ok: true},
+	}
+	for _, row := range table {
+		value, ok, err := store.get(row.key)
+		if err != nil || ok != row.ok || string(value) != row.expected {
+			t.Fatalf("expected %s: %q, %t, got: %q, %t, %v", row.key,
+				row.expected, row.ok, value, ok, err)
+		}
+	}
+	if keys := store.keys("a/"); len(keys) != 1 || keys[0] != "a/1" {
+		t.Fatalf("expected keys: [a/1], got: %v", keys)
+	}
+}
+
+// TestKVStoreTorn tests discarding a record torn by a crash.
+func TestKVStoreTorn(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.db")
+	store, err := openKVStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	store.put("a", []byte("one"))
+	size := store.size
+	store.put("b", []byte("two"))
+	store.close()
+	raw, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, raw[:len(raw)-1], 0600)
+	store, err = openKVStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.close()
+	if keys := store.keys(""); len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("expected keys: [a], got: %v", keys)
+	}
+	if info, _ := os.Stat(path); info.Size() != size {
+		t.Fatalf("expected size: %d, got: %d", size, info.Size())
+	}
+	store.put("c", []byte("three"))
+	if value, ok, _ := store.get("c"); !ok || string(value) != "three" {
+		t.Fatalf("expected c: three, got: %q", value)
+	}
+}
+
+// TestKVStoreCompact tests rewriting a store without its dead records.
+func TestKVStoreCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.db")
+	store, err := openKVStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	value := make([]byte, 1024)
+	for i := 0; i < 2*kvCompactMin/len(value); i++ {
+		store.put(fmt.Sprintf("key%d", i%10), value)
+	}
+	if store.size > kvCompactMin {
+		t.Fatalf("expected store compacted, got size: %d", store.size)
+	}
+	store.close()
+	store, err = openKVStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.close()
+	if keys := store.keys("key"); len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got: %v", keys)
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("expected compaction file removed, got: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"math/rand"
+)
+
+// leastLoadBalancer implements Balancer by selecting the replicant reporting
+// the lowest load, breaking ties at random.
+type leastLoadBalancer struct{}
+
+func (b leastLoadBalancer) Select(services []Service) (Service, error) {
+	if len(services) == 0 {
+		return Service{}, errNoServices
+	}
+	best, ties := 0, 1
+	for i := 1; i < len(services); i++ {
+		switch {
+		case services[i].Load < services[best].Load:
+			best, ties = i, 1
+		case services[i].Load == services[best].Load:
+			// reservoir sample so each tied replicant is equally likely
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return services[best], nil
+}
+
+// NewLeastLoadBalancer creates a Balancer that selects the replicant reporting
+// the lowest load.
+func NewLeastLoadBalancer() Balancer {
+	return leastLoadBalancer{}
+}
+
+// twoChoiceBalancer implements Balancer by selecting the less loaded of two
+// random replicants. Unlike always selecting the least loaded replicant this
+// avoids every request herding onto one replicant between load reports.
+type twoChoiceBalancer struct{}
+
+func (b twoChoiceBalancer) Select(services []Service) (Service, error) {
+	if len(services) == 0 {
+		return Service{}, errNoServices
+	}
+	if len(services) == 1 {
+		return services[0], nil
+	}
+	first := rand.Intn(len(services))
+	second := rand.Intn(len(services) - 1)
+	if second >= first {
+		second++
+	}
+	if services[second].Load < services[first].Load {
+		return services[second], nil
+	}
+	return services[first], nil
+}
+
+// NewTwoChoiceBalancer creates a Balancer that selects the less loaded of two
+// random replicants.
+func NewTwoChoiceBalancer() Balancer {
+	return twoChoiceBalancer{}
+}
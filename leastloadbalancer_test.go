@@ -0,0 +1,86 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+)
+
+// TestLeastLoadBalancer tests the leastLoadBalancer.Select function.
+func TestLeastLoadBalancer(t *testing.T) {
+	balancer := NewLeastLoadBalancer()
+	if _, err := balancer.Select(nil); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	services := generateTestServices(4)
+	services[0].Load = 10
+	services[1].Load = 2
+	services[2].Load = 7
+	services[3].Load = 2
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		service, err := balancer.Select(services)
+		if err != nil {
+			t.Fatalf("failed to select service: %s", err.Error())
+		}
+		if service.Host != "host2" && service.Host != "host4" {
+			t.Fatalf("expected least loaded host, got: %s", service.Host)
+		}
+		seen[service.Host] = true
+	}
+	if length := len(seen); length != 2 {
+		t.Fatalf("expected ties to be broken at random, got: %v", seen)
+	}
+}
+
+// TestTwoChoiceBalancer tests the twoChoiceBalancer.Select function.
+func TestTwoChoiceBalancer(t *testing.T) {
+	balancer := NewTwoChoiceBalancer()
+	if _, err := balancer.Select(nil); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	services := generateTestServices(1)
+	if service, _ := balancer.Select(services); service.Host != "host1" {
+		t.Fatalf("expected: host1, got: %s", service.Host)
+	}
+	services = generateTestServices(3)
+	services[0].Load = 100
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		service, err := balancer.Select(services)
+		if err != nil {
+			t.Fatalf("failed to select service: %s", err.Error())
+		}
+		counts[service.Host]++
+	}
+	// the most loaded host only wins if it is chosen twice, which the two
+	// choices being distinct prevents
+	if counts["host1"] != 0 {
+		t.Fatalf("expected most loaded host to be avoided, got: %v", counts)
+	}
+}
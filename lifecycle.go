@@ -0,0 +1,114 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Lifecycle ties the registration of a service to the life of its process. On
+// an interrupt or termination signal, or a call to Shutdown, it drains the
+// service, waits a grace period for clients to stop using it, shuts down the
+// http servers so that in-flight requests finish and deregisters the service.
+type Lifecycle struct {
+	client  *RegistryClient
+	grace   time.Duration
+	servers []*http.Server
+	trap    chan os.Signal
+	once    *sync.Once
+	done    chan struct{}
+	err     error
+}
+
+// NewLifecycle returns a lifecycle for the registry client that waits the
+// grace period between draining and deregistering the service and shuts down
+// the specified http servers.
+func NewLifecycle(client *RegistryClient, grace time.Duration,
+	servers ...*http.Server) *Lifecycle {
+	return &Lifecycle{
+		client:  client,
+		grace:   grace,
+		servers: servers,
+		trap:    make(chan os.Signal, 1),
+		once:    &sync.Once{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Start listens for interrupt and termination signals, shutting down when one
+// is received.
+func (l *Lifecycle) Start() {
+	signal.Notify(l.trap, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-l.trap:
+			l.Shutdown(context.Background())
+		case <-l.done:
+		}
+	}()
+}
+
+// Shutdown drains the service, waits the grace period, shuts down the http
+// servers and deregisters the service. If the context expires the remaining
+// steps are performed without waiting. Only the first call performs the
+// shutdown; later calls wait for it and return the same error.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.once.Do(func() {
+		defer close(l.done)
+		defer signal.Stop(l.trap)
+		setErr := func(err error) {
+			if l.err == nil {
+				l.err = err
+			}
+		}
+		setErr(l.client.Drain())
+		select {
+		case <-l.client.getClock().After(l.grace):
+		case <-ctx.Done():
+		}
+		for _, server := range l.servers {
+			setErr(server.Shutdown(ctx))
+		}
+		setErr(l.client.Deregister())
+	})
+	return l.Wait()
+}
+
+// Wait blocks until shutdown has finished and returns the first error
+// encountered while shutting down. A process should call Wait before exiting,
+// typically after ListenAndServe returns.
+func (l *Lifecycle) Wait() error {
+	<-l.done
+	return l.err
+}
@@ -0,0 +1,96 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestLifecycle tests shutting down a service on a termination signal.
+func TestLifecycle(t *testing.T) {
+	teardown := setupClientTest(t)
+	defer teardown(t)
+	client, err := NewRegistryClient("", "", "http://localhost:64646", "",
+		time.Second)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	server := &http.Server{Handler: http.NewServeMux()}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	client.Auto(10 * time.Millisecond)
+	lifecycle := NewLifecycle(client, 20*time.Millisecond, server)
+	lifecycle.Start()
+	start := time.Now()
+	lifecycle.trap <- syscall.SIGTERM
+	if err := lifecycle.Wait(); err != nil {
+		t.Fatalf("expected clean shutdown, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected grace period, shut down after: %v", elapsed)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatalf("expected server to be closed, got: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if client.IsRunning() {
+		t.Fatal("expected automatic registration to stop")
+	}
+	// later calls return without shutting down again
+	if err := lifecycle.Shutdown(context.Background()); err != nil {
+		t.Fatalf("expected clean shutdown, got: %v", err)
+	}
+}
+
+// TestLifecycleError tests reporting errors while shutting down.
+func TestLifecycleError(t *testing.T) {
+	teardown := setupClientTest(t)
+	defer teardown(t)
+	client, err := NewRegistryClient("", "", "http://localhost:46464", "",
+		time.Second)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	lifecycle := NewLifecycle(client, time.Hour)
+	if err := lifecycle.Shutdown(ctx); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
@@ -0,0 +1,65 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+// locality holds the thresholds for preferring replicants near the caller.
+type locality struct {
+	minZone   int // minZone is the fewest replicants to restrict to a zone.
+	minRegion int // minRegion is the fewest replicants to restrict to a region.
+}
+
+// inLocality gets the services in the region and, if specified, the zone.
+func inLocality(services []Service, region, zone string) []Service {
+	var local []Service
+	for _, service := range services {
+		if (region == "" || service.Region == region) &&
+			(zone == "" || service.Zone == zone) {
+			local = append(local, service)
+		}
+	}
+	return local
+}
+
+// nearest gets the services in the caller's zone, or if there are too few the
+// services in the caller's region, or if there are still too few all services.
+func (l locality) nearest(services []Service, region,
+	zone string) []Service {
+	if zone != "" {
+		local := inLocality(services, region, zone)
+		if len(local) > 0 && len(local) >= l.minZone {
+			return local
+		}
+	}
+	if region != "" {
+		local := inLocality(services, region, "")
+		if len(local) > 0 && len(local) >= l.minRegion {
+			return local
+		}
+	}
+	return services
+}
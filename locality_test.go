@@ -0,0 +1,74 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+)
+
+// TestLocalityNearest tests the locality.nearest function.
+func TestLocalityNearest(t *testing.T) {
+	services := generateTestServices(6)
+	zones := []struct{ region, zone string }{
+		{"east", "east-a"}, {"east", "east-a"}, {"east", "east-b"},
+		{"west", "west-a"}, {"west", "west-b"}, {"", ""},
+	}
+	for i, zone := range zones {
+		services[i].Region = zone.region
+		services[i].Zone = zone.zone
+	}
+	table := []struct {
+		locality    locality
+		region      string
+		zone        string
+		expectedLen int
+	}{
+		{locality: locality{1, 1}, expectedLen: 6},
+		{locality: locality{1, 1}, region: "east", zone: "east-a",
+			expectedLen: 2},
+		{locality: locality{1, 1}, region: "east", zone: "east-b",
+			expectedLen: 1},
+		{locality: locality{2, 1}, region: "east", zone: "east-b",
+			expectedLen: 3},
+		{locality: locality{3, 1}, region: "east", zone: "east-a",
+			expectedLen: 3},
+		{locality: locality{3, 4}, region: "east", zone: "east-a",
+			expectedLen: 6},
+		{locality: locality{1, 1}, region: "west", expectedLen: 2},
+		{locality: locality{1, 1}, region: "north", zone: "north-a",
+			expectedLen: 6},
+		{locality: locality{0, 0}, region: "north", expectedLen: 6},
+	}
+	for _, row := range table {
+		local := row.locality.nearest(services, row.region, row.zone)
+		if length := len(local); length != row.expectedLen {
+			t.Fatalf("expected: %d, got: %d; %v", row.expectedLen, length,
+				row)
+		}
+	}
+}
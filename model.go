@@ -29,27 +29,199 @@ package discovery
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
 // Service holds information about a service as well as the last time the
-// service was renewed.
+// service was renewed. Meta and Tags hold arbitrary information supplied by the
+// service at registration, such as its version or environment. Weight is the
+// relative share of traffic a weighted balancer sends to the service; a weight
+// of zero is treated as one. Load is the most recent load reported by the
+// service, such as its in-flight requests or queue depth. Region and Zone
+// locate the service so that discovery can prefer nearby replicants. Priority
+// places the service in a failover tier; discovery only selects from the tier
+// with the lowest Priority that has active replicants. TTL and Keep override
+// how long the registry considers the service active and how long it keeps the
+// service once inactive. Flapping is set by the server on services held out of
+// discovery for repeatedly changing status.
 type Service struct {
-	Name  string    `json:"name"`
-	Host  string    `json:"host"`
-	Added time.Time `json:"added"`
+	Name     string            `json:"name"`
+	Host     string            `json:"host"`
+	Added    time.Time         `json:"added"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Weight   int               `json:"weight,omitempty"`
+	Load     float64           `json:"load,omitempty"`
+	Region   string            `json:"region,omitempty"`
+	Zone     string            `json:"zone,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+	Check    *HealthCheck      `json:"check,omitempty"`
+	Health   *CheckResult      `json:"health,omitempty"`
+	Status   Status            `json:"status,omitempty"`
+	Reason   string            `json:"reason,omitempty"`
+	Drain    bool              `json:"drain,omitempty"`
+	Flapping bool              `json:"flapping,omitempty"`
+	TTL      Duration          `json:"ttl,omitempty"`
+	Keep     Duration          `json:"keep,omitempty"`
+}
+
+// lifetime gets how long the service is active and kept, using its own TTL and
+// Keep if set and otherwise the registry defaults. A service is kept for at
+// least as long as it is active.
+func (service Service) lifetime(timeout,
+	keep time.Duration) (time.Duration, time.Duration) {
+	if service.TTL > 0 {
+		timeout = time.Duration(service.TTL)
+	}
+	if service.Keep > 0 {
+		keep = time.Duration(service.Keep)
+	}
+	if keep < timeout {
+		keep = timeout
+	}
+	return timeout, keep
+}
+
+// Status is the health status of a service.
+type Status string
+
+// Service health statuses. Passing and warning services are discovered while
+// critical and maintenance services are only listed.
+const (
+	StatusPassing     Status = "passing"
+	StatusWarning     Status = "warning"
+	StatusCritical    Status = "critical"
+	StatusMaintenance Status = "maintenance"
+)
+
+// valid returns true if the status is a known status or empty, which is
+// treated as passing.
+func (status Status) valid() bool {
+	switch status {
+	case "", StatusPassing, StatusWarning, StatusCritical, StatusMaintenance:
+		return true
+	}
+	return false
+}
+
+// Active returns true if services with the status should be discovered.
+func (status Status) Active() bool {
+	return status == StatusPassing || status == StatusWarning
+}
+
+// Duration is a time.Duration that is written to JSON as a string such as
+// "10s". Durations may be read from JSON as a string or as nanoseconds.
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads the duration from a string or a number of nanoseconds.
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		*d = Duration(value)
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration: %s", string(raw))
+	}
+	return nil
+}
+
+// HealthCheck declares how the server checks the health of a service. If HTTP
+// is set the server requests that path from the service host and expects the
+// Status code, 200 if unset. The path may not be an absolute URL and redirects
+// are not followed. If TCP is set the server expects the service host
+// to accept connections.
+type HealthCheck struct {
+	HTTP     string   `json:"http,omitempty"`
+	Status   int      `json:"status,omitempty"`
+	TCP      bool     `json:"tcp,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+}
+
+// valid returns true if the HTTP path of the check is a path rather than a URL
+// that names its own host.
+func (check HealthCheck) valid() bool {
+	if check.HTTP == "" {
+		return true
+	}
+	uri, err := url.Parse(check.HTTP)
+	return err == nil && uri.Scheme == "" && uri.Host == "" &&
+		!strings.HasPrefix(check.HTTP, "//")
+}
+
+// CheckResult holds the outcome of the most recent health check of a service.
+type CheckResult struct {
+	Healthy bool      `json:"healthy"`
+	Output  string    `json:"output,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// Expiry is an event raised by a registry when a service stops renewing. The
+// service expires once its TTL passes without renewal and is removed once its
+// keep duration passes.
+type Expiry struct {
+	Service Service // Service is the service as it was when the event was raised.
+	Removed bool    // Removed is true if the service was removed.
 }
 
 // Registry holds host names for services by name.
 type Registry interface {
-	Add(service Service)              // Add adds or updates a service to this registry.
-	Remove(service Service)           // Remove removes a service from this registry.
-	Get(name string) (Service, error) // Get gets the specified service.
-	List(name string) []Service       // List gets all services filtered by name.
-	SetTimeout(timeout time.Duration) // SetTimeout updates the timeout duration.
-	SetKeep(timeout time.Duration)    // SetKeep updates the keep duration.
+	Add(service Service)                     // Add adds or updates a service to this registry, keeping Drain on update.
+	Remove(service Service)                  // Remove removes a service from this registry.
+	Restore(service Service)                 // Restore stores a service as is, keeping its Added time and Drain.
+	Records() []Service                      // Records gets every stored service with its reported status and the TTL and Keep in effect.
+	Drain(service Service, drain bool) error // Drain sets whether a registered service is draining.
+	Active(filter Filter) []Service          // Active gets all active services matching the filter.
+	List(name string) []Service              // List gets all services filtered by name.
+	ListMatching(filter Filter) []Service    // ListMatching gets all services matching the filter.
+	SetPolicy(policy TrafficPolicy)          // SetPolicy adds or replaces the traffic policy for a service name.
+	RemovePolicy(name string)                // RemovePolicy removes the traffic policy for a service name.
+	Policies(name string) []TrafficPolicy    // Policies gets all traffic policies filtered by name.
+	SetTimeout(timeout time.Duration)        // SetTimeout updates the timeout duration.
+	SetKeep(timeout time.Duration)           // SetKeep updates the keep duration.
+	OnExpire(observer func(expiry Expiry))   // OnExpire adds a function called for each expiry event.
+	SetClock(clock Clock)                    // SetClock sets the clock registrations are timed by.
+	Stop()                                   // Stop stops any background work of this registry.
+}
+
+// Balancer selects a single service from the active replicants returned by a
+// Registry.
+type Balancer interface {
+	Select(services []Service) (Service, error) // Select chooses one of the services.
+}
+
+// KeyedBalancer is a Balancer that can select a service for a client supplied
+// key, so that requests with the same key keep selecting the same service.
+type KeyedBalancer interface {
+	Balancer
+	SelectKey(services []Service, key string) (Service, error) // SelectKey chooses one of the services for the key.
+}
+
+// ScopedBalancer is a Balancer that keeps separate state for each scope of
+// requests, such as requests made with the same filter, so that selections in
+// one scope do not disturb those in another.
+type ScopedBalancer interface {
+	Balancer
+	SelectScope(services []Service, scope string) (Service, error) // SelectScope chooses one of the services for the scope.
 }
 
 // Authenticator defines how to handle http authentication.
@@ -0,0 +1,187 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Default outlier detection settings used by a new server.
+const (
+	defaultOutlierThreshold = 5
+	defaultOutlierWindow    = 10 * time.Second
+	defaultOutlierBase      = 30 * time.Second
+	defaultOutlierMax       = 5 * time.Minute
+)
+
+// outlier tracks the failures reported for a single service replicant.
+type outlier struct {
+	failures  []time.Time // failures holds the times of recent failures.
+	ejections int         // ejections counts consecutive ejections.
+	admitted  time.Time   // admitted is when the current ejection ends.
+}
+
+// outlierDetector ejects replicants that clients report failing. A replicant
+// reported failing threshold times within the window is ejected for the base
+// duration, doubling with each consecutive ejection up to the max duration.
+// A replicant that goes the max duration after readmission without being
+// ejected again starts over from the base duration.
+type outlierDetector struct {
+	threshold int
+	window    time.Duration
+	base      time.Duration
+	max       time.Duration
+	outliers  map[string]*outlier
+	clock     Clock
+	mutex     *sync.Mutex
+}
+
+// newOutlierDetector creates an outlier detector with the default settings.
+func newOutlierDetector() *outlierDetector {
+	return &outlierDetector{
+		threshold: defaultOutlierThreshold,
+		window:    defaultOutlierWindow,
+		base:      defaultOutlierBase,
+		max:       defaultOutlierMax,
+		outliers:  make(map[string]*outlier),
+		clock:     SystemClock,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// configure updates the outlier detection settings. A threshold of zero or
+// less disables ejection.
+func (d *outlierDetector) configure(threshold int, window, base,
+	max time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.threshold, d.window, d.base, d.max = threshold, window, base, max
+}
+
+// setClock sets the clock failures are timed by.
+func (d *outlierDetector) setClock(clock Clock) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.clock = clock
+}
+
+// report records a failure of the service, ejecting it if it crossed the
+// threshold. Returns true if the service is ejected.
+func (d *outlierDetector) report(service Service) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := d.clock.Now()
+	d.prune(now)
+	key := serviceKey(service)
+	o, ok := d.outliers[key]
+	if !ok {
+		o = &outlier{}
+		d.outliers[key] = o
+	}
+	if now.Before(o.admitted) {
+		return true
+	}
+	o.failures = append(o.failures, now)
+	if d.threshold <= 0 || len(o.failures) < d.threshold {
+		return false
+	}
+	ejection := d.base << uint(o.ejections)
+	if ejection <= 0 || ejection > d.max {
+		ejection = d.max
+	} else {
+		o.ejections++
+	}
+	o.admitted = now.Add(ejection)
+	o.failures = nil
+	return true
+}
+
+// prune drops failures outside the window and forgets replicants that have
+// nothing left to track.
+func (d *outlierDetector) prune(now time.Time) {
+	for key, o := range d.outliers {
+		i := 0
+		for i < len(o.failures) && now.Sub(o.failures[i]) > d.window {
+			i++
+		}
+		o.failures = o.failures[i:]
+		if o.ejections > 0 && now.Sub(o.admitted) > d.max {
+			o.ejections = 0
+		}
+		if len(o.failures) == 0 && o.ejections == 0 &&
+			!now.Before(o.admitted) {
+			delete(d.outliers, key)
+		}
+	}
+}
+
+// forget stops tracking failures of the service.
+func (d *outlierDetector) forget(service Service) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.outliers, serviceKey(service))
+}
+
+// ejected gets when the service will be readmitted if it is ejected.
+func (d *outlierDetector) ejected(service Service) (time.Time, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if o, ok := d.outliers[serviceKey(service)]; ok &&
+		d.clock.Now().Before(o.admitted) {
+		return o.admitted, true
+	}
+	return time.Time{}, false
+}
+
+// admitted gets the services that are not ejected. If every service is ejected
+// none are, so that failures reported against a whole pool cannot empty it.
+func (d *outlierDetector) admitted(services []Service) []Service {
+	var admitted []Service
+	for _, service := range services {
+		if _, ok := d.ejected(service); !ok {
+			admitted = append(admitted, service)
+		}
+	}
+	if len(admitted) == 0 {
+		return services
+	}
+	return admitted
+}
+
+// annotate gets the service with a critical status if it is ejected.
+func (d *outlierDetector) annotate(service Service) Service {
+	if until, ok := d.ejected(service); ok &&
+		service.Status != StatusMaintenance {
+		service.Status = StatusCritical
+		service.Reason = fmt.Sprintf("ejected for reported failures until %s",
+			until.Format(time.RFC3339))
+	}
+	return service
+}
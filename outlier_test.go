@@ -0,0 +1,95 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+// TestOutlierDetector tests ejecting and readmitting services reported failing.
+func TestOutlierDetector(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	detector := newOutlierDetector()
+	detector.setClock(clock)
+	detector.configure(2, time.Minute, 20*time.Second, 50*time.Second)
+	service := Service{Name: "service1", Host: "host1"}
+	other := Service{Name: "service1", Host: "host2"}
+	services := []Service{service, other}
+	table := []struct {
+		advance  time.Duration // advance is how far to move the clock first.
+		expected bool          // expected is whether the report ejects.
+		ejection time.Duration // ejection is the expected ejection duration.
+	}{
+		{expected: false},
+		{expected: true, ejection: 20 * time.Second},
+		{expected: true, ejection: 20 * time.Second},
+		{advance: 30 * time.Second, expected: false},
+		{expected: true, ejection: 40 * time.Second},
+		{advance: 50 * time.Second, expected: false},
+		{expected: true, ejection: 50 * time.Second},
+	}
+	for i, row := range table {
+		clock.Advance(row.advance)
+		if ejected := detector.report(service); ejected != row.expected {
+			t.Fatalf("expected ejected: %t, got: %t; row %d", row.expected,
+				ejected, i)
+		}
+		until, ejected := detector.ejected(service)
+		remaining := until.Sub(clock.Now())
+		if ejected != row.expected {
+			t.Fatalf("expected ejected: %t, got: %t; row %d", row.expected,
+				ejected, i)
+		}
+		if ejected && remaining != row.ejection {
+			t.Fatalf("expected ejection: %v, got: %v; row %d",
+				row.ejection, remaining, i)
+		}
+		admitted := detector.admitted(services)
+		if ejected && (len(admitted) != 1 || admitted[0].Host != "host2") {
+			t.Fatalf("expected only host2 admitted, got: %v; row %d",
+				admitted, i)
+		}
+	}
+	detector.report(other)
+	detector.report(other)
+	if admitted := detector.admitted(services); len(admitted) != 2 {
+		t.Fatalf("expected all services admitted when all are ejected, got: %v",
+			admitted)
+	}
+	detector.forget(service)
+	if _, ejected := detector.ejected(service); ejected {
+		t.Fatal("expected forgotten service to be admitted")
+	}
+	detector.configure(0, time.Minute, time.Minute, time.Minute)
+	for i := 0; i < 10; i++ {
+		if detector.report(service) {
+			t.Fatal("expected disabled detector not to eject")
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+// topPriority gets the services in the highest priority tier, which is the
+// tier with the lowest Priority value.
+func topPriority(services []Service) []Service {
+	var top []Service
+	for _, service := range services {
+		if len(top) > 0 && service.Priority > top[0].Priority {
+			continue
+		}
+		if len(top) > 0 && service.Priority < top[0].Priority {
+			top = top[:0]
+		}
+		top = append(top, service)
+	}
+	return top
+}
+
+// activeTiers gets the priority of the tier discovery selects from for each
+// service name.
+func activeTiers(services []Service) map[string]int {
+	tiers := make(map[string]int)
+	for _, service := range services {
+		if tier, ok := tiers[service.Name]; !ok || service.Priority < tier {
+			tiers[service.Name] = service.Priority
+		}
+	}
+	return tiers
+}
@@ -0,0 +1,60 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+)
+
+// TestTopPriority tests the topPriority function.
+func TestTopPriority(t *testing.T) {
+	services := generateTestServices(5)
+	for i, priority := range []int{2, 1, 3, 1, 2} {
+		services[i].Priority = priority
+	}
+	top := topPriority(services)
+	if len(top) != 2 || top[0].Host != "host2" || top[1].Host != "host4" {
+		t.Fatalf("expected host2 and host4, got: %v", top)
+	}
+	if top := topPriority(nil); len(top) != 0 {
+		t.Fatalf("expected empty list, got: %v", top)
+	}
+}
+
+// TestActiveTiers tests the activeTiers function.
+func TestActiveTiers(t *testing.T) {
+	services := []Service{
+		{Name: "service1", Host: "host1", Priority: 1},
+		{Name: "service1", Host: "host2", Priority: 0},
+		{Name: "service2", Host: "host1", Priority: 2},
+	}
+	tiers := activeTiers(services)
+	if len(tiers) != 2 || tiers["service1"] != 0 || tiers["service2"] != 2 {
+		t.Fatalf("unexpected tiers: %v", tiers)
+	}
+}
@@ -0,0 +1,948 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// raftHeartbeat is how often a leader sends entries or heartbeats to each
+// member, and how often other members check whether to start an election.
+const raftHeartbeat = 50 * time.Millisecond
+
+// raftElection is the shortest time a member waits to hear from a leader
+// before starting an election. Each wait is randomized up to twice as long.
+const raftElection = 300 * time.Millisecond
+
+// raftTimeout limits how long a change waits to be committed and applied.
+const raftTimeout = 5 * time.Second
+
+// raftBatch is the most entries sent to a member in one request.
+const raftBatch = 256
+
+// raftCompactAt is the number of applied entries kept before they are dropped
+// from the log. Members that fall further behind are sent the state instead.
+const raftCompactAt = 1024
+
+// raftRole is the part a member plays in the cluster.
+type raftRole string
+
+// raftFollower and the following constants are the roles of a member.
+const (
+	raftFollower  raftRole = "follower"
+	raftCandidate raftRole = "candidate"
+	raftLeader    raftRole = "leader"
+)
+
+var (
+	errNotLeader     = errors.New("not the cluster leader")
+	errNoLeader      = errors.New("no cluster leader")
+	errChangeLost    = errors.New("change lost to a new cluster leader")
+	errChangeTimeout = errors.New("timed out waiting for change to apply")
+	errNodeStopped   = errors.New("cluster member stopped")
+)
+
+// raftEntry is a registry change in the replicated log.
+type raftEntry struct {
+	Term   uint64    `json:"term"`
+	Record walRecord `json:"record"`
+}
+
+// voteRequest asks a member to vote for a candidate to lead a term.
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+// voteResponse answers a vote request.
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// appendRequest sends a member the entries following the previous entry and
+// how far the log is committed. A request without entries is a heartbeat.
+type appendRequest struct {
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex uint64      `json:"prev_index"`
+	PrevTerm  uint64      `json:"prev_term"`
+	Entries   []raftEntry `json:"entries,omitempty"`
+	Commit    uint64      `json:"commit"`
+}
+
+// appendResponse answers an append request. LastIndex is the last entry
+// matching the leader on success, and otherwise the last entry that might.
+type appendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"`
+}
+
+// installRequest sends a member the registry state as of an entry that has
+// been dropped from the log of the leader.
+type installRequest struct {
+	Term      uint64   `json:"term"`
+	Leader    string   `json:"leader"`
+	LastIndex uint64   `json:"last_index"`
+	LastTerm  uint64   `json:"last_term"`
+	State     snapshot `json:"state"`
+}
+
+// installResponse answers an install request.
+type installResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// proposeResponse answers a change forwarded to the leader with the index the
+// change was applied at.
+type proposeResponse struct {
+	Index uint64 `json:"index"`
+}
+
+// raftStatus describes a member of the cluster.
+type raftStatus struct {
+	ID      string   `json:"id"`
+	Role    raftRole `json:"role"`
+	Term    uint64   `json:"term"`
+	Leader  string   `json:"leader"`
+	Commit  uint64   `json:"commit"`
+	Applied uint64   `json:"applied"`
+}
+
+// raftNode is a member of a cluster that replicates registry changes through
+// the Raft consensus algorithm, exchanging requests with the other members
+// over http. Changes are applied once a majority of members hold them. The
+// term, vote and log are saved to a store before the member answers a request
+// or acts on them, so that a member that restarts rejoins with the promises it
+// made intact.
+type raftNode struct {
+	id          string
+	peers       map[string]string // peers maps other members to base URLs.
+	token       string
+	client      *http.Client // client sends votes and entries.
+	slowClient  *http.Client // slowClient sends changes and registry state.
+	store       *raftStore
+	restored    *snapshot // restored is the saved registry state.
+	recoverAt   uint64    // recoverAt is the last index loaded from the store.
+	recoverTime time.Time // recoverTime is the time of the last change loaded.
+	now         func() time.Time
+	apply       func(record walRecord)
+	capture     func() snapshot
+	install     func(state snapshot)
+	recover     func(taken time.Time)
+	compactAt   uint64
+	mutex       *sync.Mutex
+	applyMutex  *sync.Mutex
+	role        raftRole
+	term        uint64
+	votedFor    string
+	leader      string
+	entries     []raftEntry
+	snapIndex   uint64
+	snapTerm    uint64
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inflight    map[string]bool
+	heard       time.Time
+	timeout     time.Duration
+	changed     chan struct{}
+	done        chan struct{}
+	once        *sync.Once
+}
+
+// lastIndex gets the index of the last entry in the log.
+func (n *raftNode) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.entries))
+}
+
+// termAt gets the term of the entry at the index, or zero if the entry is not
+// held.
+func (n *raftNode) termAt(index uint64) uint64 {
+	switch {
+	case index == n.snapIndex:
+		return n.snapTerm
+	case index < n.snapIndex || index > n.lastIndex():
+		return 0
+	}
+	return n.entries[index-n.snapIndex-1].Term
+}
+
+// quorum gets the number of members that make up a majority.
+func (n *raftNode) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// notify wakes everything waiting for the node to change.
+func (n *raftNode) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// await waits until the condition holds, checking it each time the node
+// changes. The mutex must be held and is held again when await returns.
+func (n *raftNode) await(condition func() (bool, error)) error {
+	deadline := time.After(raftTimeout)
+	for {
+		if ok, err := condition(); ok || err != nil {
+			return err
+		}
+		changed := n.changed
+		n.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			n.mutex.Lock()
+			return errChangeTimeout
+		case <-n.done:
+			n.mutex.Lock()
+			return errNodeStopped
+		}
+		n.mutex.Lock()
+	}
+}
+
+// resetTimer restarts the wait for a leader with a new random timeout.
+func (n *raftNode) resetTimer() {
+	n.heard = time.Now()
+	n.timeout = raftElection + time.Duration(rand.Int63n(int64(raftElection)))
+}
+
+// setState sets the term and vote once they are saved to the store. Returns
+// false if they could not be saved, leaving them unchanged.
+func (n *raftNode) setState(term uint64, votedFor string) bool {
+	if term == n.term && votedFor == n.votedFor {
+		return true
+	}
+	err := n.store.saveState(raftHardState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		log.Printf("failed to save raft state: %s\n", err.Error())
+		return false
+	}
+	n.term, n.votedFor = term, votedFor
+	return true
+}
+
+// persist saves the entries of the log from the index on to the store.
+func (n *raftNode) persist(index uint64) error {
+	return n.store.append(index, n.entries[index-n.snapIndex-1:])
+}
+
+// follow makes the node a follower in the term, led by the leader if known.
+// The node stays as it is if the term cannot be saved.
+func (n *raftNode) follow(term uint64, leader string) {
+	if term > n.term && !n.setState(term, "") {
+		return
+	}
+	if n.role != raftFollower || n.leader != leader {
+		n.role, n.leader = raftFollower, leader
+		n.notify()
+	}
+}
+
+// call sends a request to a member with the client and decodes its response.
+func (n *raftNode) call(client *http.Client, base, path string, request,
+	response interface{}) error {
+	raw, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", base+path, bytes.NewBuffer(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", n.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s from %s%s", resp.Status, base, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// run drives elections and heartbeats until the node is stopped.
+func (n *raftNode) run() {
+	ticker := time.NewTicker(raftHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+		n.mutex.Lock()
+		role, waited := n.role, time.Since(n.heard) >= n.timeout
+		n.mutex.Unlock()
+		if role == raftLeader {
+			n.replicate()
+		} else if waited {
+			n.campaign()
+		}
+	}
+}
+
+// campaign starts an election for the next term, leading the cluster if a
+// majority of members vote for the node.
+func (n *raftNode) campaign() {
+	n.mutex.Lock()
+	if !n.setState(n.term+1, n.id) {
+		n.resetTimer()
+		n.mutex.Unlock()
+		return
+	}
+	n.role, n.leader = raftCandidate, ""
+	n.resetTimer()
+	n.notify()
+	request := voteRequest{Term: n.term, Candidate: n.id,
+		LastIndex: n.lastIndex(), LastTerm: n.termAt(n.lastIndex())}
+	n.mutex.Unlock()
+	votes := make(chan bool, len(n.peers))
+	for _, base := range n.peers {
+		go func(base string) {
+			response := voteResponse{}
+			if err := n.call(n.client, base, "/raft/vote", request,
+				&response); err != nil {
+				votes <- false
+				return
+			}
+			n.mutex.Lock()
+			if response.Term > n.term {
+				n.follow(response.Term, "")
+			}
+			n.mutex.Unlock()
+			votes <- response.Granted
+		}(base)
+	}
+	granted := 1
+	for i := 0; i < len(n.peers) && granted < n.quorum(); i++ {
+		if <-votes {
+			granted++
+		}
+	}
+	n.mutex.Lock()
+	if n.role != raftCandidate || n.term != request.Term ||
+		granted < n.quorum() {
+		n.mutex.Unlock()
+		return
+	}
+	n.role, n.leader = raftLeader, n.id
+	for id := range n.peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.matchIndex[id] = 0
+	}
+	// an entry of the new term commits the entries of earlier terms
+	n.entries = append(n.entries, raftEntry{Term: n.term})
+	if err := n.persist(n.lastIndex()); err != nil {
+		log.Printf("failed to save raft log: %s\n", err.Error())
+		n.entries = n.entries[:len(n.entries)-1]
+		n.role, n.leader = raftFollower, ""
+		n.notify()
+		n.mutex.Unlock()
+		return
+	}
+	n.advanceCommit()
+	n.notify()
+	n.mutex.Unlock()
+	n.replicate()
+}
+
+// replicate sends each member the entries it is missing, or a heartbeat.
+func (n *raftNode) replicate() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.role != raftLeader {
+		return
+	}
+	for id, base := range n.peers {
+		if !n.inflight[id] {
+			n.inflight[id] = true
+			go n.send(id, base)
+		}
+	}
+}
+
+// send brings a member up to date with the log of the leader.
+func (n *raftNode) send(id, base string) {
+	defer func() {
+		n.mutex.Lock()
+		n.inflight[id] = false
+		n.mutex.Unlock()
+	}()
+	n.mutex.Lock()
+	if n.role != raftLeader {
+		n.mutex.Unlock()
+		return
+	}
+	next := n.nextIndex[id]
+	if next <= n.snapIndex {
+		n.mutex.Unlock()
+		n.sendState(id, base)
+		return
+	}
+	request := appendRequest{Term: n.term, Leader: n.id, PrevIndex: next - 1,
+		PrevTerm: n.termAt(next - 1), Commit: n.commitIndex}
+	if pending := n.entries[next-n.snapIndex-1:]; len(pending) > 0 {
+		if len(pending) > raftBatch {
+			pending = pending[:raftBatch]
+		}
+		request.Entries = append([]raftEntry(nil), pending...)
+	}
+	n.mutex.Unlock()
+	response := appendResponse{}
+	if err := n.call(n.client, base, "/raft/append", request,
+		&response); err != nil {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if response.Term > n.term {
+		n.follow(response.Term, "")
+		return
+	}
+	if n.role != raftLeader || n.term != request.Term {
+		return
+	}
+	if !response.Success {
+		next := request.PrevIndex
+		if response.LastIndex+1 < next {
+			next = response.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[id] = next
+		return
+	}
+	if match := request.PrevIndex + uint64(len(request.Entries)); match >
+		n.matchIndex[id] {
+		n.matchIndex[id] = match
+	}
+	n.nextIndex[id] = n.matchIndex[id] + 1
+	n.advanceCommit()
+}
+
+// sendState sends a member the registry state in place of entries that have
+// been dropped from the log.
+func (n *raftNode) sendState(id, base string) {
+	n.applyMutex.Lock()
+	n.mutex.Lock()
+	request := installRequest{Term: n.term, Leader: n.id,
+		LastIndex: n.lastApplied, LastTerm: n.termAt(n.lastApplied)}
+	n.mutex.Unlock()
+	request.State = n.capture()
+	n.applyMutex.Unlock()
+	response := installResponse{}
+	if err := n.call(n.slowClient, base, "/raft/install", request,
+		&response); err != nil {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if response.Term > n.term {
+		n.follow(response.Term, "")
+		return
+	}
+	if n.role != raftLeader || n.term != request.Term {
+		return
+	}
+	if request.LastIndex > n.matchIndex[id] {
+		n.matchIndex[id] = request.LastIndex
+	}
+	n.nextIndex[id] = n.matchIndex[id] + 1
+	n.advanceCommit()
+}
+
+// advanceCommit commits the entries of the current term held by a majority.
+func (n *raftNode) advanceCommit() {
+	matches := []uint64{n.lastIndex()}
+	for id := range n.peers {
+		matches = append(matches, n.matchIndex[id])
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i] > matches[j]
+	})
+	if index := matches[n.quorum()-1]; index > n.commitIndex &&
+		n.termAt(index) == n.term {
+		n.commitIndex = index
+		n.notify()
+	}
+}
+
+// applier applies committed entries in order until the node is stopped.
+func (n *raftNode) applier() {
+	for {
+		n.mutex.Lock()
+		err := n.await(func() (bool, error) {
+			return n.lastApplied < n.commitIndex, nil
+		})
+		n.mutex.Unlock()
+		if err == errNodeStopped {
+			return
+		} else if err != nil {
+			continue
+		}
+		n.applyMutex.Lock()
+		n.mutex.Lock()
+		from, to := n.lastApplied+1, n.commitIndex
+		var batch []raftEntry
+		if from <= to {
+			batch = append(batch,
+				n.entries[from-n.snapIndex-1:to-n.snapIndex]...)
+		}
+		n.mutex.Unlock()
+		for _, entry := range batch {
+			n.apply(entry.Record)
+		}
+		n.mutex.Lock()
+		if to > n.lastApplied {
+			n.lastApplied = to
+		}
+		n.compact()
+		n.notify()
+		n.mutex.Unlock()
+		n.recovered()
+		n.applyMutex.Unlock()
+	}
+}
+
+// compact drops applied entries from the log once there are enough of them,
+// saving the registry state in their place. The apply mutex must be held so
+// that the registry state is as of the last applied entry.
+func (n *raftNode) compact() {
+	if n.lastApplied-n.snapIndex <= n.compactAt {
+		return
+	}
+	snap := raftSnapshot{Index: n.lastApplied, Term: n.termAt(n.lastApplied),
+		State: n.capture()}
+	entries := n.entries[n.lastApplied-n.snapIndex:]
+	if err := n.store.saveSnapshot(snap, entries); err != nil {
+		log.Printf("failed to save raft snapshot: %s\n", err.Error())
+		return
+	}
+	n.entries = append([]raftEntry(nil), entries...)
+	n.snapIndex, n.snapTerm = snap.Index, snap.Term
+}
+
+// vote answers a candidate asking for a vote.
+func (n *raftNode) vote(request voteRequest) voteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if request.Term > n.term {
+		n.follow(request.Term, "")
+	}
+	lastIndex := n.lastIndex()
+	lastTerm := n.termAt(lastIndex)
+	current := request.LastTerm > lastTerm ||
+		(request.LastTerm == lastTerm && request.LastIndex >= lastIndex)
+	if request.Term == n.term && current &&
+		(n.votedFor == "" || n.votedFor == request.Candidate) &&
+		n.setState(n.term, request.Candidate) {
+		n.resetTimer()
+		return voteResponse{Term: n.term, Granted: true}
+	}
+	return voteResponse{Term: n.term}
+}
+
+// appendEntries adds the entries sent by the leader to the log.
+func (n *raftNode) appendEntries(request appendRequest) appendResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if request.Term < n.term {
+		return appendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	}
+	n.follow(request.Term, request.Leader)
+	if n.term != request.Term {
+		return appendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	}
+	n.resetTimer()
+	prev, entries := request.PrevIndex, request.Entries
+	if prev < n.snapIndex {
+		// entries up to the snapshot are committed and already held
+		skip := n.snapIndex - prev
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prev = n.snapIndex
+	} else if prev > n.lastIndex() {
+		return appendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	} else if term := n.termAt(prev); term != request.PrevTerm {
+		// skip back over the conflicting term
+		index := prev
+		for index > n.snapIndex+1 && n.termAt(index-1) == term {
+			index--
+		}
+		return appendResponse{Term: n.term, LastIndex: index - 1}
+	}
+	var first uint64
+	for i, entry := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= n.lastIndex() {
+			if n.termAt(index) == entry.Term {
+				continue
+			}
+			n.entries = n.entries[:index-n.snapIndex-1]
+		}
+		if first == 0 {
+			first = index
+		}
+		n.entries = append(n.entries, entry)
+	}
+	if first != 0 {
+		if err := n.persist(first); err != nil {
+			log.Printf("failed to save raft log: %s\n", err.Error())
+			n.entries = n.entries[:first-n.snapIndex-1]
+			return appendResponse{Term: n.term, LastIndex: n.lastIndex()}
+		}
+	}
+	match := prev + uint64(len(entries))
+	if commit := request.Commit; commit > n.commitIndex {
+		if commit > match {
+			commit = match
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.notify()
+		}
+	}
+	return appendResponse{Term: n.term, Success: true, LastIndex: match}
+}
+
+// installState replaces the registry state and log with the state sent by the
+// leader. Returns an error if the state could not be saved.
+func (n *raftNode) installState(request installRequest) (installResponse,
+	error) {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	n.mutex.Lock()
+	if request.Term < n.term {
+		defer n.mutex.Unlock()
+		return installResponse{Term: n.term}, nil
+	}
+	n.follow(request.Term, request.Leader)
+	if n.term != request.Term {
+		defer n.mutex.Unlock()
+		return installResponse{}, errors.New("failed to save raft state")
+	}
+	n.resetTimer()
+	term := n.term
+	if request.LastIndex <= n.lastApplied {
+		n.mutex.Unlock()
+		return installResponse{Term: term}, nil
+	}
+	var entries []raftEntry
+	if request.LastIndex < n.lastIndex() &&
+		n.termAt(request.LastIndex) == request.LastTerm {
+		entries = append(entries, n.entries[request.LastIndex-n.snapIndex:]...)
+	}
+	if err := n.store.saveSnapshot(raftSnapshot{Index: request.LastIndex,
+		Term: request.LastTerm, State: request.State}, entries); err != nil {
+		n.mutex.Unlock()
+		return installResponse{}, err
+	}
+	n.entries = entries
+	n.snapIndex, n.snapTerm = request.LastIndex, request.LastTerm
+	if n.commitIndex < request.LastIndex {
+		n.commitIndex = request.LastIndex
+	}
+	n.mutex.Unlock()
+	n.install(request.State)
+	n.mutex.Lock()
+	n.lastApplied = request.LastIndex
+	n.notify()
+	n.mutex.Unlock()
+	n.recovered()
+	return installResponse{Term: term}, nil
+}
+
+// recovered calls recover once the node has applied every entry it loaded
+// from the store, with the time of the last change loaded. The apply mutex
+// must be held.
+func (n *raftNode) recovered() {
+	n.mutex.Lock()
+	if n.recoverAt == 0 || n.lastApplied < n.recoverAt {
+		n.mutex.Unlock()
+		return
+	}
+	taken := n.recoverTime
+	n.recoverAt = 0
+	n.mutex.Unlock()
+	n.recover(taken)
+}
+
+// propose adds a change to the log if the node leads the cluster and waits
+// for it to be applied, returning its index. The change is timed when it is
+// accepted, so that every member applies it as of the same time however late
+// it is applied.
+func (n *raftNode) propose(record walRecord) (uint64, error) {
+	n.mutex.Lock()
+	if n.role != raftLeader {
+		n.mutex.Unlock()
+		return 0, errNotLeader
+	}
+	record.At = n.now()
+	n.entries = append(n.entries, raftEntry{Term: n.term, Record: record})
+	if err := n.persist(n.lastIndex()); err != nil {
+		n.entries = n.entries[:len(n.entries)-1]
+		n.mutex.Unlock()
+		return 0, err
+	}
+	index, term := n.lastIndex(), n.term
+	n.advanceCommit()
+	n.mutex.Unlock()
+	n.replicate()
+	return index, n.waitApplied(index, term)
+}
+
+// waitApplied waits for the entry at the index to be applied. If the term is
+// set the entry must be from that term, otherwise it was replaced by a new
+// leader.
+func (n *raftNode) waitApplied(index, term uint64) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	held := func() bool {
+		return index <= n.snapIndex || n.termAt(index) == term
+	}
+	return n.await(func() (bool, error) {
+		if term != 0 && n.term != term && index <= n.lastIndex() && !held() {
+			return false, errChangeLost
+		}
+		if n.lastApplied < index {
+			return false, nil
+		}
+		if term != 0 && !held() {
+			return false, errChangeLost
+		}
+		return true, nil
+	})
+}
+
+// commit applies a change through the cluster, forwarding it to the leader if
+// the node does not lead. Returns once the change is applied on this node.
+func (n *raftNode) commit(record walRecord) error {
+	_, err := n.propose(record)
+	if err != errNotLeader {
+		return err
+	}
+	base, ok := n.leaderURL()
+	if !ok {
+		return errNoLeader
+	}
+	response := proposeResponse{}
+	if err := n.call(n.slowClient, base, "/raft/propose", record,
+		&response); err != nil {
+		return err
+	}
+	return n.waitApplied(response.Index, 0)
+}
+
+// confirm returns true if a majority of members still accept the node as
+// leader of the term.
+func (n *raftNode) confirm(term uint64) bool {
+	n.mutex.Lock()
+	requests := make(map[string]appendRequest)
+	for id := range n.peers {
+		match := n.matchIndex[id]
+		requests[id] = appendRequest{Term: term, Leader: n.id,
+			PrevIndex: match, PrevTerm: n.termAt(match), Commit: n.commitIndex}
+	}
+	n.mutex.Unlock()
+	acks := make(chan bool, len(n.peers))
+	for id, base := range n.peers {
+		go func(base string, request appendRequest) {
+			response := appendResponse{}
+			err := n.call(n.client, base, "/raft/append", request,
+				&response)
+			acks <- err == nil && response.Term == term
+		}(base, requests[id])
+	}
+	acked := 1
+	for i := 0; i < len(n.peers) && acked < n.quorum(); i++ {
+		if <-acks {
+			acked++
+		}
+	}
+	return acked >= n.quorum()
+}
+
+// readBarrier waits until the node can serve a linearizable read: it must
+// lead the cluster, have committed an entry of its term, confirm it still
+// leads and have applied everything committed when the read arrived.
+func (n *raftNode) readBarrier() error {
+	n.mutex.Lock()
+	if n.role != raftLeader {
+		n.mutex.Unlock()
+		return errNotLeader
+	}
+	term := n.term
+	err := n.await(func() (bool, error) {
+		if n.term != term || n.role != raftLeader {
+			return false, errNotLeader
+		}
+		return n.termAt(n.commitIndex) == term, nil
+	})
+	index := n.commitIndex
+	n.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if !n.confirm(term) {
+		return errNotLeader
+	}
+	return n.waitApplied(index, 0)
+}
+
+// leaderURL gets the base URL of the leader if another member leads.
+func (n *raftNode) leaderURL() (string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	base, ok := n.peers[n.leader]
+	return base, ok
+}
+
+// leading returns true if the node leads the cluster.
+func (n *raftNode) leading() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.role == raftLeader
+}
+
+// status describes the node.
+func (n *raftNode) status() raftStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return raftStatus{ID: n.id, Role: n.role, Term: n.term, Leader: n.leader,
+		Commit: n.commitIndex, Applied: n.lastApplied}
+}
+
+// stop stops the node taking part in the cluster and closes its store.
+func (n *raftNode) stop() {
+	n.once.Do(func() {
+		close(n.done)
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		if err := n.store.close(); err != nil {
+			log.Printf("failed to close raft store: %s\n", err.Error())
+		}
+	})
+}
+
+// start installs the registry state loaded from the store, if any, and starts
+// the node as a follower.
+func (n *raftNode) start() {
+	n.applyMutex.Lock()
+	if n.restored != nil {
+		n.install(*n.restored)
+		n.restored = nil
+	}
+	n.recovered()
+	n.applyMutex.Unlock()
+	go n.run()
+	go n.applier()
+}
+
+// newRaftNode creates a member of a cluster, loading its term, vote and log
+// from the store in the directory. The peers map the other members to their
+// base URLs, and the token is sent to them for authentication. Votes and
+// entries must be answered within an election timeout, while changes and
+// registry state are given longer since they wait to be applied or are large.
+// Changes are timed by now when accepted. Once the node has applied the
+// entries it loaded, recover is called with the time of the last change
+// loaded. The node takes part in the cluster once started.
+func newRaftNode(id string, peers map[string]string, token, dir string,
+	now func() time.Time, apply func(record walRecord),
+	capture func() snapshot, install func(state snapshot),
+	recover func(taken time.Time)) (*raftNode, error) {
+	store, err := openRaftStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	state, snap, entries, err := store.load()
+	if err != nil {
+		store.close()
+		return nil, err
+	}
+	node := &raftNode{
+		id:         id,
+		peers:      peers,
+		token:      token,
+		client:     &http.Client{Timeout: raftElection},
+		slowClient: &http.Client{Timeout: 2 * raftTimeout},
+		store:      store,
+		term:       state.Term,
+		votedFor:   state.VotedFor,
+		entries:    entries,
+		now:        now,
+		apply:      apply,
+		capture:    capture,
+		install:    install,
+		recover:    recover,
+		compactAt:  raftCompactAt,
+		mutex:      &sync.Mutex{},
+		applyMutex: &sync.Mutex{},
+		role:       raftFollower,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+		once:       &sync.Once{},
+	}
+	if snap != nil {
+		node.snapIndex, node.snapTerm = snap.Index, snap.Term
+		node.commitIndex, node.lastApplied = snap.Index, snap.Index
+		node.restored = &snap.State
+		node.recoverTime = snap.State.Taken
+	}
+	node.recoverAt = node.lastIndex()
+	for _, entry := range entries {
+		if entry.Record.At.After(node.recoverTime) {
+			node.recoverTime = entry.Record.At
+		}
+	}
+	node.resetTimer()
+	return node, nil
+}
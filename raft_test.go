@@ -0,0 +1,267 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRaftNode creates a follower that is not running, keeping its store in
+// the directory and applying records to the returned slice.
+func testRaftNode(t *testing.T, dir string,
+	peers ...string) (*raftNode, *[]walRecord) {
+	store, err := openRaftStore(dir)
+	if err != nil {
+		t.Fatalf("failed to open raft store: %v", err)
+	}
+	applied := &[]walRecord{}
+	node := &raftNode{
+		id:         "node1",
+		peers:      make(map[string]string),
+		store:      store,
+		compactAt:  raftCompactAt,
+		apply:      func(record walRecord) { *applied = append(*applied, record) },
+		now:        time.Now,
+		capture:    func() snapshot { return snapshot{} },
+		mutex:      &sync.Mutex{},
+		applyMutex: &sync.Mutex{},
+		role:       raftFollower,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+		once:       &sync.Once{},
+	}
+	for _, peer := range peers {
+		node.peers[peer] = "http://" + peer
+	}
+	return node, applied
+}
+
+// testEntries creates entries in the terms.
+func testEntries(terms ...uint64) []raftEntry {
+	entries := make([]raftEntry, len(terms))
+	for i, term := range terms {
+		entries[i] = raftEntry{Term: term, Record: walRecord{Op: walAdd,
+			Service: &Service{Name: "service1", Host: "host1"}}}
+	}
+	return entries
+}
+
+// TestRaftVote tests granting votes to candidates.
+func TestRaftVote(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	node, _ := testRaftNode(t, dir, "node2", "node3")
+	node.term = 2
+	node.entries = testEntries(1, 2)
+	table := []struct {
+		request  voteRequest
+		expected bool
+	}{
+		{request: voteRequest{Term: 1, Candidate: "node2", LastIndex: 5,
+			LastTerm: 2}},
+		{request: voteRequest{Term: 3, Candidate: "node2", LastIndex: 2,
+			LastTerm: 2}, expected: true},
+		{request: voteRequest{Term: 3, Candidate: "node3", LastIndex: 2,
+			LastTerm: 2}},
+		{request: voteRequest{Term: 3, Candidate: "node2", LastIndex: 2,
+			LastTerm: 2}, expected: true},
+		{request: voteRequest{Term: 4, Candidate: "node3", LastIndex: 1,
+			LastTerm: 2}},
+		{request: voteRequest{Term: 4, Candidate: "node3", LastIndex: 2,
+			LastTerm: 2}, expected: true},
+		{request: voteRequest{Term: 5, Candidate: "node2", LastIndex: 1,
+			LastTerm: 3}, expected: true},
+	}
+	for i, row := range table {
+		response := node.vote(row.request)
+		if response.Granted != row.expected {
+			t.Fatalf("expected granted: %t, got: %t; row %d", row.expected,
+				response.Granted, i)
+		}
+		if response.Term < row.request.Term {
+			t.Fatalf("expected term: %d, got: %d; row %d", row.request.Term,
+				response.Term, i)
+		}
+	}
+	state, _, _, err := node.store.load()
+	if err != nil || state.Term != 5 || state.VotedFor != "node2" {
+		t.Fatalf("expected vote for node2 in term 5 saved, got: %v, %v",
+			state, err)
+	}
+}
+
+// TestRaftAppendEntries tests following the log of a leader.
+func TestRaftAppendEntries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	node, _ := testRaftNode(t, dir, "node2", "node3")
+	table := []struct {
+		request   appendRequest
+		success   bool
+		lastIndex uint64
+		terms     []uint64
+		commit    uint64
+	}{
+		{request: appendRequest{Term: 1, PrevIndex: 0,
+			Entries: testEntries(1, 1, 1), Commit: 1},
+			success: true, lastIndex: 3, terms: []uint64{1, 1, 1}, commit: 1},
+		{request: appendRequest{Term: 1, PrevIndex: 5, PrevTerm: 1},
+			lastIndex: 3, terms: []uint64{1, 1, 1}, commit: 1},
+		{request: appendRequest{Term: 2, PrevIndex: 2, PrevTerm: 1,
+			Entries: testEntries(2, 2), Commit: 3},
+			success: true, lastIndex: 4, terms: []uint64{1, 1, 2, 2},
+			commit: 3},
+		{request: appendRequest{Term: 3, PrevIndex: 4, PrevTerm: 3},
+			lastIndex: 2, terms: []uint64{1, 1, 2, 2}, commit: 3},
+		{request: appendRequest{Term: 3, PrevIndex: 1, PrevTerm: 1,
+			Entries: testEntries(1, 2), Commit: 10},
+			success: true, lastIndex: 3, terms: []uint64{1, 1, 2, 2},
+			commit: 3},
+		{request: appendRequest{Term: 2, PrevIndex: 4, PrevTerm: 2,
+			Entries: testEntries(2)},
+			lastIndex: 4, terms: []uint64{1, 1, 2, 2}, commit: 3},
+		{request: appendRequest{Term: 3, PrevIndex: 4, PrevTerm: 2,
+			Commit: 10},
+			success: true, lastIndex: 4, terms: []uint64{1, 1, 2, 2},
+			commit: 4},
+	}
+	for i, row := range table {
+		response := node.appendEntries(row.request)
+		if response.Success != row.success ||
+			response.LastIndex != row.lastIndex {
+			t.Fatalf("expected success: %t at %d, got: %v; row %d",
+				row.success, row.lastIndex, response, i)
+		}
+		if len(node.entries) != len(row.terms) {
+			t.Fatalf("expected terms: %v, got: %v; row %d", row.terms,
+				node.entries, i)
+		}
+		for j, entry := range node.entries {
+			if entry.Term != row.terms[j] {
+				t.Fatalf("expected terms: %v, got: %v; row %d", row.terms,
+					node.entries, i)
+			}
+		}
+		if node.commitIndex != row.commit {
+			t.Fatalf("expected commit: %d, got: %d; row %d", row.commit,
+				node.commitIndex, i)
+		}
+		_, _, saved, err := node.store.load()
+		if err != nil || len(saved) != len(row.terms) ||
+			saved[len(saved)-1].Term != row.terms[len(row.terms)-1] {
+			t.Fatalf("expected terms: %v saved, got: %v, %v; row %d",
+				row.terms, saved, err, i)
+		}
+	}
+	if node.role != raftFollower || node.term != 3 {
+		t.Fatalf("expected follower in term 3, got: %s in %d", node.role,
+			node.term)
+	}
+}
+
+// TestRaftApplyCompact tests applying committed entries and dropping them
+// from the log.
+func TestRaftApplyCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	node, applied := testRaftNode(t, dir)
+	node.compactAt = 2
+	go node.applier()
+	defer node.stop()
+	node.appendEntries(appendRequest{Term: 1, Entries: testEntries(1, 1, 1,
+		1), Commit: 3})
+	waitFor(t, func() bool {
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+		return node.lastApplied == 3
+	})
+	node.mutex.Lock()
+	if len(*applied) != 3 || node.snapIndex != 3 || node.snapTerm != 1 ||
+		len(node.entries) != 1 || node.lastIndex() != 4 {
+		t.Fatalf("expected 3 applied and compacted, got: %d applied, "+
+			"snapshot at %d, %d entries", len(*applied), node.snapIndex,
+			len(node.entries))
+	}
+	node.mutex.Unlock()
+	response := node.appendEntries(appendRequest{Term: 1, PrevIndex: 1,
+		PrevTerm: 1, Entries: testEntries(1, 1, 1, 1)})
+	if !response.Success || response.LastIndex != 5 {
+		t.Fatalf("expected entries before the snapshot skipped, got: %v",
+			response)
+	}
+}
+
+// TestRaftSingleNode tests a cluster of one electing itself and applying
+// changes.
+func TestRaftSingleNode(t *testing.T) {
+	var mutex sync.Mutex
+	var applied []walRecord
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	node, err := newRaftNode("node1", map[string]string{}, "", dir, time.Now,
+		func(record walRecord) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			applied = append(applied, record)
+		}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	node.start()
+	defer node.stop()
+	if _, err := node.propose(walRecord{Op: walAdd}); err != errNotLeader {
+		t.Fatalf("expected: %v, got: %v", errNotLeader, err)
+	}
+	start := time.Now()
+	for !node.leading() {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for election")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	index, err := node.propose(walRecord{Op: walRemove})
+	if err != nil || index != 2 {
+		t.Fatalf("expected change applied at 2, got: %d, %v", index, err)
+	}
+	if err := node.readBarrier(); err != nil {
+		t.Fatalf("failed read barrier: %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(applied) != 2 || applied[1].Op != walRemove ||
+		applied[1].At.Before(start) {
+		t.Fatalf("expected no-op then timed remove applied, got: %v",
+			applied)
+	}
+}
@@ -0,0 +1,253 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// raftStateFile, raftSnapshotFile and raftLogFile are the names of the files a
+// cluster member keeps in its data directory.
+const (
+	raftStateFile    = "raft.state"
+	raftSnapshotFile = "raft.snapshot"
+	raftLogFile      = "raft.log"
+)
+
+// errRaftStoreClosed is returned writing to a raft store after it is closed.
+var errRaftStoreClosed = errors.New("raft store closed")
+
+// raftHardState is the term and vote of a member. It must survive a restart so
+// that a member never votes twice in a term.
+type raftHardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// raftSnapshot is the registry state as of an entry dropped from the log.
+type raftSnapshot struct {
+	Index uint64   `json:"index"`
+	Term  uint64   `json:"term"`
+	State snapshot `json:"state"`
+}
+
+// raftLogRecord is an entry of the log at its index. A record replaces any
+// entry held at its index and every entry after it.
+type raftLogRecord struct {
+	Index uint64    `json:"index"`
+	Entry raftEntry `json:"entry"`
+}
+
+// raftStore keeps the state a cluster member needs to rejoin after a restart
+// without breaking the promises it made to other members: its term and vote,
+// its log, and a snapshot of the registry in place of the entries dropped from
+// the log. Every write is synced to disk before it returns. Log records are
+// framed like write-ahead log records so that a record torn by a crash is
+// discarded.
+type raftStore struct {
+	dir    string
+	file   *os.File
+	closed bool
+}
+
+// openRaftStore opens the store in the directory, creating the directory if it
+// does not exist.
+func openRaftStore(dir string) (*raftStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &raftStore{dir: dir}, nil
+}
+
+// path gets the path of a file of the store.
+func (s *raftStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// saveState writes the term and vote.
+func (s *raftStore) saveState(state raftHardState) error {
+	if s.closed {
+		return errRaftStoreClosed
+	}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(raftStateFile), raw)
+}
+
+// append writes entries to the log starting at the index, replacing any
+// entries held from the index on.
+func (s *raftStore) append(index uint64, entries []raftEntry) error {
+	if s.closed {
+		return errRaftStoreClosed
+	}
+	if s.file == nil {
+		file, err := os.OpenFile(s.path(raftLogFile),
+			os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	var frames []byte
+	for i, entry := range entries {
+		raw, err := json.Marshal(raftLogRecord{Index: index + uint64(i),
+			Entry: entry})
+		if err != nil {
+			return err
+		}
+		frames = append(frames, encodeFrame(raw)...)
+	}
+	if _, err := s.file.Write(frames); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// saveSnapshot writes the snapshot and replaces the log with the entries
+// following it.
+func (s *raftStore) saveSnapshot(snap raftSnapshot, entries []raftEntry) error {
+	if s.closed {
+		return errRaftStoreClosed
+	}
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(raftSnapshotFile), raw); err != nil {
+		return err
+	}
+	var frames []byte
+	for i, entry := range entries {
+		raw, err := json.Marshal(raftLogRecord{Index: snap.Index + 1 +
+			uint64(i), Entry: entry})
+		if err != nil {
+			return err
+		}
+		frames = append(frames, encodeFrame(raw)...)
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	return writeFileAtomic(s.path(raftLogFile), frames)
+}
+
+// load reads the term and vote, the snapshot if one was saved, and the entries
+// of the log following the snapshot. A torn record ends the log and is
+// truncated.
+func (s *raftStore) load() (raftHardState, *raftSnapshot, []raftEntry,
+	error) {
+	state := raftHardState{}
+	raw, err := ioutil.ReadFile(s.path(raftStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return state, nil, nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(raw, &state); err != nil {
+			return state, nil, nil, err
+		}
+	}
+	var snap *raftSnapshot
+	raw, err = ioutil.ReadFile(s.path(raftSnapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return state, nil, nil, err
+	} else if err == nil {
+		snap = &raftSnapshot{}
+		if err := json.Unmarshal(raw, snap); err != nil {
+			return state, nil, nil, err
+		}
+	}
+	var first uint64 = 1
+	if snap != nil {
+		first = snap.Index + 1
+	}
+	entries, err := s.readLog(first)
+	return state, snap, entries, err
+}
+
+// readLog reads the entries of the log from the index on.
+func (s *raftStore) readLog(first uint64) ([]raftEntry, error) {
+	file, err := os.OpenFile(s.path(raftLogFile), os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var entries []raftEntry
+	var offset int64
+	for {
+		payload, err := readFrame(reader)
+		record := raftLogRecord{}
+		if err == nil && json.Unmarshal(payload, &record) != nil {
+			err = errTornRecord
+		}
+		if err == io.EOF {
+			return entries, nil
+		} else if err == errTornRecord {
+			log.Printf("truncating torn raft log at offset %d\n", offset)
+			if err := file.Truncate(offset); err != nil {
+				return nil, err
+			}
+			return entries, file.Sync()
+		} else if err != nil {
+			return nil, err
+		}
+		offset += int64(walHeader + len(payload))
+		if record.Index < first {
+			continue
+		}
+		position := record.Index - first
+		if position > uint64(len(entries)) {
+			return nil, fmt.Errorf("raft log skips from %d to %d",
+				first+uint64(len(entries))-1, record.Index)
+		}
+		entries = append(entries[:position], record.Entry)
+	}
+}
+
+// close closes the store. Later writes return errRaftStoreClosed.
+func (s *raftStore) close() error {
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	file := s.file
+	s.file = nil
+	return file.Close()
+}
@@ -0,0 +1,126 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTerms gets the terms of the entries.
+func testTerms(entries []raftEntry) []uint64 {
+	terms := make([]uint64, len(entries))
+	for i, entry := range entries {
+		terms[i] = entry.Term
+	}
+	return terms
+}
+
+// TestRaftStore tests saving the term, vote, log and snapshot across
+// reopening.
+func TestRaftStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store, err := openRaftStore(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	state, snap, entries, err := store.load()
+	if err != nil || state.Term != 0 || snap != nil || len(entries) != 0 {
+		t.Fatalf("expected empty store, got: %v, %v, %v, %v", state, snap,
+			entries, err)
+	}
+	store.saveState(raftHardState{Term: 2, VotedFor: "node2"})
+	store.append(1, testEntries(1, 1, 1))
+	store.append(3, testEntries(2, 2))
+	store.close()
+	if err := store.append(5, testEntries(2)); err != errRaftStoreClosed {
+		t.Fatalf("expected: %v, got: %v", errRaftStoreClosed, err)
+	}
+	store, err = openRaftStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	state, snap, entries, err = store.load()
+	if err != nil || state.Term != 2 || state.VotedFor != "node2" ||
+		snap != nil || fmt.Sprint(testTerms(entries)) != "[1 1 2 2]" {
+		t.Fatalf("expected term 2, vote for node2 and terms [1 1 2 2], "+
+			"got: %v, %v, %v, %v", state, snap, testTerms(entries), err)
+	}
+	store.saveSnapshot(raftSnapshot{Index: 3, Term: 2, State: snapshot{
+		Services: []Service{{Name: "service1", Host: "host1"}}}},
+		testEntries(2))
+	store.append(5, testEntries(3))
+	store.close()
+	store, err = openRaftStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.close()
+	_, snap, entries, err = store.load()
+	if err != nil || snap == nil || snap.Index != 3 || snap.Term != 2 ||
+		len(snap.State.Services) != 1 ||
+		fmt.Sprint(testTerms(entries)) != "[2 3]" {
+		t.Fatalf("expected snapshot at 3 and terms [2 3], got: %v, %v, %v",
+			snap, testTerms(entries), err)
+	}
+}
+
+// TestRaftStoreTorn tests discarding a log record torn by a crash.
+func TestRaftStoreTorn(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store, err := openRaftStore(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	store.append(1, testEntries(1, 1))
+	store.close()
+	path := filepath.Join(dir, raftLogFile)
+	raw, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, raw[:len(raw)-1], 0600)
+	store, err = openRaftStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.close()
+	_, _, entries, err := store.load()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got: %v, %v", entries, err)
+	}
+	store.append(2, testEntries(2))
+	if _, _, entries, _ = store.load(); len(entries) != 2 ||
+		entries[1].Term != 2 {
+		t.Fatalf("expected terms [1 2], got: %v", testTerms(entries))
+	}
+}
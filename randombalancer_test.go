@@ -0,0 +1,63 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"testing"
+)
+
+// generateTestServices generates replicants of a single service.
+func generateTestServices(replicantCount int) []Service {
+	services := []Service{}
+	for i := 1; i <= replicantCount; i++ {
+		services = append(services, Service{Name: "service1",
+			Host: fmt.Sprintf("host%d", i)})
+	}
+	return services
+}
+
+// TestRandomBalancer tests the randomBalancer.Select function.
+func TestRandomBalancer(t *testing.T) {
+	balancer := NewRandomBalancer()
+	if _, err := balancer.Select(nil); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	services := generateTestServices(3)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		service, err := balancer.Select(services)
+		if err != nil {
+			t.Fatalf("failed to select service: %s", err.Error())
+		}
+		seen[service.Host] = true
+	}
+	if length := len(seen); length != 3 {
+		t.Fatalf("expected all 3 hosts selected, got: %d", length)
+	}
+}
@@ -29,17 +29,23 @@ package discovery
 
 import (
 	"fmt"
-	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
 
-// randomRegistry implements Registry with a random load balancing algorithm.
+// randomRegistry implements Registry by keeping services in memory. Selecting
+// between replicants is left to a Balancer. Services are expired and removed by
+// a reaper so that reads do not modify the registry.
 type randomRegistry struct {
-	Services []Service
-	Timeout  time.Duration
-	Keep     time.Duration
-	mutex    *sync.Mutex
+	Services  []Service
+	policies  map[string]TrafficPolicy
+	Timeout   time.Duration
+	Keep      time.Duration
+	mutex     *sync.Mutex
+	reaper    *reaper
+	observers []func(expiry Expiry)
+	clock     Clock
 }
 
 // indexOf gets the index of the specified service in the registry or -1.
@@ -52,42 +58,110 @@ func (r *randomRegistry) indexOf(target Service) int {
 	return -1
 }
 
-// getAll gets all active services of the specified name. Optionally includes
-// inactive services if inactive is true.
-func (r *randomRegistry) getAll(name string, inactive bool) []Service {
-	var (
-		services []Service
-		stale    []Service
-	)
+// indexOfKey gets the index of the service with the specified key or -1.
+func (r *randomRegistry) indexOfKey(key string) int {
+	for i, service := range r.Services {
+		if serviceKey(service) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// schedule sets the deadlines at which the service expires and is removed.
+func (r *randomRegistry) schedule(service Service) {
+	ttl, keep := service.lifetime(r.Timeout, r.Keep)
+	key := serviceKey(service)
+	r.reaper.schedule(key, service.Added.Add(ttl), false)
+	r.reaper.schedule(key, service.Added.Add(keep), true)
+}
+
+// reap raises an expiry event for the service with the key if its deadline has
+// passed, removing the service if remove is true.
+func (r *randomRegistry) reap(key string, remove bool) {
+	r.mutex.Lock()
+	idx := r.indexOfKey(key)
+	if idx < 0 {
+		r.mutex.Unlock()
+		return
+	}
+	service := r.Services[idx]
+	ttl, keep := service.lifetime(r.Timeout, r.Keep)
+	age := r.clock.Now().Sub(service.Added)
+	if (!remove && age < ttl) || (remove && age < keep) {
+		r.mutex.Unlock()
+		return
+	}
+	if remove {
+		r.Services = append(r.Services[:idx], r.Services[idx+1:]...)
+		r.reaper.cancel(key)
+	}
+	expiry := Expiry{Service: r.withStatus(service), Removed: remove}
+	observers := r.observers
+	r.mutex.Unlock()
+	for _, observer := range observers {
+		observer(expiry)
+	}
+}
+
+// withStatus gets the service with its status derived from the status it
+// reported, whether it is draining and whether its registration has expired,
+// and with the TTL and Keep in effect for it.
+func (r *randomRegistry) withStatus(service Service) Service {
+	return deriveStatus(service, r.Timeout, r.Keep, r.clock.Now())
+}
+
+// deriveStatus gets the service with its status derived from the status it
+// reported, whether it is draining and whether its registration has expired
+// at the specified time given the registry timeout and keep durations, and
+// with the TTL and Keep in effect for it.
+func deriveStatus(service Service, timeout, keep time.Duration,
+	now time.Time) Service {
+	ttl, keep := service.lifetime(timeout, keep)
+	service.TTL, service.Keep = Duration(ttl), Duration(keep)
+	if now.Sub(service.Added) >= ttl {
+		service.Status = StatusCritical
+		service.Reason = "registration expired"
+	} else if service.Drain {
+		service.Status = StatusMaintenance
+		service.Reason = "draining"
+	} else if service.Status == "" {
+		service.Status = StatusPassing
+	}
+	return service
+}
+
+// getAll gets all active services matching the filter. Optionally includes
+// inactive services if inactive is true. Services past their keep duration
+// that have yet to be removed are left out.
+func (r *randomRegistry) getAll(filter Filter, inactive bool) []Service {
+	var services []Service
 	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	for _, service := range r.Services {
-		if name == "" || name == service.Name {
-			if time.Since(service.Added) < r.Timeout ||
-				(inactive && time.Since(service.Added) >= r.Timeout &&
-					time.Since(service.Added) < r.Keep) {
-				services = append(services, service)
-			}
+		_, keep := service.lifetime(r.Timeout, r.Keep)
+		if r.clock.Now().Sub(service.Added) > keep {
+			continue
 		}
-		if time.Since(service.Added) > r.Keep {
-			stale = append(stale, service)
+		service = r.withStatus(service)
+		if filter.Matches(service) && (inactive || service.Status.Active()) {
+			services = append(services, service)
 		}
 	}
-	r.mutex.Unlock()
-	for _, service := range stale {
-		r.Remove(service)
-	}
 	return services
 }
 
 func (r *randomRegistry) Add(service Service) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	service.Added = r.clock.Now()
 	if idx := r.indexOf(service); idx >= 0 {
-		r.Services[idx].Added = time.Now()
+		service.Drain = r.Services[idx].Drain
+		r.Services[idx] = service
 	} else {
-		service.Added = time.Now()
 		r.Services = append(r.Services, service)
 	}
+	r.schedule(service)
 }
 
 func (r *randomRegistry) Remove(service Service) {
@@ -96,39 +170,130 @@ func (r *randomRegistry) Remove(service Service) {
 	if idx := r.indexOf(service); idx >= 0 {
 		r.Services = append(r.Services[:idx], r.Services[idx+1:]...)
 	}
+	r.reaper.cancel(serviceKey(service))
 }
 
-func (r *randomRegistry) Get(name string) (Service, error) {
-	services := r.getAll(name, false)
-	if len(services) == 0 {
-		return Service{}, fmt.Errorf("so such service '%s'", name)
+func (r *randomRegistry) Restore(service Service) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if idx := r.indexOf(service); idx >= 0 {
+		r.Services[idx] = service
+	} else {
+		r.Services = append(r.Services, service)
 	}
-	return services[rand.Intn(len(services))], nil
+	r.schedule(service)
+}
+
+func (r *randomRegistry) Records() []Service {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	services := make([]Service, len(r.Services))
+	for i, service := range r.Services {
+		ttl, keep := service.lifetime(r.Timeout, r.Keep)
+		service.TTL, service.Keep = Duration(ttl), Duration(keep)
+		services[i] = service
+	}
+	return services
+}
+
+func (r *randomRegistry) Drain(service Service, drain bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	idx := r.indexOf(service)
+	if idx < 0 {
+		return fmt.Errorf("no such service '%s' on '%s'", service.Name,
+			service.Host)
+	}
+	r.Services[idx].Drain = drain
+	return nil
+}
+
+func (r *randomRegistry) Active(filter Filter) []Service {
+	return r.getAll(filter, false)
 }
 
 func (r *randomRegistry) List(name string) []Service {
-	return r.getAll(name, true)
+	return r.ListMatching(Filter{Name: name})
+}
+
+func (r *randomRegistry) ListMatching(filter Filter) []Service {
+	return r.getAll(filter, true)
+}
+
+func (r *randomRegistry) SetPolicy(policy TrafficPolicy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.policies[policy.Name] = policy
+}
+
+func (r *randomRegistry) RemovePolicy(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.policies, name)
+}
+
+func (r *randomRegistry) Policies(name string) []TrafficPolicy {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var policies []TrafficPolicy
+	for _, policy := range r.policies {
+		if name == "" || name == policy.Name {
+			policies = append(policies, policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+	return policies
 }
 
 func (r *randomRegistry) SetTimeout(timeout time.Duration) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.Timeout = timeout
+	for _, service := range r.Services {
+		r.schedule(service)
+	}
 }
 
 func (r *randomRegistry) SetKeep(keep time.Duration) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.Keep = keep
+	for _, service := range r.Services {
+		r.schedule(service)
+	}
+}
+
+func (r *randomRegistry) OnExpire(observer func(expiry Expiry)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.observers = append(r.observers, observer)
+}
+
+func (r *randomRegistry) SetClock(clock Clock) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock = clock
+	r.reaper.setClock(clock)
+}
+
+func (r *randomRegistry) Stop() {
+	r.reaper.stop()
 }
 
-// NewRandomRegistry creates a Registry that load balances by selecting a
-// random service when replicants exist.
+// NewRandomRegistry creates an in-memory Registry. It is paired with a
+// RandomBalancer by NewRandomServer to select a random service when replicants
+// exist.
 func NewRandomRegistry(timeout time.Duration, keep time.Duration) Registry {
-	return &randomRegistry{
+	registry := &randomRegistry{
 		Services: make([]Service, 0),
+		policies: make(map[string]TrafficPolicy),
 		Timeout:  timeout,
 		Keep:     keep,
 		mutex:    &sync.Mutex{},
+		clock:    SystemClock,
 	}
+	registry.reaper = newReaper(registry.reap)
+	return registry
 }
@@ -35,7 +35,7 @@ import (
 
 // generateTestRegistry generates a random registry with the specified services
 // and replicants for each service.
-func generateTestRegistry(serviceCount, replicantCount int) randomRegistry {
+func generateTestRegistry(serviceCount, replicantCount int) *randomRegistry {
 	registry := NewRandomRegistry(12*time.Hour, 24*time.Hour).(*randomRegistry)
 	services := []Service{}
 	for i := 1; i <= serviceCount; i++ {
@@ -47,7 +47,27 @@ func generateTestRegistry(serviceCount, replicantCount int) randomRegistry {
 		}
 	}
 	registry.Services = services
-	return *registry
+	for _, service := range services {
+		registry.schedule(service)
+	}
+	return registry
+}
+
+// countServices gets the number of services held by the registry.
+func countServices(registry *randomRegistry) int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return len(registry.Services)
+}
+
+// rescheduleAll schedules the deadlines of every service in the registry after
+// a test has changed them.
+func rescheduleAll(registry *randomRegistry) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for _, service := range registry.Services {
+		registry.schedule(service)
+	}
 }
 
 // TestIndexOf tests the randomRegistry.indexOf function.
@@ -89,7 +109,7 @@ func TestGetAll(t *testing.T) {
 		{name: "", inactive: true, expectedLen: 25},
 	}
 	for _, row := range table {
-		services := registry.getAll(row.name, row.inactive)
+		services := registry.getAll(Filter{Name: row.name}, row.inactive)
 		if length := len(services); length != row.expectedLen {
 			t.Fatalf("expected: %d, got: %d; %v", row.expectedLen, length,
 				row)
@@ -97,20 +117,25 @@ func TestGetAll(t *testing.T) {
 	}
 }
 
-// TestStale test removing stale entries on randomRegistry.getAll call.
+// TestStale tests that randomRegistry.getAll hides stale entries without
+// removing them, leaving removal to the reaper.
 func TestStale(t *testing.T) {
 	registry := generateTestRegistry(5, 5)
+	defer registry.Stop()
 	for i, service := range registry.Services {
 		service.Added = service.Added.Add(-25 * time.Hour)
 		registry.Services[i] = service
 	}
-	services := registry.getAll("", true)
+	services := registry.getAll(Filter{}, true)
 	if length := len(services); length > 0 {
 		t.Fatalf("expected empty list, got length: %d", length)
 	}
-	if length := len(registry.Services); length > 0 {
-		t.Fatalf("expected empty registry, got length: %d", length)
+	if length := countServices(registry); length != 25 {
+		t.Fatalf("expected reads not to remove services, got length: %d",
+			length)
 	}
+	rescheduleAll(registry)
+	waitFor(t, func() bool { return countServices(registry) == 0 })
 }
 
 // TestAdd tests the randomRegistry.Add function.
@@ -143,6 +168,25 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+// TestAddRenewMeta tests that renewing a service updates its metadata and tags.
+func TestAddRenewMeta(t *testing.T) {
+	registry := generateTestRegistry(0, 0)
+	registry.Add(Service{Name: "service1", Host: "host1",
+		Meta: map[string]string{"version": "1"}, Tags: []string{"canary"}})
+	registry.Add(Service{Name: "service1", Host: "host1",
+		Meta: map[string]string{"version": "2"}})
+	services := registry.List("service1")
+	if length := len(services); length != 1 {
+		t.Fatalf("expected length: 1, got: %d", length)
+	}
+	if version := services[0].Meta["version"]; version != "2" {
+		t.Fatalf("expected version: 2, got: %s", version)
+	}
+	if tags := services[0].Tags; len(tags) != 0 {
+		t.Fatalf("expected no tags, got: %v", tags)
+	}
+}
+
 // TestRemove tests the randomRegistry.Remove function.
 func TestRemove(t *testing.T) {
 	registry := generateTestRegistry(1, 5)
@@ -166,23 +210,30 @@ func TestRemove(t *testing.T) {
 	}
 }
 
-// TestGet tests the randomRegistry.Get function.
-func TestGet(t *testing.T) {
+// TestActive tests the randomRegistry.Active function.
+func TestActive(t *testing.T) {
 	registry := generateTestRegistry(5, 5)
+	registry.Services[10].Added = registry.Services[10].Added.Add(
+		-13 * time.Hour)
 	table := []struct {
 		name        string
-		expectedErr bool
+		expectedLen int
 	}{
-		{name: "service3", expectedErr: false},
-		{name: "invalid", expectedErr: true},
+		{name: "service3", expectedLen: 4},
+		{name: "service4", expectedLen: 5},
+		{name: "invalid", expectedLen: 0},
 	}
 	for _, row := range table {
-		service, err := registry.Get(row.name)
-		if !row.expectedErr && service.Name != row.name {
-			t.Fatalf("expected: %s, got: %s; %v", row.name, service.Name, row)
+		services := registry.Active(Filter{Name: row.name})
+		if length := len(services); length != row.expectedLen {
+			t.Fatalf("expected: %d, got: %d; %v", row.expectedLen, length,
+				row)
 		}
-		if row.expectedErr && err == nil {
-			t.Fatalf("expected error, got nil; %v", row)
+		for _, service := range services {
+			if service.Name != row.name {
+				t.Fatalf("expected: %s, got: %s; %v", row.name, service.Name,
+					row)
+			}
 		}
 	}
 }
@@ -220,12 +271,12 @@ func TestSetTimeout(t *testing.T) {
 		service.Added = service.Added.Add(-7 * time.Hour)
 		registry.Services[i] = service
 	}
-	services := registry.getAll("", false)
+	services := registry.getAll(Filter{}, false)
 	if length := len(services); length != 25 {
 		t.Fatalf("failed to propagate registry, got length: %d", length)
 	}
 	registry.SetTimeout(6 * time.Hour)
-	services = registry.getAll("", false)
+	services = registry.getAll(Filter{}, false)
 	if length := len(services); length != 0 {
 		t.Fatalf("expected empty list, got length: %d\n", length)
 	}
@@ -238,13 +289,301 @@ func TestSetKeep(t *testing.T) {
 		service.Added = service.Added.Add(-15 * time.Hour)
 		registry.Services[i] = service
 	}
-	registry.getAll("", false)
-	if length := len(registry.Services); length != 25 {
+	rescheduleAll(registry)
+	if length := len(registry.getAll(Filter{}, true)); length != 25 {
 		t.Fatalf("failed to propagate registry, got length: %d", length)
 	}
 	registry.SetKeep(14 * time.Hour)
-	registry.getAll("", false)
-	if length := len(registry.Services); length != 0 {
+	if length := len(registry.getAll(Filter{}, true)); length != 0 {
+		t.Fatalf("expected empty list, got length: %d", length)
+	}
+	waitFor(t, func() bool { return countServices(registry) == 0 })
+}
+
+// TestListMatching tests the randomRegistry.ListMatching function.
+func TestListMatching(t *testing.T) {
+	registry := generateTestRegistry(2, 4)
+	for i, service := range registry.Services {
+		service.Meta = map[string]string{"env": "prod"}
+		if i%2 == 0 {
+			service.Meta["env"] = "dev"
+			service.Tags = []string{"canary"}
+		}
+		registry.Services[i] = service
+	}
+	table := []struct {
+		filter      Filter
+		expectedLen int
+	}{
+		{filter: Filter{}, expectedLen: 8},
+		{filter: Filter{Name: "service1"}, expectedLen: 4},
+		{filter: Filter{Tags: []string{"canary"}}, expectedLen: 4},
+		{filter: Filter{Name: "service2",
+			Meta: map[string]string{"env": "prod"}}, expectedLen: 2},
+		{filter: Filter{Meta: map[string]string{"env": "test"}},
+			expectedLen: 0},
+	}
+	for _, row := range table {
+		services := registry.ListMatching(row.filter)
+		if length := len(services); length != row.expectedLen {
+			t.Fatalf("expected: %d, got: %d; %v", row.expectedLen, length,
+				row)
+		}
+	}
+}
+
+// TestActiveMatching tests the randomRegistry.Active function with a filter.
+func TestActiveMatching(t *testing.T) {
+	registry := generateTestRegistry(1, 4)
+	registry.Services[2].Tags = []string{"canary"}
+	services := registry.Active(Filter{Name: "service1",
+		Tags: []string{"canary"}})
+	if len(services) != 1 || services[0].Host != "host3" {
+		t.Fatalf("expected only host3, got: %v", services)
+	}
+	services = registry.Active(Filter{Name: "service1",
+		Tags: []string{"stable"}})
+	if length := len(services); length != 0 {
 		t.Fatalf("expected empty list, got length: %d", length)
 	}
 }
+
+// TestPolicies tests setting, listing and removing traffic policies.
+func TestPolicies(t *testing.T) {
+	registry := generateTestRegistry(0, 0)
+	registry.SetPolicy(TrafficPolicy{Name: "service2"})
+	registry.SetPolicy(TrafficPolicy{Name: "service1"})
+	registry.SetPolicy(TrafficPolicy{Name: "service1",
+		Splits: []Split{{Tag: "canary", Weight: 1}}})
+	policies := registry.Policies("")
+	if len(policies) != 2 || policies[0].Name != "service1" ||
+		len(policies[0].Splits) != 1 {
+		t.Fatalf("unexpected policies: %v", policies)
+	}
+	if policies := registry.Policies("service2"); len(policies) != 1 {
+		t.Fatalf("expected one policy, got: %v", policies)
+	}
+	registry.RemovePolicy("service2")
+	if policies := registry.Policies("service2"); len(policies) != 0 {
+		t.Fatalf("expected no policies, got: %v", policies)
+	}
+}
+
+// TestStatus tests deriving service status from reports and expiry.
+func TestStatus(t *testing.T) {
+	registry := generateTestRegistry(1, 5)
+	registry.Services[1].Status = StatusWarning
+	registry.Services[2].Status = StatusCritical
+	registry.Services[2].Reason = "disk full"
+	registry.Services[3].Status = StatusMaintenance
+	registry.Services[4].Added = registry.Services[4].Added.Add(-13 * time.Hour)
+	expected := []struct {
+		status Status
+		reason string
+	}{
+		{StatusPassing, ""},
+		{StatusWarning, ""},
+		{StatusCritical, "disk full"},
+		{StatusMaintenance, ""},
+		{StatusCritical, "registration expired"},
+	}
+	services := registry.List("service1")
+	for i, service := range services {
+		if service.Status != expected[i].status ||
+			service.Reason != expected[i].reason {
+			t.Fatalf("expected: %v, got: %s %s", expected[i], service.Status,
+				service.Reason)
+		}
+	}
+	active := registry.Active(Filter{Name: "service1"})
+	if len(active) != 2 || active[0].Host != "host1" ||
+		active[1].Host != "host2" {
+		t.Fatalf("expected passing and warning services, got: %v", active)
+	}
+}
+
+// TestDrain tests the randomRegistry.Drain function.
+func TestDrain(t *testing.T) {
+	registry := generateTestRegistry(1, 2)
+	if err := registry.Drain(Service{Name: "service1", Host: "hostX"},
+		true); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	drained := Service{Name: "service1", Host: "host1"}
+	if err := registry.Drain(drained, true); err != nil {
+		t.Fatalf("failed to drain service: %s", err.Error())
+	}
+	// renewing a draining service should keep it draining
+	registry.Add(drained)
+	services := registry.List("service1")
+	if services[0].Status != StatusMaintenance || !services[0].Drain {
+		t.Fatalf("expected draining service, got: %v", services[0])
+	}
+	active := registry.Active(Filter{Name: "service1"})
+	if len(active) != 1 || active[0].Host != "host2" {
+		t.Fatalf("expected only host2 active, got: %v", active)
+	}
+	if err := registry.Drain(drained, false); err != nil {
+		t.Fatalf("failed to undrain service: %s", err.Error())
+	}
+	if length := len(registry.Active(Filter{Name: "service1"})); length != 2 {
+		t.Fatalf("expected: 2, got: %d", length)
+	}
+}
+
+// TestServiceLifetime tests services overriding the registry timeout and keep
+// durations.
+func TestServiceLifetime(t *testing.T) {
+	registry := generateTestRegistry(1, 5)
+	registry.Services[1].TTL = Duration(time.Hour)
+	registry.Services[2].TTL = Duration(30 * time.Minute)
+	registry.Services[2].Keep = Duration(time.Hour)
+	registry.Services[3].TTL = Duration(5 * time.Hour)
+	registry.Services[3].Keep = Duration(5 * time.Hour)
+	registry.Services[4].Keep = Duration(time.Hour)
+	for i, service := range registry.Services {
+		service.Added = service.Added.Add(-2 * time.Hour)
+		registry.Services[i] = service
+	}
+	registry.SetTimeout(3 * time.Hour)
+	registry.SetKeep(4 * time.Hour)
+	table := []struct {
+		host         string
+		expectedTTL  time.Duration
+		expectedKeep time.Duration
+		expected     Status
+	}{
+		{"host1", 3 * time.Hour, 4 * time.Hour, StatusPassing},
+		{"host2", time.Hour, 4 * time.Hour, StatusCritical},
+		{"host3", 30 * time.Minute, time.Hour, StatusCritical},
+		{"host4", 5 * time.Hour, 5 * time.Hour, StatusPassing},
+		{"host5", 3 * time.Hour, 3 * time.Hour, StatusPassing},
+	}
+	services := registry.List("service1")
+	if len(services) != 4 {
+		t.Fatalf("expected expired services to be removed, got: %v", services)
+	}
+	for _, row := range table {
+		var found *Service
+		for i := range services {
+			if services[i].Host == row.host {
+				found = &services[i]
+			}
+		}
+		if row.expectedKeep < 2*time.Hour {
+			if found != nil {
+				t.Fatalf("expected service to be removed, got: %v", *found)
+			}
+			continue
+		}
+		if found == nil {
+			t.Fatalf("expected service to be listed: %v", row)
+		}
+		if time.Duration(found.TTL) != row.expectedTTL ||
+			time.Duration(found.Keep) != row.expectedKeep ||
+			found.Status != row.expected {
+			t.Fatalf("expected: %v, got: %v", row, *found)
+		}
+	}
+}
+
+// TestOnExpire tests observing services expiring and being removed.
+func TestOnExpire(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	start := clock.Now()
+	registry := NewRandomRegistry(time.Minute, time.Hour)
+	registry.SetClock(clock)
+	defer registry.Stop()
+	events := make(chan Expiry, 10)
+	registry.OnExpire(func(expiry Expiry) {
+		events <- expiry
+	})
+	registry.Add(Service{Name: "service1", Host: "host1"})
+	registry.Add(Service{Name: "service1", Host: "host2"})
+	registry.Remove(Service{Name: "service1", Host: "host2"})
+	table := []struct {
+		removed  bool
+		deadline time.Duration
+	}{
+		{removed: false, deadline: time.Minute},
+		{removed: true, deadline: time.Hour},
+	}
+	for _, row := range table {
+		var expiry Expiry
+		advanceUntil(t, clock, time.Minute, func() bool {
+			select {
+			case expiry = <-events:
+				return true
+			default:
+				return false
+			}
+		})
+		if expiry.Removed != row.removed || expiry.Service.Host != "host1" ||
+			expiry.Service.Status != StatusCritical {
+			t.Fatalf("expected removed: %t for host1, got: %v", row.removed,
+				expiry)
+		}
+		if elapsed := clock.Now().Sub(start); elapsed < row.deadline {
+			t.Fatalf("expected event after: %v, got: %v", row.deadline,
+				elapsed)
+		}
+	}
+	if services := registry.List(""); len(services) != 0 {
+		t.Fatalf("expected empty registry, got: %v", services)
+	}
+	clock.Advance(time.Hour)
+	select {
+	case expiry := <-events:
+		t.Fatalf("unexpected expiry event: %v", expiry)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// testRestore tests restoring services into a registry and reading back their
+// records.
+func testRestore(t *testing.T, registry Registry) {
+	clock := NewFakeClock(time.Now())
+	registry.SetClock(clock)
+	registry.Add(Service{Name: "service1", Host: "host1"})
+	added := clock.Now().Add(-2 * time.Minute)
+	registry.Restore(Service{Name: "service1", Host: "host1", Added: added,
+		Drain: true})
+	registry.Restore(Service{Name: "service2", Host: "host1", Added: added,
+		TTL: Duration(time.Hour)})
+	registry.Restore(Service{Name: "service3", Host: "host1", Added: added})
+	table := []struct {
+		name     string
+		drain    bool
+		ttl      time.Duration
+		expected Status
+	}{
+		{name: "service1", drain: true, ttl: time.Minute,
+			expected: StatusCritical},
+		{name: "service2", ttl: time.Hour, expected: StatusPassing},
+		{name: "service3", ttl: time.Minute, expected: StatusCritical},
+	}
+	records := registry.Records()
+	if len(records) != len(table) {
+		t.Fatalf("expected %d records, got: %v", len(table), records)
+	}
+	for i, row := range table {
+		record := records[i]
+		if record.Name != row.name || !record.Added.Equal(added) ||
+			record.Drain != row.drain || time.Duration(record.TTL) != row.ttl {
+			t.Fatalf("expected %s added at %v with drain: %t and ttl: %v, "+
+				"got: %v", row.name, added, row.drain, row.ttl, record)
+		}
+		services := registry.List(row.name)
+		if len(services) != 1 || services[0].Status != row.expected {
+			t.Fatalf("expected %s to be %s, got: %v", row.name, row.expected,
+				services)
+		}
+	}
+}
+
+// TestRestore tests restoring services into a random registry.
+func TestRestore(t *testing.T) {
+	registry := NewRandomRegistry(time.Minute, time.Hour)
+	defer registry.Stop()
+	testRestore(t, registry)
+}
@@ -0,0 +1,210 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// deadline is when a service replicant expires or is removed from a registry.
+type deadline struct {
+	key    string    // key identifies the replicant, see serviceKey.
+	at     time.Time // at is when the deadline passes.
+	remove bool      // remove is true if the replicant is removed at the deadline.
+	index  int       // index is the position of the deadline in the heap.
+}
+
+// deadlineKey identifies a deadline of a replicant.
+type deadlineKey struct {
+	key    string
+	remove bool
+}
+
+// deadlines is a heap of deadlines ordered by time.
+type deadlines []*deadline
+
+func (d deadlines) Len() int           { return len(d) }
+func (d deadlines) Less(i, j int) bool { return d[i].at.Before(d[j].at) }
+
+func (d deadlines) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+	d[i].index, d[j].index = i, j
+}
+
+func (d *deadlines) Push(x interface{}) {
+	item := x.(*deadline)
+	item.index = len(*d)
+	*d = append(*d, item)
+}
+
+func (d *deadlines) Pop() interface{} {
+	old := *d
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*d = old[:len(old)-1]
+	return item
+}
+
+// reaper runs a goroutine that calls expire for each deadline as it passes, so
+// that a registry can expire and remove services without waiting for a read.
+type reaper struct {
+	deadlines deadlines
+	index     map[deadlineKey]*deadline
+	expire    func(key string, remove bool)
+	clock     Clock
+	timer     Timer // timer fires at the earliest deadline, created on first use.
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   *sync.Once
+	mutex     *sync.Mutex
+}
+
+// newReaper creates a reaper and starts its goroutine.
+func newReaper(expire func(key string, remove bool)) *reaper {
+	r := &reaper{
+		index:   make(map[deadlineKey]*deadline),
+		expire:  expire,
+		clock:   SystemClock,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: &sync.Once{},
+		mutex:   &sync.Mutex{},
+	}
+	go r.run()
+	return r
+}
+
+// setClock sets the clock deadlines are timed by.
+func (r *reaper) setClock(clock Clock) {
+	r.mutex.Lock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.clock = clock
+	r.mutex.Unlock()
+	r.poke()
+}
+
+// poke wakes the reaper goroutine to check its deadlines.
+func (r *reaper) poke() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule sets when the replicant expires, or is removed if remove is true,
+// replacing any earlier deadline of the same kind.
+func (r *reaper) schedule(key string, at time.Time, remove bool) {
+	r.mutex.Lock()
+	if item, ok := r.index[deadlineKey{key, remove}]; ok {
+		item.at = at
+		heap.Fix(&r.deadlines, item.index)
+	} else {
+		item := &deadline{key: key, at: at, remove: remove}
+		heap.Push(&r.deadlines, item)
+		r.index[deadlineKey{key, remove}] = item
+	}
+	r.mutex.Unlock()
+	r.poke()
+}
+
+// cancel drops the deadlines of the replicant.
+func (r *reaper) cancel(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, remove := range []bool{false, true} {
+		if item, ok := r.index[deadlineKey{key, remove}]; ok {
+			heap.Remove(&r.deadlines, item.index)
+			delete(r.index, deadlineKey{key, remove})
+		}
+	}
+}
+
+// due pops the deadlines that have passed and gets a channel that receives when
+// the next deadline passes, or nil if there are none. The reaper's one timer is
+// reset to the next deadline rather than a new timer created on each wake.
+func (r *reaper) due() ([]deadline, <-chan time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := r.clock.Now()
+	var due []deadline
+	for len(r.deadlines) > 0 && !r.deadlines[0].at.After(now) {
+		item := heap.Pop(&r.deadlines).(*deadline)
+		delete(r.index, deadlineKey{item.key, item.remove})
+		due = append(due, *item)
+	}
+	if len(r.deadlines) == 0 {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		return due, nil
+	}
+	wait := r.deadlines[0].at.Sub(now)
+	if r.timer == nil {
+		r.timer = r.clock.NewTimer(wait)
+	} else {
+		r.timer.Reset(wait)
+	}
+	return due, r.timer.C()
+}
+
+// run calls expire for deadlines as they pass until the reaper is stopped.
+func (r *reaper) run() {
+	for {
+		due, next := r.due()
+		for _, item := range due {
+			r.expire(item.key, item.remove)
+		}
+		select {
+		case <-next:
+		case <-r.wake:
+		case <-r.done:
+		}
+		select {
+		case <-r.done:
+			r.mutex.Lock()
+			if r.timer != nil {
+				r.timer.Stop()
+			}
+			r.mutex.Unlock()
+			return
+		default:
+		}
+	}
+}
+
+// stop stops the reaper goroutine. Later calls have no effect.
+func (r *reaper) stop() {
+	r.stopped.Do(func() {
+		close(r.done)
+	})
+}
@@ -0,0 +1,136 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor waits up to a second for the condition to hold.
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestReaper tests expiring deadlines in order as they pass.
+func TestReaper(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		expired []deadline
+	)
+	r := newReaper(func(key string, remove bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		expired = append(expired, deadline{key: key, remove: remove})
+	})
+	defer r.stop()
+	now := time.Now()
+	r.schedule("a", now.Add(30*time.Millisecond), false)
+	r.schedule("b", now.Add(10*time.Millisecond), false)
+	r.schedule("b", now.Add(20*time.Millisecond), true)
+	r.schedule("c", now.Add(time.Hour), false)
+	r.schedule("c", now.Add(-time.Second), false)
+	r.schedule("d", now.Add(10*time.Millisecond), true)
+	r.cancel("d")
+	expected := []deadline{
+		{key: "c"},
+		{key: "b"},
+		{key: "b", remove: true},
+		{key: "a"},
+	}
+	waitFor(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(expired) >= len(expected)
+	})
+	time.Sleep(20 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(expired) != len(expected) {
+		t.Fatalf("expected: %v, got: %v", expected, expired)
+	}
+	for i := range expected {
+		if expired[i] != expected[i] {
+			t.Fatalf("expected: %v, got: %v", expected, expired)
+		}
+	}
+}
+
+// TestReaperStop tests that a stopped reaper expires nothing.
+func TestReaperStop(t *testing.T) {
+	expired := make(chan string, 1)
+	r := newReaper(func(key string, remove bool) {
+		expired <- key
+	})
+	r.schedule("a", time.Now().Add(10*time.Millisecond), false)
+	r.stop()
+	r.stop()
+	select {
+	case key := <-expired:
+		t.Fatalf("unexpected expiry: %s", key)
+	case <-time.After(30 * time.Millisecond):
+	}
+}
+
+// TestReaperTimer tests that the reaper waits on one timer however often it is
+// woken.
+func TestReaperTimer(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	expired := make(chan string, 1)
+	r := newReaper(func(key string, remove bool) {
+		expired <- key
+	})
+	defer r.stop()
+	r.setClock(clock)
+	for i := 0; i < 100; i++ {
+		r.schedule("a", clock.Now().Add(time.Duration(i+1)*time.Second),
+			false)
+		waitFor(t, func() bool {
+			return clock.Waiters() == 1
+		})
+	}
+	clock.Advance(100 * time.Second)
+	select {
+	case key := <-expired:
+		if key != "a" {
+			t.Fatalf("expected: a, got: %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected expiry")
+	}
+	waitFor(t, func() bool {
+		return clock.Waiters() == 0
+	})
+}
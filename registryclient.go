@@ -32,7 +32,9 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -50,6 +52,95 @@ type RegistryClient struct {
 	mutex    *sync.RWMutex
 	running  bool
 	shutdown chan bool
+	load     LoadFunc
+	ttl      time.Duration
+	clock    Clock
+}
+
+// defaultRenewInterval is how often Auto renews a registration when it derives
+// the interval but the server has not granted a TTL.
+const defaultRenewInterval = 20 * time.Second
+
+// LoadFunc reports the current load of a service, such as its in-flight
+// requests, CPU usage or queue depth.
+type LoadFunc func() float64
+
+// ServiceOption sets optional information on the service registered by a
+// RegistryClient.
+type ServiceOption func(service *Service)
+
+// WithMeta adds a metadata key/value pair to the registered service.
+func WithMeta(key, value string) ServiceOption {
+	return func(service *Service) {
+		if service.Meta == nil {
+			service.Meta = make(map[string]string)
+		}
+		service.Meta[key] = value
+	}
+}
+
+// WithTags adds tags to the registered service.
+func WithTags(tags ...string) ServiceOption {
+	return func(service *Service) {
+		service.Tags = append(service.Tags, tags...)
+	}
+}
+
+// WithWeight sets the relative share of traffic weighted balancers send to the
+// registered service.
+func WithWeight(weight int) ServiceOption {
+	return func(service *Service) {
+		service.Weight = weight
+	}
+}
+
+// WithZone sets the region and zone the registered service runs in.
+func WithZone(region, zone string) ServiceOption {
+	return func(service *Service) {
+		service.Region = region
+		service.Zone = zone
+	}
+}
+
+// WithPriority sets the failover tier of the registered service. Discovery only
+// selects from the tier with the lowest priority that has active replicants.
+func WithPriority(priority int) ServiceOption {
+	return func(service *Service) {
+		service.Priority = priority
+	}
+}
+
+// WithHealthCheck declares a health check the server runs against the
+// registered service. Replicants failing their check are not discovered.
+func WithHealthCheck(check HealthCheck) ServiceOption {
+	return func(service *Service) {
+		service.Check = &check
+	}
+}
+
+// WithTTL requests how long the server considers the registered service active
+// without renewal. The server limits the TTL to its bounds.
+func WithTTL(ttl time.Duration) ServiceOption {
+	return func(service *Service) {
+		service.TTL = Duration(ttl)
+	}
+}
+
+// WithKeep requests how long the server keeps the registered service once it
+// stops renewing. The server limits the keep duration to its bounds.
+func WithKeep(keep time.Duration) ServiceOption {
+	return func(service *Service) {
+		service.Keep = Duration(keep)
+	}
+}
+
+// newService builds the service registered by a RegistryClient.
+func newService(name, host string, options []ServiceOption) Service {
+	service := Service{Name: name, Host: host}
+	for _, option := range options {
+		option(&service)
+	}
+	return service
 }
 
 // setRunning thread-safe way of setting the running state of this client.
@@ -66,9 +157,73 @@ func (client *RegistryClient) IsRunning() bool {
 	return client.running
 }
 
-// Register registers the service with the discovery service.
+// SetLoad sets the load reported with the next registration.
+func (client *RegistryClient) SetLoad(load float64) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.service.Load = load
+}
+
+// ReportLoad sets a function that is called for the current load each time the
+// service registers, including each automatic renewal.
+func (client *RegistryClient) ReportLoad(load LoadFunc) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.load = load
+}
+
+// SetStatus sets the health status reported by the service, with a reason
+// explaining any status other than passing, and registers the service so that
+// the status takes effect immediately. Services reporting a critical or
+// maintenance status remain listed but are not discovered.
+func (client *RegistryClient) SetStatus(status Status, reason string) error {
+	client.mutex.Lock()
+	client.service.Status = status
+	client.service.Reason = reason
+	client.mutex.Unlock()
+	return client.Register()
+}
+
+// TTL gets the TTL granted by the server at the last registration, or zero if
+// the service has not registered.
+func (client *RegistryClient) TTL() time.Duration {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.ttl
+}
+
+// SetClock sets the clock automatic registration is timed by.
+func (client *RegistryClient) SetClock(clock Clock) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.clock = clock
+}
+
+// getClock thread-safe way of getting the clock of this client.
+func (client *RegistryClient) getClock() Clock {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.clock
+}
+
+// getService thread-safe way of getting the service this client registers.
+func (client *RegistryClient) getService() Service {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.service
+}
+
+// Register registers the service with the discovery service. If a LoadFunc is
+// set the current load is reported with the registration. The TTL granted by
+// the server is kept for deriving the automatic registration interval.
 func (client *RegistryClient) Register() error {
-	raw, err := json.Marshal(client.service)
+	client.mutex.RLock()
+	load := client.load
+	client.mutex.RUnlock()
+	if load != nil {
+		client.SetLoad(load())
+	}
+	raw, err := json.Marshal(client.getService())
 	if err != nil {
 		return err
 	}
@@ -85,11 +240,31 @@ func (client *RegistryClient) Register() error {
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf(string(body))
+		return errors.New(string(body))
+	}
+	granted := Service{}
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&granted); err != nil && err != io.EOF {
+		return err
+	}
+	if granted.TTL > 0 {
+		client.mutex.Lock()
+		client.ttl = time.Duration(granted.TTL)
+		client.mutex.Unlock()
 	}
 	return nil
 }
 
+// renewInterval gets the interval to renew the registration on when it is
+// derived from the granted TTL, a third of the TTL so that a renewal may fail
+// without the service expiring.
+func (client *RegistryClient) renewInterval() time.Duration {
+	if ttl := client.TTL(); ttl > 0 {
+		return ttl / 3
+	}
+	return defaultRenewInterval
+}
+
 // doAuto a concurrent function to perform the automatic registration.
 func (client *RegistryClient) doAuto(interval time.Duration) {
 	client.setRunning(true)
@@ -100,13 +275,23 @@ func (client *RegistryClient) doAuto(interval time.Duration) {
 			return
 		default:
 			client.Register()
-			time.Sleep(interval)
+			wait := interval
+			if wait <= 0 {
+				wait = client.renewInterval()
+			}
+			select {
+			case <-client.getClock().After(wait):
+			case <-client.shutdown:
+				client.setRunning(false)
+				return
+			}
 		}
 	}
 }
 
 // Auto automatically registers the service with the discovery service on the
-// specified interval.
+// specified interval. If the interval is zero it is derived from the TTL
+// granted by the server.
 func (client *RegistryClient) Auto(interval time.Duration) {
 	if !client.IsRunning() {
 		go client.doAuto(interval)
@@ -122,7 +307,7 @@ func (client *RegistryClient) Deregister() error {
 		default:
 		}
 	}
-	raw, err := json.Marshal(client.service)
+	raw, err := json.Marshal(client.getService())
 	if err != nil {
 		return err
 	}
@@ -139,11 +324,46 @@ func (client *RegistryClient) Deregister() error {
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf(string(body))
+		return errors.New(string(body))
 	}
 	return nil
 }
 
+// drain sends a drain request with the specified method for the service.
+func (client *RegistryClient) drain(method string) error {
+	raw, err := json.Marshal(client.getService())
+	if err != nil {
+		return err
+	}
+	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "drain"))
+	req, err := http.NewRequest(method, uri.String(), bytes.NewBuffer(raw))
+	req.Header.Set("Authorization", client.token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+// Drain puts the service into maintenance with the discovery service. The
+// service remains listed and keeps renewing but is no longer discovered.
+func (client *RegistryClient) Drain() error {
+	return client.drain("POST")
+}
+
+// Undrain returns a drained service to rotation.
+func (client *RegistryClient) Undrain() error {
+	return client.drain("DELETE")
+}
+
 // Ping pings the discovery service.
 func (client *RegistryClient) Ping() error {
 	uri, _ := url.Parse(fmt.Sprintf("%s/%s", client.host, "ping"))
@@ -159,24 +379,28 @@ func (client *RegistryClient) Ping() error {
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf(string(body))
+		return errors.New(string(body))
 	}
 	return nil
 }
 
-// NewRegistryClient returns a discovery server registry client.
+// NewRegistryClient returns a discovery server registry client. Options may be
+// supplied to attach metadata and tags to the registered service.
 func NewRegistryClient(name, host, targetHost, targetToken string,
-	timeout time.Duration) (*RegistryClient, error) {
+	timeout time.Duration, options ...ServiceOption) (*RegistryClient, error) {
 	client := &RegistryClient{
 		http.Client{
 			Timeout: timeout,
 		},
 		targetHost,
 		targetToken,
-		Service{Name: name, Host: host},
+		newService(name, host, options),
 		&sync.RWMutex{},
 		false,
 		make(chan bool, 1),
+		nil,
+		0,
+		SystemClock,
 	}
 	err := client.Ping()
 	if err != nil {
@@ -186,8 +410,10 @@ func NewRegistryClient(name, host, targetHost, targetToken string,
 }
 
 // NewTLSRegistryClient returns an encryped discovery server registry client.
+// Options may be supplied to attach metadata and tags to the registered service.
 func NewTLSRegistryClient(name, host, targetHost, targetToken, certFile string,
-	skipVerify bool, timeout time.Duration) (*RegistryClient, error) {
+	skipVerify bool, timeout time.Duration,
+	options ...ServiceOption) (*RegistryClient, error) {
 	certs, err := x509.SystemCertPool()
 	if err != nil {
 		certs = x509.NewCertPool()
@@ -213,10 +439,13 @@ func NewTLSRegistryClient(name, host, targetHost, targetToken, certFile string,
 		},
 		targetHost,
 		targetToken,
-		Service{Name: name, Host: host},
+		newService(name, host, options),
 		&sync.RWMutex{},
 		false,
 		make(chan bool, 1),
+		nil,
+		0,
+		SystemClock,
 	}
 	err = client.Ping()
 	if err != nil {
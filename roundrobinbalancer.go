@@ -0,0 +1,153 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"sync"
+)
+
+// rotationLimit is the most scopes a round-robin balancer tracks before it
+// starts its rotations over.
+const rotationLimit = 4096
+
+// roundRobinBalancer implements ScopedBalancer by cycling through the
+// candidate replicants of each scope in the order of their keys. It remembers
+// the replicant selected last rather than a position, so that the order the
+// candidates are given in does not matter and replicants joining or leaving
+// the candidates do not start the rotation over.
+type roundRobinBalancer struct {
+	last  map[string]string
+	mutex *sync.Mutex
+}
+
+// Select chooses the next of the services, rotating every set of candidates
+// given to Select together.
+func (b *roundRobinBalancer) Select(services []Service) (Service, error) {
+	return b.SelectScope(services, "")
+}
+
+func (b *roundRobinBalancer) SelectScope(services []Service,
+	scope string) (Service, error) {
+	if len(services) == 0 {
+		return Service{}, errNoServices
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	last, ok := b.last[scope]
+	if !ok && len(b.last) >= rotationLimit {
+		b.last = make(map[string]string)
+	}
+	// select the replicant following the last one, wrapping to the first
+	first, next := -1, -1
+	var firstKey, nextKey string
+	for i, service := range services {
+		key := serviceKey(service)
+		if first < 0 || key < firstKey {
+			first, firstKey = i, key
+		}
+		if key > last && (next < 0 || key < nextKey) {
+			next, nextKey = i, key
+		}
+	}
+	if next < 0 {
+		next, nextKey = first, firstKey
+	}
+	b.last[scope] = nextKey
+	return services[next], nil
+}
+
+// NewRoundRobinBalancer creates a Balancer that selects each replicant of a
+// service in turn.
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{
+		last:  make(map[string]string),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// weightedRoundRobinBalancer implements ScopedBalancer with the smooth
+// weighted round-robin algorithm, which interleaves replicants in proportion
+// to their weight rather than selecting heavier replicants in bursts. Each
+// scope keeps the current weight of its replicants, and ties are broken by
+// key so that the order the candidates are given in does not matter.
+type weightedRoundRobinBalancer struct {
+	current map[string]map[string]int
+	mutex   *sync.Mutex
+}
+
+// weight gets the effective weight of the service.
+func (service Service) weight() int {
+	if service.Weight <= 0 {
+		return 1
+	}
+	return service.Weight
+}
+
+// Select chooses one of the services, interleaving every set of candidates
+// given to Select together.
+func (b *weightedRoundRobinBalancer) Select(services []Service) (Service,
+	error) {
+	return b.SelectScope(services, "")
+}
+
+func (b *weightedRoundRobinBalancer) SelectScope(services []Service,
+	scope string) (Service, error) {
+	if len(services) == 0 {
+		return Service{}, errNoServices
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	previous, ok := b.current[scope]
+	if !ok && len(b.current) >= rotationLimit {
+		b.current = make(map[string]map[string]int)
+	}
+	current := make(map[string]int, len(services))
+	total, best := 0, -1
+	var bestKey string
+	for i, service := range services {
+		key := serviceKey(service)
+		current[key] = previous[key] + service.weight()
+		total += service.weight()
+		if best < 0 || current[key] > current[bestKey] ||
+			(current[key] == current[bestKey] && key < bestKey) {
+			best, bestKey = i, key
+		}
+	}
+	current[bestKey] -= total
+	b.current[scope] = current
+	return services[best], nil
+}
+
+// NewWeightedRoundRobinBalancer creates a Balancer that selects replicants in
+// turn in proportion to their weight.
+func NewWeightedRoundRobinBalancer() Balancer {
+	return &weightedRoundRobinBalancer{
+		current: make(map[string]map[string]int),
+		mutex:   &sync.Mutex{},
+	}
+}
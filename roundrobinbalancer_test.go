@@ -0,0 +1,126 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+)
+
+// TestRoundRobinBalancer tests the roundRobinBalancer.Select function.
+func TestRoundRobinBalancer(t *testing.T) {
+	balancer := NewRoundRobinBalancer()
+	if _, err := balancer.Select(nil); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	services := generateTestServices(3)
+	expected := []string{"host1", "host2", "host3", "host1", "host2"}
+	for _, host := range expected {
+		service, err := balancer.Select(services)
+		if err != nil {
+			t.Fatalf("failed to select service: %s", err.Error())
+		}
+		if service.Host != host {
+			t.Fatalf("expected: %s, got: %s", host, service.Host)
+		}
+	}
+	// each scope, such as a filtered subset, rotates on its own in the order
+	// of the hosts
+	scoped := balancer.(ScopedBalancer)
+	subset := []Service{services[2], services[0]}
+	expected = []string{"host1", "host3", "host1", "host3", "host3"}
+	for i, host := range expected {
+		candidates, scope := subset, "subset"
+		if i == 3 {
+			candidates, scope = services, ""
+		}
+		service, err := scoped.SelectScope(candidates, scope)
+		if err != nil {
+			t.Fatalf("failed to select service: %s", err.Error())
+		}
+		if service.Host != host {
+			t.Fatalf("expected: %s, got: %s; at %d", host, service.Host, i)
+		}
+	}
+}
+
+// TestRoundRobinBalancerMembership tests continuing a rotation when
+// replicants leave and join the candidates or are given in another order.
+func TestRoundRobinBalancerMembership(t *testing.T) {
+	balancer := NewRoundRobinBalancer()
+	services := generateTestServices(4)
+	table := []struct {
+		candidates []Service
+		expected   string
+	}{
+		{candidates: services, expected: "host1"},
+		{candidates: services, expected: "host2"},
+		// host3 renews late
+		{candidates: []Service{services[3], services[0], services[1]},
+			expected: "host4"},
+		{candidates: services[:2], expected: "host1"},
+		{candidates: []Service{services[3], services[2], services[1],
+			services[0]}, expected: "host2"},
+		{candidates: services, expected: "host3"},
+		// host4 is drained
+		{candidates: services[:3], expected: "host1"},
+	}
+	for i, row := range table {
+		service, err := balancer.Select(row.candidates)
+		if err != nil {
+			t.Fatalf("failed to select service: %s", err.Error())
+		}
+		if service.Host != row.expected {
+			t.Fatalf("expected: %s, got: %s; row %d", row.expected,
+				service.Host, i)
+		}
+	}
+}
+
+// TestWeightedRoundRobinBalancer tests the weightedRoundRobinBalancer.Select
+// function.
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	balancer := NewWeightedRoundRobinBalancer()
+	if _, err := balancer.Select(nil); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	services := generateTestServices(3)
+	services[0].Weight = 5
+	// host2 has no weight and should be treated as weight one
+	services[2].Weight = 1
+	expected := []string{"host1", "host1", "host2", "host1", "host3", "host1",
+		"host1"}
+	for i, host := range expected {
+		service, err := balancer.Select(services)
+		if err != nil {
+			t.Fatalf("failed to select service: %s", err.Error())
+		}
+		if service.Host != host {
+			t.Fatalf("expected: %s, got: %s; at %d", host, service.Host, i)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Selector operators supported by a Requirement.
+const (
+	OpEquals       = "="
+	OpNotEquals    = "!="
+	OpIn           = "in"
+	OpNotIn        = "notin"
+	OpExists       = "exists"
+	OpDoesNotExist = "!"
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+)
+
+// Requirement is a single condition of a Selector. The key name refers to the
+// service name, host to the service host and tag to the service tags; any
+// other key refers to a metadata value.
+type Requirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+// Selector chooses services that satisfy every one of its requirements, for
+// example: name=billing,env in (prod,staging),version>=2.1
+type Selector []Requirement
+
+// Eq requires the key to equal the value.
+func Eq(key, value string) Requirement {
+	return Requirement{Key: key, Operator: OpEquals, Values: []string{value}}
+}
+
+// NotEq requires the key to be absent or differ from the value.
+func NotEq(key, value string) Requirement {
+	return Requirement{Key: key, Operator: OpNotEquals, Values: []string{value}}
+}
+
+// In requires the key to equal one of the values.
+func In(key string, values ...string) Requirement {
+	return Requirement{Key: key, Operator: OpIn, Values: values}
+}
+
+// NotIn requires the key to be absent or equal none of the values.
+func NotIn(key string, values ...string) Requirement {
+	return Requirement{Key: key, Operator: OpNotIn, Values: values}
+}
+
+// Exists requires the key to be present.
+func Exists(key string) Requirement {
+	return Requirement{Key: key, Operator: OpExists}
+}
+
+// DoesNotExist requires the key to be absent.
+func DoesNotExist(key string) Requirement {
+	return Requirement{Key: key, Operator: OpDoesNotExist}
+}
+
+// Gt requires the key to be a version greater than the value.
+func Gt(key, version string) Requirement {
+	return Requirement{Key: key, Operator: OpGreater, Values: []string{version}}
+}
+
+// Gte requires the key to be a version greater than or equal to the value.
+func Gte(key, version string) Requirement {
+	return Requirement{Key: key, Operator: OpGreaterEqual,
+		Values: []string{version}}
+}
+
+// Lt requires the key to be a version less than the value.
+func Lt(key, version string) Requirement {
+	return Requirement{Key: key, Operator: OpLess, Values: []string{version}}
+}
+
+// Lte requires the key to be a version less than or equal to the value.
+func Lte(key, version string) Requirement {
+	return Requirement{Key: key, Operator: OpLessEqual,
+		Values: []string{version}}
+}
+
+// String returns the requirement in selector syntax.
+func (requirement Requirement) String() string {
+	switch requirement.Operator {
+	case OpExists:
+		return requirement.Key
+	case OpDoesNotExist:
+		return "!" + requirement.Key
+	case OpIn, OpNotIn:
+		return fmt.Sprintf("%s %s (%s)", requirement.Key, requirement.Operator,
+			strings.Join(requirement.Values, ","))
+	}
+	value := ""
+	if len(requirement.Values) > 0 {
+		value = requirement.Values[0]
+	}
+	return requirement.Key + requirement.Operator + value
+}
+
+// String returns the selector in selector syntax.
+func (selector Selector) String() string {
+	parts := make([]string, len(selector))
+	for i, requirement := range selector {
+		parts[i] = requirement.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// values gets the values of the key on the service and whether it is present.
+func (requirement Requirement) values(service Service) ([]string, bool) {
+	switch requirement.Key {
+	case "name":
+		return []string{service.Name}, true
+	case "host":
+		return []string{service.Host}, true
+	case "tag":
+		return service.Tags, len(service.Tags) > 0
+	}
+	value, ok := service.Meta[requirement.Key]
+	return []string{value}, ok
+}
+
+// contains returns true if any of the actual values is one of the expected
+// values.
+func contains(actual, expected []string) bool {
+	for _, a := range actual {
+		for _, e := range expected {
+			if a == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Matches returns true if the service satisfies the requirement.
+func (requirement Requirement) Matches(service Service) bool {
+	actual, ok := requirement.values(service)
+	switch requirement.Operator {
+	case OpEquals, OpIn:
+		return ok && contains(actual, requirement.Values)
+	case OpNotEquals, OpNotIn:
+		return !ok || !contains(actual, requirement.Values)
+	case OpExists:
+		return ok
+	case OpDoesNotExist:
+		return !ok
+	}
+	if !ok || len(requirement.Values) == 0 {
+		return false
+	}
+	cmp := compareVersions(actual[0], requirement.Values[0])
+	switch requirement.Operator {
+	case OpGreater:
+		return cmp > 0
+	case OpGreaterEqual:
+		return cmp >= 0
+	case OpLess:
+		return cmp < 0
+	case OpLessEqual:
+		return cmp <= 0
+	}
+	return false
+}
+
+// Matches returns true if the service satisfies every requirement.
+func (selector Selector) Matches(service Service) bool {
+	for _, requirement := range selector {
+		if !requirement.Matches(service) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersions compares two dotted versions such as 2.1 and v2.10.3-rc1,
+// returning a negative number, zero or a positive number if a is less than,
+// equal to or greater than b. Missing components are treated as zero and a
+// pre-release sorts before its release.
+func compareVersions(a, b string) int {
+	a, b = strings.TrimPrefix(a, "v"), strings.TrimPrefix(b, "v")
+	aVersion, aPre := splitPreRelease(a)
+	bVersion, bPre := splitPreRelease(b)
+	aParts, bParts := strings.Split(aVersion, "."), strings.Split(bVersion, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		if cmp := compareVersionPart(aPart, bPart); cmp != 0 {
+			return cmp
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return strings.Compare(aPre, bPre)
+}
+
+// splitPreRelease splits a version into its release and pre-release parts.
+func splitPreRelease(version string) (string, string) {
+	if idx := strings.Index(version, "-"); idx >= 0 {
+		return version[:idx], version[idx+1:]
+	}
+	return version, ""
+}
+
+// compareVersionPart compares version components numerically when both are
+// numbers and lexically otherwise.
+func compareVersionPart(a, b string) int {
+	aNum, aErr := strconv.Atoi(a)
+	bNum, bErr := strconv.Atoi(b)
+	if aErr != nil || bErr != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case aNum < bNum:
+		return -1
+	case aNum > bNum:
+		return 1
+	}
+	return 0
+}
+
+// selectorParser holds the state of a selector being parsed.
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+// isSelectorSpecial returns true if the byte may not appear in a key or value.
+func isSelectorSpecial(c byte) bool {
+	return strings.IndexByte(" \t,()=!<>", c) >= 0
+}
+
+// skipSpace advances the parser past any whitespace.
+func (p *selectorParser) skipSpace() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' ||
+		p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// consume advances the parser past the token if it is next in the input.
+func (p *selectorParser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+// word reads a key or value from the input.
+func (p *selectorParser) word() (string, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && !isSelectorSpecial(p.input[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", fmt.Errorf("expected identifier at position %d", start)
+	}
+	return p.input[start:p.pos], nil
+}
+
+// list reads a parenthesized, comma separated list of values.
+func (p *selectorParser) list() ([]string, error) {
+	if !p.consume("(") {
+		return nil, fmt.Errorf("expected '(' at position %d", p.pos)
+	}
+	var values []string
+	for {
+		value, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if p.consume(")") {
+			return values, nil
+		}
+		if !p.consume(",") {
+			return nil, fmt.Errorf("expected ',' or ')' at position %d", p.pos)
+		}
+	}
+}
+
+// requirement reads a single requirement from the input.
+func (p *selectorParser) requirement() (Requirement, error) {
+	if p.consume("!") {
+		key, err := p.word()
+		return DoesNotExist(key), err
+	}
+	key, err := p.word()
+	if err != nil {
+		return Requirement{}, err
+	}
+	for _, op := range []string{OpNotEquals, OpGreaterEqual, OpLessEqual,
+		"==", OpEquals, OpGreater, OpLess} {
+		if p.consume(op) {
+			value, err := p.word()
+			if op == "==" {
+				op = OpEquals
+			}
+			return Requirement{Key: key, Operator: op,
+				Values: []string{value}}, err
+		}
+	}
+	p.skipSpace()
+	start := p.pos
+	if word, err := p.word(); err == nil && (word == OpIn || word == OpNotIn) {
+		values, err := p.list()
+		return Requirement{Key: key, Operator: word, Values: values}, err
+	}
+	p.pos = start
+	return Exists(key), nil
+}
+
+// ParseSelector parses a selector such as: name=billing,env in (prod,staging)
+// The empty string parses to a selector that matches every service.
+func ParseSelector(input string) (Selector, error) {
+	p := &selectorParser{input: input}
+	selector := Selector{}
+	if p.skipSpace(); p.pos == len(p.input) {
+		return selector, nil
+	}
+	for {
+		requirement, err := p.requirement()
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector '%s': %s", input,
+				err.Error())
+		}
+		selector = append(selector, requirement)
+		if p.skipSpace(); p.pos == len(p.input) {
+			return selector, nil
+		}
+		if !p.consume(",") {
+			return nil, fmt.Errorf("invalid selector '%s': expected ',' at "+
+				"position %d", input, p.pos)
+		}
+	}
+}
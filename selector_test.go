@@ -0,0 +1,128 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+)
+
+// TestParseSelector tests the ParseSelector function.
+func TestParseSelector(t *testing.T) {
+	table := []struct {
+		input       string
+		expected    string
+		expectedErr bool
+	}{
+		{input: "", expected: ""},
+		{input: "name=billing", expected: "name=billing"},
+		{input: "name == billing", expected: "name=billing"},
+		{input: "env in (prod, staging)", expected: "env in (prod,staging)"},
+		{input: "env notin (dev)", expected: "env notin (dev)"},
+		{input: "version>=2.1,version<3", expected: "version>=2.1,version<3"},
+		{input: "canary, !legacy", expected: "canary,!legacy"},
+		{input: "zone!=us-east-1a", expected: "zone!=us-east-1a"},
+		{input: "name=billing,env in (prod,staging),version>=2.1",
+			expected: "name=billing,env in (prod,staging),version>=2.1"},
+		{input: "=billing", expectedErr: true},
+		{input: "env in prod", expectedErr: true},
+		{input: "env in (prod", expectedErr: true},
+		{input: "name=", expectedErr: true},
+		{input: "name=a name=b", expectedErr: true},
+		{input: "name=a,", expectedErr: true},
+	}
+	for _, row := range table {
+		selector, err := ParseSelector(row.input)
+		if row.expectedErr {
+			if err == nil {
+				t.Fatalf("expected error, got: %v; %v", selector, row)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to parse selector: %s; %v", err.Error(), row)
+		}
+		if result := selector.String(); result != row.expected {
+			t.Fatalf("expected: %s, got: %s; %v", row.expected, result, row)
+		}
+	}
+}
+
+// TestSelectorMatches tests the Selector.Matches function.
+func TestSelectorMatches(t *testing.T) {
+	service := Service{Name: "billing", Host: "host1",
+		Meta: map[string]string{"env": "prod", "version": "2.10.0"},
+		Tags: []string{"canary"}}
+	table := []struct {
+		selector Selector
+		expected bool
+	}{
+		{selector: Selector{}, expected: true},
+		{selector: Selector{Eq("name", "billing")}, expected: true},
+		{selector: Selector{Eq("host", "host2")}, expected: false},
+		{selector: Selector{Eq("tag", "canary")}, expected: true},
+		{selector: Selector{NotEq("tag", "canary")}, expected: false},
+		{selector: Selector{In("env", "prod", "staging")}, expected: true},
+		{selector: Selector{NotIn("env", "prod")}, expected: false},
+		{selector: Selector{NotIn("zone", "a")}, expected: true},
+		{selector: Selector{Exists("env")}, expected: true},
+		{selector: Selector{DoesNotExist("env")}, expected: false},
+		{selector: Selector{Gte("version", "2.1")}, expected: true},
+		{selector: Selector{Gt("version", "2.10")}, expected: false},
+		{selector: Selector{Lt("version", "v2.9")}, expected: false},
+		{selector: Selector{Lte("version", "2.10.0")}, expected: true},
+		{selector: Selector{Gt("missing", "1")}, expected: false},
+		{selector: Selector{Eq("name", "billing"), Eq("env", "dev")},
+			expected: false},
+	}
+	for _, row := range table {
+		if matches := row.selector.Matches(service); matches != row.expected {
+			t.Fatalf("expected: %t, got: %t; %v", row.expected, matches,
+				row.selector)
+		}
+	}
+}
+
+// TestCompareVersions tests the compareVersions function.
+func TestCompareVersions(t *testing.T) {
+	table := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "2.1", b: "2.1.0", expected: 0},
+		{a: "2.10", b: "2.9", expected: 1},
+		{a: "v1.0", b: "1.1", expected: -1},
+		{a: "1.0-rc1", b: "1.0", expected: -1},
+		{a: "1.0-rc2", b: "1.0-rc1", expected: 1},
+		{a: "1.a", b: "1.b", expected: -1},
+	}
+	for _, row := range table {
+		if cmp := compareVersions(row.a, row.b); cmp != row.expected {
+			t.Fatalf("expected: %d, got: %d; %v", row.expected, cmp, row)
+		}
+	}
+}
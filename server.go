@@ -28,10 +28,14 @@
 package discovery
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 )
 
@@ -39,10 +43,137 @@ import (
 type Server struct {
 	http.Server
 	registry      Registry
+	balancer      Balancer
 	authenticator Authenticator
+	locality      locality
+	mutex         *sync.RWMutex
+	checker       *checker
+	outliers      *outlierDetector
+	flaps         *flapDetector
+	ttl           bounds
+	keep          bounds
+	clock         Clock
+	snapshotter   *Snapshotter
+	cluster       *raftNode
+	consistency   Consistency
 }
 
-// handleRegister adds a service to or renews a service with the registry.
+// bounds limits a duration requested by a service.
+type bounds struct {
+	min time.Duration
+	max time.Duration
+}
+
+// clamp gets the duration within the bounds. A duration of zero or less is
+// unset so that the registry default applies.
+func (b bounds) clamp(d Duration) Duration {
+	switch {
+	case d <= 0:
+		return 0
+	case time.Duration(d) < b.min:
+		return Duration(b.min)
+	case time.Duration(d) > b.max:
+		return Duration(b.max)
+	}
+	return d
+}
+
+// discoverOptions holds the caller supplied parameters of a discover request
+// other than the filter.
+type discoverOptions struct {
+	key    string // key selects a service with a KeyedBalancer.
+	region string // region is the region of the caller.
+	zone   string // zone is the zone of the caller.
+}
+
+// parseDiscoverOptions reads discover options from request query parameters.
+func parseDiscoverOptions(query url.Values) discoverOptions {
+	return discoverOptions{
+		key:    query.Get("key"),
+		region: query.Get("region"),
+		zone:   query.Get("zone"),
+	}
+}
+
+// discover selects one of the services matching the filter. Only services that
+// are active, healthy, steady and not ejected as outliers are considered, and
+// only those in the highest priority tier. Any traffic policy for the service
+// name is applied and services near the caller are preferred. If a key is
+// given and the balancer is a KeyedBalancer the service is selected for the
+// key. Otherwise a ScopedBalancer selects within the scope of the filter and
+// the caller's location.
+func (server *Server) discover(filter Filter,
+	options discoverOptions) (Service, error) {
+	services := server.flaps.steady(server.checker.healthy(
+		server.registry.Active(filter)))
+	services = server.outliers.admitted(services)
+	if len(services) == 0 {
+		return Service{}, fmt.Errorf("no such service '%s'", filter.Name)
+	}
+	services = topPriority(services)
+	if filter.Name != "" {
+		for _, policy := range server.registry.Policies(filter.Name) {
+			services = policy.apply(services)
+		}
+	}
+	server.mutex.RLock()
+	services = server.locality.nearest(services, options.region,
+		options.zone)
+	server.mutex.RUnlock()
+	if keyed, ok := server.balancer.(KeyedBalancer); ok && options.key != "" {
+		return keyed.SelectKey(services, options.key)
+	}
+	if scoped, ok := server.balancer.(ScopedBalancer); ok {
+		return scoped.SelectScope(services, filter.scope()+"\x00"+
+			options.region+"\x00"+options.zone)
+	}
+	return server.balancer.Select(services)
+}
+
+// lookup gets the registered record of the service.
+func (server *Server) lookup(service Service) (Service, bool) {
+	services := server.registry.ListMatching(Filter{Name: service.Name,
+		Selector: Selector{Eq("host", service.Host)}})
+	if len(services) == 0 {
+		return Service{}, false
+	}
+	return services[0], true
+}
+
+// observe records with the flap detector whether the registered service is
+// active and healthy. Services in maintenance are not observed so that draining
+// a service is not mistaken for flapping.
+func (server *Server) observe(service Service) {
+	service, ok := server.lookup(service)
+	if !ok {
+		return
+	}
+	service = server.checker.annotate(service)
+	if service.Status == StatusMaintenance {
+		return
+	}
+	server.flaps.observe(service, service.Status.Active())
+}
+
+// expire handles an expiry event from the registry. An expired service is
+// observed by the flap detector and a removed service is forgotten.
+func (server *Server) expire(expiry Expiry) {
+	service := expiry.Service
+	if !expiry.Removed {
+		log.Printf("service %s at %s expired\n", service.Name, service.Host)
+		server.observe(service)
+		return
+	}
+	log.Printf("removed service %s at %s\n", service.Name, service.Host)
+	server.checker.forget(service)
+	server.outliers.forget(service)
+	server.flaps.forget(service)
+}
+
+// handleRegister adds a service to or renews a service with the registry and
+// starts any health check the service declares. A TTL or Keep requested by the
+// service is limited to the server bounds. Responds with the service as
+// registered, including the TTL and Keep granted.
 func (server *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		log.Printf("invalid request method from: %s\n", r.Host)
@@ -60,13 +191,40 @@ func (server *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		err = decoder.Decode(&service)
 	}
-	if r.Body == nil || err != nil || service.Name == "" || service.Host == "" {
+	if r.Body == nil || err != nil || service.Name == "" || service.Host == "" ||
+		!service.Status.valid() ||
+		(service.Check != nil && !service.Check.valid()) {
 		log.Printf("bad request body from: %s\n", r.Host)
 		http.Error(w, "failed to read request body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
-	server.registry.Add(service)
+	service.Health, service.Drain, service.Flapping = nil, false, false
+	server.mutex.RLock()
+	service.TTL = server.ttl.clamp(service.TTL)
+	service.Keep = server.keep.clamp(service.Keep)
+	server.mutex.RUnlock()
+	if service.Keep > 0 && service.Keep < service.TTL {
+		service.Keep = service.TTL
+	}
+	err = server.commit(walRecord{Op: walAdd, Service: &service})
+	if err != nil {
+		log.Printf("failed to register service: %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	granted, ok := server.lookup(service)
+	if !ok {
+		return
+	}
+	raw, err := json.Marshal(granted)
+	if err != nil {
+		log.Printf("error writing service to JSON: %s\n", err.Error())
+		http.Error(w, "failed to write service", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
 }
 
 // handleDeregister removes a service from the registry.
@@ -93,7 +251,84 @@ func (server *Server) handleDeregister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	server.registry.Remove(service)
+	err = server.commit(walRecord{Op: walRemove, Service: &service})
+	if err != nil {
+		log.Printf("failed to deregister service: %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// handleDrain drains a service so that it remains listed but is no longer
+// discovered, or with the DELETE method stops draining it.
+func (server *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		log.Printf("invalid request method from: %s\n", r.Host)
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.authenticator(r.Header.Get("Authorization")) {
+		log.Printf("unauthorized drain request from: %s\n", r.Host)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var err error
+	service := Service{}
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&service)
+	}
+	if r.Body == nil || err != nil || service.Name == "" || service.Host == "" {
+		log.Printf("bad request body from: %s\n", r.Host)
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if _, ok := server.lookup(service); !ok {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	op := walUndrain
+	if r.Method == "POST" {
+		op = walDrain
+	}
+	if err := server.commit(walRecord{Op: op, Service: &service}); err != nil {
+		log.Printf("failed to drain service: %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// handleReport records a failure a client experienced using a service,
+// ejecting the service if it is reported failing too often.
+func (server *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		log.Printf("invalid request method from: %s\n", r.Host)
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.authenticator(r.Header.Get("Authorization")) {
+		log.Printf("unauthorized report request from: %s\n", r.Host)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var err error
+	service := Service{}
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&service)
+	}
+	if r.Body == nil || err != nil || service.Name == "" || service.Host == "" {
+		log.Printf("bad request body from: %s\n", r.Host)
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if _, ok := server.lookup(service); !ok {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	if server.outliers.report(service) {
+		log.Printf("ejected service %s at %s\n", service.Name, service.Host)
+	}
 }
 
 // handleDiscover gets a service from the registry.
@@ -108,13 +343,22 @@ func (server *Server) handleDiscover(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	name := r.URL.Query().Get("name")
-	if name == "" {
+	if server.routeRead(w, r) {
+		return
+	}
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		log.Printf("bad request query from: %s\n", r.Host)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.Name == "" && len(filter.Selector) == 0 {
 		log.Printf("bad request query from: %s\n", r.Host)
 		http.Error(w, "no service name provided", http.StatusBadRequest)
 		return
 	}
-	service, err := server.registry.Get(name)
+	service, err := server.discover(filter,
+		parseDiscoverOptions(r.URL.Query()))
 	if err != nil {
 		http.Error(w, "service not found", http.StatusNotFound)
 		return
@@ -129,7 +373,8 @@ func (server *Server) handleDiscover(w http.ResponseWriter, r *http.Request) {
 	w.Write(raw)
 }
 
-// handleList lists all services registered with the registry.
+// handleList lists all services registered with the registry along with the
+// priority tier discovery currently selects from for each service name.
 func (server *Server) handleList(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		log.Printf("invalid request method from: %s\n", r.Host)
@@ -141,10 +386,26 @@ func (server *Server) handleList(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if server.routeRead(w, r) {
+		return
+	}
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		log.Printf("bad request query from: %s\n", r.Host)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	resp := struct {
-		Services []Service `json:"services"`
+		Services []Service      `json:"services"`
+		Tiers    map[string]int `json:"active_tiers"`
 	}{}
-	resp.Services = server.registry.List(r.URL.Query().Get("name"))
+	resp.Services = server.registry.ListMatching(filter)
+	for i, service := range resp.Services {
+		resp.Services[i] = server.flaps.annotate(server.outliers.annotate(
+			server.checker.annotate(service)))
+	}
+	resp.Tiers = activeTiers(server.outliers.admitted(server.flaps.steady(
+		server.checker.healthy(server.registry.Active(filter)))))
 	raw, err := json.Marshal(resp)
 	if err != nil {
 		log.Printf("error writing services to JSON: %s\n", err.Error())
@@ -155,6 +416,75 @@ func (server *Server) handleList(w http.ResponseWriter, r *http.Request) {
 	w.Write(raw)
 }
 
+// handlePolicy lists, sets or removes traffic policies.
+func (server *Server) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		log.Printf("invalid request method from: %s\n", r.Host)
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.authenticator(r.Header.Get("Authorization")) {
+		log.Printf("unauthorized policy request from: %s\n", r.Host)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		var err error
+		policy := TrafficPolicy{}
+		if r.Body != nil {
+			defer r.Body.Close()
+			decoder := json.NewDecoder(r.Body)
+			err = decoder.Decode(&policy)
+		}
+		if r.Body == nil || err != nil {
+			log.Printf("bad request body from: %s\n", r.Host)
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if err := policy.validate(); err != nil {
+			log.Printf("bad traffic policy from: %s\n", r.Host)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = server.commit(walRecord{Op: walSetPolicy, Policy: &policy})
+		if err != nil {
+			log.Printf("failed to set policy: %s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			log.Printf("bad request query from: %s\n", r.Host)
+			http.Error(w, "no service name provided", http.StatusBadRequest)
+			return
+		}
+		err := server.commit(walRecord{Op: walRemovePolicy,
+			Policy: &TrafficPolicy{Name: name}})
+		if err != nil {
+			log.Printf("failed to remove policy: %s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+	default:
+		if server.routeRead(w, r) {
+			return
+		}
+		resp := struct {
+			Policies []TrafficPolicy `json:"policies"`
+		}{}
+		resp.Policies = server.registry.Policies(r.URL.Query().Get("name"))
+		raw, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("error writing policies to JSON: %s\n", err.Error())
+			http.Error(w, "failed to write policies",
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	}
+}
+
 // handlePing returns status code 200 if request passes auth.
 func (server *Server) handlePing(w http.ResponseWriter, r *http.Request) {
 	if !server.authenticator(r.Header.Get("Authorization")) {
@@ -164,6 +494,86 @@ func (server *Server) handlePing(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Shutdown gracefully shuts down the http server, saves a final snapshot if
+// snapshots are enabled, then stops any background work of the registry.
+func (server *Server) Shutdown(ctx context.Context) error {
+	err := server.Server.Shutdown(ctx)
+	server.checker.stop()
+	if node := server.getCluster(); node != nil {
+		node.stop()
+	}
+	server.mutex.RLock()
+	snapshotter := server.snapshotter
+	server.mutex.RUnlock()
+	if snapshotter != nil {
+		if serr := snapshotter.Stop(); err == nil {
+			err = serr
+		}
+	}
+	server.registry.Stop()
+	return err
+}
+
+// now gets the time on the server's clock.
+func (server *Server) now() time.Time {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	return server.clock.Now()
+}
+
+// journal records a registry mutation in the write-ahead log if snapshots are
+// enabled.
+func (server *Server) journal(record walRecord) error {
+	server.mutex.RLock()
+	snapshotter := server.snapshotter
+	server.mutex.RUnlock()
+	if snapshotter == nil {
+		return nil
+	}
+	return snapshotter.append(record)
+}
+
+// EnableSnapshots restores the registry from the latest snapshot and
+// write-ahead log in the data directory, then logs each change to the registry
+// and saves a snapshot on the interval and when the server shuts down. Restored
+// services that were active get the grace period to renew before they expire.
+// A server in a cluster keeps the registry in its cluster state instead, so
+// snapshots cannot be enabled once a cluster is.
+func (server *Server) EnableSnapshots(dir string, interval,
+	grace time.Duration) (int, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.snapshotter != nil {
+		return 0, errors.New("snapshots already enabled")
+	}
+	if server.cluster != nil {
+		return 0, errors.New("snapshots cannot be enabled in a cluster")
+	}
+	snapshotter := NewSnapshotter(server.registry, dir)
+	snapshotter.SetClock(server.clock)
+	count, err := snapshotter.Restore(grace)
+	if err != nil {
+		return 0, err
+	}
+	snapshotter.Start(interval)
+	server.snapshotter = snapshotter
+	return count, nil
+}
+
+// SetClock sets the clock the server and its registry are timed by.
+func (server *Server) SetClock(clock Clock) {
+	server.mutex.Lock()
+	server.clock = clock
+	if server.snapshotter != nil {
+		server.snapshotter.SetClock(clock)
+	}
+	server.mutex.Unlock()
+	server.registry.SetClock(clock)
+	server.checker.setClock(clock)
+	server.outliers.setClock(clock)
+	server.flaps.setClock(clock)
+}
+
 // SetTimeout updates how long a service should be considered active.
 func (server *Server) SetTimeout(timeout time.Duration) {
 	server.registry.SetTimeout(timeout)
@@ -174,25 +584,125 @@ func (server *Server) SetKeep(keep time.Duration) {
 	server.registry.SetKeep(keep)
 }
 
-// NewServer returns a server with the specified parameters.
-func NewServer(port int, authenticator Authenticator,
-	registry Registry) *Server {
+// SetTTLBounds updates the shortest and longest TTL a service may request. A
+// service that does not request a TTL uses the timeout.
+func (server *Server) SetTTLBounds(min, max time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.ttl = bounds{min: min, max: max}
+}
+
+// SetKeepBounds updates the shortest and longest Keep a service may request. A
+// service that does not request a Keep uses the keep duration.
+func (server *Server) SetKeepBounds(min, max time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.keep = bounds{min: min, max: max}
+}
+
+// SetLocality updates how many active replicants the caller's zone and region
+// must have before discovery is restricted to them. When a zone or region has
+// fewer replicants traffic overflows to the next wider locality.
+func (server *Server) SetLocality(minZone, minRegion int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.locality = locality{minZone: minZone, minRegion: minRegion}
+}
+
+// SetOutlierDetection updates how failures reported by clients eject services.
+// A service reported failing threshold times within the window is not
+// discovered for the base duration, doubling with each consecutive ejection up
+// to the max duration. A threshold of zero disables ejection.
+func (server *Server) SetOutlierDetection(threshold int, window, base,
+	max time.Duration) {
+	server.outliers.configure(threshold, window, base, max)
+}
+
+// SetFlapDetection updates how services that keep going up and down are held
+// out of discovery. A service whose status or health check result changes
+// threshold times within the window is not discovered until it goes the stable
+// duration without changing. A threshold of zero disables flap detection.
+func (server *Server) SetFlapDetection(threshold int, window,
+	stable time.Duration) {
+	server.flaps.configure(threshold, window, stable)
+}
+
+// NewServer returns a server with the specified parameters. The registry
+// stores services and the balancer selects between active replicants.
+func NewServer(port int, authenticator Authenticator, registry Registry,
+	balancer Balancer) *Server {
 	mux := http.NewServeMux()
 	server := &Server{
 		http.Server{Addr: fmt.Sprintf("localhost:%d", port), Handler: mux},
 		registry,
+		balancer,
 		authenticator,
+		locality{minZone: 1, minRegion: 1},
+		&sync.RWMutex{},
+		newChecker(registry),
+		newOutlierDetector(),
+		newFlapDetector(),
+		bounds{min: time.Second, max: time.Hour},
+		bounds{min: time.Minute, max: 7 * 24 * time.Hour},
+		SystemClock,
+		nil,
+		nil,
+		ConsistencyStale,
 	}
+	server.checker.notify = server.observe
+	registry.OnExpire(server.expire)
 	mux.HandleFunc("/register", server.handleRegister)
 	mux.HandleFunc("/deregister", server.handleDeregister)
+	mux.HandleFunc("/drain", server.handleDrain)
+	mux.HandleFunc("/report", server.handleReport)
 	mux.HandleFunc("/discover", server.handleDiscover)
 	mux.HandleFunc("/list", server.handleList)
+	mux.HandleFunc("/policy", server.handlePolicy)
 	mux.HandleFunc("/ping", server.handlePing)
+	mux.HandleFunc("/raft/", server.handleRaft)
 	return server
 }
 
-// NewRandomServer returns a server backed by a RandomRegistry.
+// NewRandomServer returns a server backed by an in-memory registry that selects
+// a random service when replicants exist.
 func NewRandomServer(port int, authenticator Authenticator) *Server {
 	return NewServer(port, authenticator,
-		NewRandomRegistry(time.Minute, 12*time.Hour))
+		NewRandomRegistry(time.Minute, 12*time.Hour), NewRandomBalancer())
+}
+
+// NewRoundRobinServer returns a server backed by an in-memory registry that
+// selects each replicant of a service in turn.
+func NewRoundRobinServer(port int, authenticator Authenticator) *Server {
+	return NewServer(port, authenticator,
+		NewRandomRegistry(time.Minute, 12*time.Hour), NewRoundRobinBalancer())
+}
+
+// NewWeightedRoundRobinServer returns a server backed by an in-memory registry
+// that selects replicants in turn in proportion to their registered weight.
+func NewWeightedRoundRobinServer(port int,
+	authenticator Authenticator) *Server {
+	return NewServer(port, authenticator,
+		NewRandomRegistry(time.Minute, 12*time.Hour),
+		NewWeightedRoundRobinBalancer())
+}
+
+// NewHashServer returns a server backed by an in-memory registry that selects
+// the same replicant for requests with the same key.
+func NewHashServer(port int, authenticator Authenticator) *Server {
+	return NewServer(port, authenticator,
+		NewRandomRegistry(time.Minute, 12*time.Hour), NewHashBalancer())
+}
+
+// NewLeastLoadServer returns a server backed by an in-memory registry that
+// selects the replicant reporting the lowest load.
+func NewLeastLoadServer(port int, authenticator Authenticator) *Server {
+	return NewServer(port, authenticator,
+		NewRandomRegistry(time.Minute, 12*time.Hour), NewLeastLoadBalancer())
+}
+
+// NewTwoChoiceServer returns a server backed by an in-memory registry that
+// selects the less loaded of two random replicants.
+func NewTwoChoiceServer(port int, authenticator Authenticator) *Server {
+	return NewServer(port, authenticator,
+		NewRandomRegistry(time.Minute, 12*time.Hour), NewTwoChoiceBalancer())
 }
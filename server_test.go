@@ -29,15 +29,25 @@ package discovery
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
+// firstBalancer is a Balancer that always selects the first service.
+type firstBalancer struct{}
+
+func (b firstBalancer) Select(services []Service) (Service, error) {
+	return services[0], nil
+}
+
 // TestHandleDiscover405 tests the discover endpoint with a bad method.
 func TestHandleDiscover405(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
@@ -250,6 +260,18 @@ func TestHandleRegister400(t *testing.T) {
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, status)
 	}
+	// a health check may not name a host other than the service host
+	req, err = http.NewRequest("POST", "/register", bytes.NewBufferString(
+		`{"name":"service1","host":"host1",`+
+			`"check":{"http":"http://169.254.169.254/latest"}}`))
+	if err != nil {
+		t.Fatalf("failed to create mock request: %s", err.Error())
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, status)
+	}
 }
 
 // TestHandleRegister200 tests the register endpoint.
@@ -270,7 +292,7 @@ func TestHandleRegister200(t *testing.T) {
 	if status := rr.Code; status != http.StatusOK {
 		t.Fatalf("expected: %v, got: %v", http.StatusOK, status)
 	}
-	if _, err := server.registry.Get(service.Name); err != nil {
+	if _, err := server.discover(Filter{Name: service.Name}, discoverOptions{}); err != nil {
 		t.Fatalf("failed to retrieve registered service: %s", err.Error())
 	}
 }
@@ -345,7 +367,708 @@ func TestHandleDeregister200(t *testing.T) {
 	if status := rr.Code; status != http.StatusOK {
 		t.Fatalf("expected: %v, got: %v", http.StatusOK, status)
 	}
-	if s, err := server.registry.Get(service.Name); err == nil {
+	if s, err := server.discover(Filter{Name: service.Name}, discoverOptions{}); err == nil {
 		t.Fatalf("deregistered service found in registry: %v", s)
 	}
 }
+
+// TestHandleRegisterMeta tests that metadata and tags survive registration,
+// discovery and listing.
+func TestHandleRegisterMeta(t *testing.T) {
+	server := NewRandomServer(64646, NullAuthenticator)
+	service := Service{Name: "service1", Host: "host1",
+		Meta: map[string]string{"env": "prod"}, Tags: []string{"canary"}}
+	raw, err := json.Marshal(service)
+	if err != nil {
+		t.Fatalf("failed to create request body: %s", err.Error())
+	}
+	req, err := http.NewRequest("POST", "/register", bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatalf("failed to create mock request: %s", err.Error())
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.handleRegister).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, status)
+	}
+	req, err = http.NewRequest("GET", "/discover?name=service1", nil)
+	if err != nil {
+		t.Fatalf("failed to create mock request: %s", err.Error())
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(server.handleDiscover).ServeHTTP(rr, req)
+	discovered := Service{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &discovered); err != nil {
+		t.Fatalf("failed to parse json response: %s", err.Error())
+	}
+	if discovered.Meta["env"] != "prod" || len(discovered.Tags) != 1 ||
+		discovered.Tags[0] != "canary" {
+		t.Fatalf("discovered service missing metadata: %v", discovered)
+	}
+	req, err = http.NewRequest("GET", "/list?name=service1", nil)
+	if err != nil {
+		t.Fatalf("failed to create mock request: %s", err.Error())
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(server.handleList).ServeHTTP(rr, req)
+	resp := struct {
+		Services []Service `json:"services"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to parse json response: %s", err.Error())
+	}
+	if len(resp.Services) != 1 || resp.Services[0].Meta["env"] != "prod" {
+		t.Fatalf("listed service missing metadata: %v", resp.Services)
+	}
+}
+
+// TestHandleListFilter tests filtering the list endpoint by tag and metadata.
+func TestHandleListFilter(t *testing.T) {
+	server := NewRandomServer(64646, NullAuthenticator)
+	for i := 1; i <= 4; i++ {
+		service := Service{Name: "service1", Host: fmt.Sprintf("host%d", i),
+			Meta: map[string]string{"env": "prod"}}
+		if i%2 == 0 {
+			service.Meta["env"] = "dev"
+			service.Tags = []string{"canary"}
+		}
+		server.registry.Add(service)
+	}
+	table := []struct {
+		query       string
+		expectedLen int
+	}{
+		{query: "name=service1", expectedLen: 4},
+		{query: "tag=canary", expectedLen: 2},
+		{query: "meta.env=prod", expectedLen: 2},
+		{query: "tag=canary&meta.env=prod", expectedLen: 0},
+		{query: "q=env+in+(prod,dev),!canary", expectedLen: 4},
+		{query: "q=env%3Ddev,tag%3Dcanary", expectedLen: 2},
+	}
+	for _, row := range table {
+		req, err := http.NewRequest("GET", "/list?"+row.query, nil)
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleList).ServeHTTP(rr, req)
+		resp := struct {
+			Services []Service `json:"services"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to parse json response: %s", err.Error())
+		}
+		if length := len(resp.Services); length != row.expectedLen {
+			t.Fatalf("expected: %d, got: %d; %v", row.expectedLen, length,
+				row)
+		}
+	}
+}
+
+// TestHandleDiscoverFilter tests filtering the discover endpoint by tag.
+func TestHandleDiscoverFilter(t *testing.T) {
+	server := NewRandomServer(64646, NullAuthenticator)
+	server.registry.Add(Service{Name: "service1", Host: "host1"})
+	server.registry.Add(Service{Name: "service1", Host: "host2",
+		Tags: []string{"canary"}})
+	table := []struct {
+		query          string
+		expectedStatus int
+	}{
+		{query: "name=service1&tag=canary", expectedStatus: http.StatusOK},
+		{query: "name=service1&tag=stable",
+			expectedStatus: http.StatusNotFound},
+		{query: "q=name%3Dservice1,tag%3Dcanary",
+			expectedStatus: http.StatusOK},
+		{query: "q=name%3D", expectedStatus: http.StatusBadRequest},
+	}
+	for _, row := range table {
+		req, err := http.NewRequest("GET", "/discover?"+row.query, nil)
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleDiscover).ServeHTTP(rr, req)
+		if status := rr.Code; status != row.expectedStatus {
+			t.Fatalf("expected: %v, got: %v; %v", row.expectedStatus, status,
+				row)
+		}
+		if row.expectedStatus != http.StatusOK {
+			continue
+		}
+		service := Service{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &service); err != nil {
+			t.Fatalf("failed to parse json response: %s", err.Error())
+		}
+		if service.Host != "host2" {
+			t.Fatalf("expected: host2, got: %s", service.Host)
+		}
+	}
+}
+
+// TestDiscoverBalancer tests that the server selects through its balancer.
+func TestDiscoverBalancer(t *testing.T) {
+	server := NewServer(64646, NullAuthenticator,
+		NewRandomRegistry(time.Minute, time.Hour), firstBalancer{})
+	server.registry.Add(Service{Name: "service1", Host: "host1"})
+	server.registry.Add(Service{Name: "service1", Host: "host2"})
+	for i := 0; i < 10; i++ {
+		service, err := server.discover(Filter{Name: "service1"}, discoverOptions{})
+		if err != nil {
+			t.Fatalf("failed to discover service: %s", err.Error())
+		}
+		if service.Host != "host1" {
+			t.Fatalf("expected: host1, got: %s", service.Host)
+		}
+	}
+	if _, err := server.discover(Filter{Name: "invalid"}, discoverOptions{}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+// TestHandleDiscoverKey tests discovering the same service for the same key.
+func TestHandleDiscoverKey(t *testing.T) {
+	server := NewHashServer(64646, NullAuthenticator)
+	for i := 1; i <= 5; i++ {
+		server.registry.Add(Service{Name: "service1",
+			Host: fmt.Sprintf("host%d", i)})
+	}
+	hosts := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest("GET", "/discover?name=service1&key=user1",
+			nil)
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleDiscover).ServeHTTP(rr, req)
+		service := Service{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &service); err != nil {
+			t.Fatalf("failed to parse json response: %s", err.Error())
+		}
+		hosts[service.Host] = true
+	}
+	if length := len(hosts); length != 1 {
+		t.Fatalf("expected a single host for key, got: %d", length)
+	}
+}
+
+// TestHandleDiscoverZone tests discovering services near the caller.
+func TestHandleDiscoverZone(t *testing.T) {
+	server := NewRandomServer(64646, NullAuthenticator)
+	server.registry.Add(Service{Name: "service1", Host: "host1",
+		Region: "east", Zone: "east-a"})
+	server.registry.Add(Service{Name: "service1", Host: "host2",
+		Region: "east", Zone: "east-b"})
+	server.registry.Add(Service{Name: "service1", Host: "host3",
+		Region: "west", Zone: "west-a"})
+	table := []struct {
+		query    string
+		minZone  int
+		expected map[string]bool
+	}{
+		{query: "region=east&zone=east-a", minZone: 1,
+			expected: map[string]bool{"host1": true}},
+		{query: "region=east&zone=east-a", minZone: 2,
+			expected: map[string]bool{"host1": true, "host2": true}},
+		{query: "region=west&zone=west-b", minZone: 1,
+			expected: map[string]bool{"host3": true}},
+	}
+	for _, row := range table {
+		server.SetLocality(row.minZone, 1)
+		for i := 0; i < 20; i++ {
+			req, err := http.NewRequest("GET",
+				"/discover?name=service1&"+row.query, nil)
+			if err != nil {
+				t.Fatalf("failed to create mock request: %s", err.Error())
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(server.handleDiscover).ServeHTTP(rr, req)
+			service := Service{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &service); err != nil {
+				t.Fatalf("failed to parse json response: %s", err.Error())
+			}
+			if !row.expected[service.Host] {
+				t.Fatalf("unexpected host: %s; %v", service.Host, row)
+			}
+		}
+	}
+}
+
+// TestHandleDiscoverPriority tests failing over between priority tiers.
+func TestHandleDiscoverPriority(t *testing.T) {
+	server := NewRandomServer(64646, NullAuthenticator)
+	primary := Service{Name: "service1", Host: "host1"}
+	server.registry.Add(primary)
+	server.registry.Add(Service{Name: "service1", Host: "host2", Priority: 1})
+	table := []struct {
+		remove       bool
+		expectedHost string
+		expectedTier int
+	}{
+		{expectedHost: "host1", expectedTier: 0},
+		{remove: true, expectedHost: "host2", expectedTier: 1},
+	}
+	for _, row := range table {
+		if row.remove {
+			server.registry.Remove(primary)
+		}
+		for i := 0; i < 10; i++ {
+			service, err := server.discover(Filter{Name: "service1"},
+				discoverOptions{})
+			if err != nil {
+				t.Fatalf("failed to discover service: %s", err.Error())
+			}
+			if service.Host != row.expectedHost {
+				t.Fatalf("expected: %s, got: %s", row.expectedHost,
+					service.Host)
+			}
+		}
+		req, err := http.NewRequest("GET", "/list?name=service1", nil)
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleList).ServeHTTP(rr, req)
+		resp := struct {
+			Tiers map[string]int `json:"active_tiers"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to parse json response: %s", err.Error())
+		}
+		if tier := resp.Tiers["service1"]; tier != row.expectedTier {
+			t.Fatalf("expected tier: %d, got: %d", row.expectedTier, tier)
+		}
+	}
+}
+
+// TestHandlePolicy tests managing traffic policies through the policy
+// endpoint.
+func TestHandlePolicy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := NewRandomServer(64646, NullAuthenticator)
+	policy := `{"name":"service1","splits":[{"tag":"canary","weight":5},` +
+		`{"tag":"stable","weight":95}]}`
+	table := []struct {
+		method         string
+		query          string
+		body           string
+		expectedStatus int
+		expectedLen    int
+	}{
+		{method: "PUT", expectedStatus: http.StatusMethodNotAllowed},
+		{method: "POST", body: `{"name":"service1"}`,
+			expectedStatus: http.StatusBadRequest},
+		{method: "POST", body: `{"name":`,
+			expectedStatus: http.StatusBadRequest},
+		{method: "POST", body: policy, expectedStatus: http.StatusOK,
+			expectedLen: 1},
+		{method: "GET", query: "name=service2", expectedStatus: http.StatusOK,
+			expectedLen: 0},
+		{method: "DELETE", expectedStatus: http.StatusBadRequest,
+			expectedLen: 1},
+		{method: "DELETE", query: "name=service1",
+			expectedStatus: http.StatusOK, expectedLen: 0},
+	}
+	for _, row := range table {
+		req, err := http.NewRequest(row.method, "/policy?"+row.query,
+			bytes.NewBufferString(row.body))
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handlePolicy).ServeHTTP(rr, req)
+		if status := rr.Code; status != row.expectedStatus {
+			t.Fatalf("expected: %v, got: %v; %v", row.expectedStatus, status,
+				row)
+		}
+		if row.method == "GET" {
+			resp := struct {
+				Policies []TrafficPolicy `json:"policies"`
+			}{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse json response: %s", err.Error())
+			}
+			if length := len(resp.Policies); length != row.expectedLen {
+				t.Fatalf("expected: %d, got: %d; %v", row.expectedLen,
+					length, row)
+			}
+		} else if length := len(server.registry.Policies("")); length !=
+			row.expectedLen {
+			t.Fatalf("expected: %d, got: %d; %v", row.expectedLen, length, row)
+		}
+	}
+}
+
+// TestDiscoverPolicy tests that discovery applies traffic policies.
+func TestDiscoverPolicy(t *testing.T) {
+	server := NewRandomServer(64646, NullAuthenticator)
+	server.registry.Add(Service{Name: "service1", Host: "host1",
+		Tags: []string{"canary"}})
+	for i := 2; i <= 4; i++ {
+		server.registry.Add(Service{Name: "service1",
+			Host: fmt.Sprintf("host%d", i), Tags: []string{"stable"}})
+	}
+	server.registry.SetPolicy(TrafficPolicy{Name: "service1",
+		Splits: []Split{{Tag: "canary", Weight: 0}, {Tag: "stable",
+			Weight: 100}}})
+	for i := 0; i < 50; i++ {
+		service, err := server.discover(Filter{Name: "service1"},
+			discoverOptions{})
+		if err != nil {
+			t.Fatalf("failed to discover service: %s", err.Error())
+		}
+		if service.Host == "host1" {
+			t.Fatal("expected canary to receive no traffic")
+		}
+	}
+}
+
+// TestHandleRegisterCheck tests that failing health checks are reported by
+// the list endpoint and skipped by discovery.
+func TestHandleRegisterCheck(t *testing.T) {
+	server := NewRandomServer(64646, NullAuthenticator)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to reserve port: %v", err)
+	}
+	host := listener.Addr().String()
+	listener.Close()
+	raw, err := json.Marshal(Service{Name: "service1", Host: host,
+		Check: &HealthCheck{TCP: true,
+			Interval: Duration(10 * time.Millisecond)}})
+	if err != nil {
+		t.Fatalf("failed to create request body: %s", err.Error())
+	}
+	req, err := http.NewRequest("POST", "/register", bytes.NewBuffer(raw))
+	if err != nil {
+		t.Fatalf("failed to create mock request: %s", err.Error())
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.handleRegister).ServeHTTP(rr, req)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := server.discover(Filter{Name: "service1"},
+		discoverOptions{}); err == nil {
+		t.Fatal("expected unhealthy service not to be discovered")
+	}
+	req, err = http.NewRequest("GET", "/list?name=service1", nil)
+	if err != nil {
+		t.Fatalf("failed to create mock request: %s", err.Error())
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(server.handleList).ServeHTTP(rr, req)
+	resp := struct {
+		Services []Service `json:"services"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to parse json response: %s", err.Error())
+	}
+	if len(resp.Services) != 1 || resp.Services[0].Health == nil ||
+		resp.Services[0].Health.Healthy {
+		t.Fatalf("expected failing health in list, got: %v", resp.Services)
+	}
+}
+
+// TestHandleRegisterStatus tests registering services with a reported status.
+func TestHandleRegisterStatus(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := NewRandomServer(64646, NullAuthenticator)
+	table := []struct {
+		body           string
+		expectedStatus int
+	}{
+		{body: `{"name":"service1","host":"host1","status":"warning"}`,
+			expectedStatus: http.StatusOK},
+		{body: `{"name":"service1","host":"host2","status":"maintenance",` +
+			`"reason":"upgrading"}`, expectedStatus: http.StatusOK},
+		{body: `{"name":"service1","host":"host3","status":"broken"}`,
+			expectedStatus: http.StatusBadRequest},
+	}
+	for _, row := range table {
+		req, err := http.NewRequest("POST", "/register",
+			bytes.NewBufferString(row.body))
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleRegister).ServeHTTP(rr, req)
+		if status := rr.Code; status != row.expectedStatus {
+			t.Fatalf("expected: %v, got: %v; %v", row.expectedStatus, status,
+				row)
+		}
+	}
+	services := server.registry.List("service1")
+	if len(services) != 2 || services[1].Status != StatusMaintenance ||
+		services[1].Reason != "upgrading" {
+		t.Fatalf("unexpected services: %v", services)
+	}
+	for i := 0; i < 10; i++ {
+		service, err := server.discover(Filter{Name: "service1"},
+			discoverOptions{})
+		if err != nil || service.Host != "host1" {
+			t.Fatalf("expected: host1, got: %v, %v", service, err)
+		}
+	}
+}
+
+// TestHandleDrain tests draining services through the drain endpoint.
+func TestHandleDrain(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := NewRandomServer(64646, NullAuthenticator)
+	server.registry.Add(Service{Name: "service1", Host: "host1"})
+	body := `{"name":"service1","host":"host1"}`
+	table := []struct {
+		method         string
+		body           string
+		expectedStatus int
+		expectedActive int
+	}{
+		{method: "GET", body: body,
+			expectedStatus: http.StatusMethodNotAllowed, expectedActive: 1},
+		{method: "POST", body: `{"name":"service1"}`,
+			expectedStatus: http.StatusBadRequest, expectedActive: 1},
+		{method: "POST", body: `{"name":"service1","host":"host2"}`,
+			expectedStatus: http.StatusNotFound, expectedActive: 1},
+		{method: "POST", body: body, expectedStatus: http.StatusOK,
+			expectedActive: 0},
+		{method: "DELETE", body: body, expectedStatus: http.StatusOK,
+			expectedActive: 1},
+	}
+	for _, row := range table {
+		req, err := http.NewRequest(row.method, "/drain",
+			bytes.NewBufferString(row.body))
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleDrain).ServeHTTP(rr, req)
+		if status := rr.Code; status != row.expectedStatus {
+			t.Fatalf("expected: %v, got: %v; %v", row.expectedStatus, status,
+				row)
+		}
+		active := server.registry.Active(Filter{Name: "service1"})
+		if length := len(active); length != row.expectedActive {
+			t.Fatalf("expected: %d, got: %d; %v", row.expectedActive, length,
+				row)
+		}
+		if length := len(server.registry.List("service1")); length != 1 {
+			t.Fatalf("expected service to remain listed, got: %d", length)
+		}
+	}
+}
+
+// TestHandleReport tests ejecting services reported failing by clients.
+func TestHandleReport(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := NewServer(64646, NullAuthenticator,
+		NewRandomRegistry(time.Minute, time.Hour), firstBalancer{})
+	server.SetOutlierDetection(2, time.Minute, time.Minute, time.Hour)
+	server.registry.Add(Service{Name: "service1", Host: "host1"})
+	server.registry.Add(Service{Name: "service1", Host: "host2"})
+	body := `{"name":"service1","host":"host1"}`
+	table := []struct {
+		method         string
+		body           string
+		expectedStatus int
+		expectedHost   string
+	}{
+		{method: "GET", body: body,
+			expectedStatus: http.StatusMethodNotAllowed, expectedHost: "host1"},
+		{method: "POST", body: `{"name":"service1"}`,
+			expectedStatus: http.StatusBadRequest, expectedHost: "host1"},
+		{method: "POST", body: `{"name":"service1","host":"host3"}`,
+			expectedStatus: http.StatusNotFound, expectedHost: "host1"},
+		{method: "POST", body: body, expectedStatus: http.StatusOK,
+			expectedHost: "host1"},
+		{method: "POST", body: body, expectedStatus: http.StatusOK,
+			expectedHost: "host2"},
+	}
+	for _, row := range table {
+		req, err := http.NewRequest(row.method, "/report",
+			bytes.NewBufferString(row.body))
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleReport).ServeHTTP(rr, req)
+		if status := rr.Code; status != row.expectedStatus {
+			t.Fatalf("expected: %v, got: %v; %v", row.expectedStatus, status,
+				row)
+		}
+		service, err := server.discover(Filter{Name: "service1"},
+			discoverOptions{})
+		if err != nil || service.Host != row.expectedHost {
+			t.Fatalf("expected: %s, got: %v, %v; %v", row.expectedHost,
+				service, err, row)
+		}
+	}
+	for _, service := range server.registry.List("service1") {
+		service = server.outliers.annotate(service)
+		if (service.Status == StatusCritical) != (service.Host == "host1") {
+			t.Fatalf("expected only host1 to be critical, got: %v", service)
+		}
+	}
+}
+
+// TestHandleRegisterFlapping tests holding out services that keep expiring and
+// renewing.
+func TestHandleRegisterFlapping(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := NewServer(64646, NullAuthenticator,
+		NewRandomRegistry(40*time.Second, time.Hour), firstBalancer{})
+	defer server.Shutdown(context.Background())
+	clock := NewFakeClock(time.Now())
+	server.SetClock(clock)
+	server.SetFlapDetection(2, time.Minute, 50*time.Second)
+	register := func() {
+		req, err := http.NewRequest("POST", "/register",
+			bytes.NewBufferString(`{"name":"service1","host":"host1"}`))
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleRegister).ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, status)
+		}
+	}
+	register()
+	clock.Advance(50 * time.Second)
+	register()
+	if _, err := server.discover(Filter{Name: "service1"},
+		discoverOptions{}); err == nil {
+		t.Fatal("expected flapping service not to be discovered")
+	}
+	req, err := http.NewRequest("GET", "/list?name=service1", nil)
+	if err != nil {
+		t.Fatalf("failed to create mock request: %s", err.Error())
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.handleList).ServeHTTP(rr, req)
+	resp := struct {
+		Services []Service `json:"services"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to read list response: %v", err)
+	}
+	if len(resp.Services) != 1 || !resp.Services[0].Flapping {
+		t.Fatalf("expected flapping service to be listed, got: %v",
+			resp.Services)
+	}
+	for i := 0; i < 6; i++ {
+		clock.Advance(10 * time.Second)
+		register()
+	}
+	if _, err := server.discover(Filter{Name: "service1"},
+		discoverOptions{}); err != nil {
+		t.Fatalf("expected stable service to be discovered, got: %v", err)
+	}
+}
+
+// TestBoundsClamp tests limiting requested durations to bounds.
+func TestBoundsClamp(t *testing.T) {
+	b := bounds{min: time.Second, max: time.Minute}
+	table := []struct {
+		requested Duration
+		expected  Duration
+	}{
+		{requested: 0, expected: 0},
+		{requested: -1, expected: 0},
+		{requested: Duration(time.Millisecond), expected: Duration(time.Second)},
+		{requested: Duration(time.Second), expected: Duration(time.Second)},
+		{requested: Duration(10 * time.Second),
+			expected: Duration(10 * time.Second)},
+		{requested: Duration(time.Hour), expected: Duration(time.Minute)},
+	}
+	for _, row := range table {
+		if clamped := b.clamp(row.requested); clamped != row.expected {
+			t.Fatalf("expected: %v, got: %v; %v", row.expected, clamped, row)
+		}
+	}
+}
+
+// TestHandleRegisterTTL tests granting services the TTL and keep durations they
+// request within the server bounds.
+func TestHandleRegisterTTL(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := NewServer(64646, NullAuthenticator,
+		NewRandomRegistry(time.Minute, time.Hour), firstBalancer{})
+	defer server.Shutdown(context.Background())
+	clock := NewFakeClock(time.Now())
+	server.SetClock(clock)
+	server.SetTTLBounds(10*time.Second, time.Hour)
+	server.SetKeepBounds(time.Minute, 2*time.Hour)
+	table := []struct {
+		body         string
+		expectedTTL  time.Duration
+		expectedKeep time.Duration
+	}{
+		{body: `{"name":"service1","host":"host1"}`,
+			expectedTTL: time.Minute, expectedKeep: time.Hour},
+		{body: `{"name":"service1","host":"host2","ttl":"20s","keep":"30s"}`,
+			expectedTTL: 20 * time.Second, expectedKeep: time.Minute},
+		{body: `{"name":"service1","host":"host3","ttl":"1s","keep":"3h"}`,
+			expectedTTL: 10 * time.Second, expectedKeep: 2 * time.Hour},
+		{body: `{"name":"service1","host":"host4","ttl":"3h","keep":"1h"}`,
+			expectedTTL: time.Hour, expectedKeep: time.Hour},
+		{body: `{"name":"service1","host":"host5","ttl":"10m","keep":"2m"}`,
+			expectedTTL: 10 * time.Minute, expectedKeep: 10 * time.Minute},
+	}
+	for _, row := range table {
+		req, err := http.NewRequest("POST", "/register",
+			bytes.NewBufferString(row.body))
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.handleRegister).ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v; %v", http.StatusOK, status, row)
+		}
+		granted := Service{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &granted); err != nil {
+			t.Fatalf("failed to read register response: %v", err)
+		}
+		if time.Duration(granted.TTL) != row.expectedTTL ||
+			time.Duration(granted.Keep) != row.expectedKeep {
+			t.Fatalf("expected: %v, got: %v", row, granted)
+		}
+	}
+	clock.Advance(30 * time.Second)
+	active := server.registry.Active(Filter{Name: "service1"})
+	if hosts := fmt.Sprint(hostsOf(active)); hosts != "[host1 host4 host5]" {
+		t.Fatalf("expected host1, host4 and host5 to be active, got: %v",
+			active)
+	}
+	// a keep shorter than the TTL must not remove an active service
+	clock.Advance(5 * time.Minute)
+	active = server.registry.Active(Filter{Name: "service1"})
+	if hosts := fmt.Sprint(hostsOf(active)); hosts != "[host4 host5]" {
+		t.Fatalf("expected host4 and host5 to be active, got: %v", active)
+	}
+}
+
+// TestServerExpire tests forgetting the state kept for services the registry
+// removes.
+func TestServerExpire(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := NewServer(64646, NullAuthenticator,
+		NewRandomRegistry(10*time.Millisecond, 20*time.Millisecond),
+		firstBalancer{})
+	defer server.Shutdown(context.Background())
+	service := Service{Name: "service1", Host: "host1"}
+	server.registry.Add(service)
+	server.observe(service)
+	server.outliers.report(service)
+	waitFor(t, func() bool {
+		return len(server.registry.List("service1")) == 0
+	})
+	waitFor(t, func() bool {
+		server.outliers.mutex.Lock()
+		defer server.outliers.mutex.Unlock()
+		server.flaps.mutex.Lock()
+		defer server.flaps.mutex.Unlock()
+		return len(server.outliers.outliers) == 0 &&
+			len(server.flaps.states) == 0
+	})
+}
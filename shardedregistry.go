@@ -0,0 +1,389 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultShards is the number of shards used by NewShardedRegistry.
+const defaultShards = 32
+
+// replicas holds the replicants of a single service name in registration order
+// indexed by host.
+type replicas struct {
+	index    map[string]int
+	services []Service
+}
+
+// remove removes the replicant with the host, returning false if there is none.
+func (r *replicas) remove(host string) bool {
+	idx, ok := r.index[host]
+	if !ok {
+		return false
+	}
+	r.services = append(r.services[:idx], r.services[idx+1:]...)
+	delete(r.index, host)
+	for i := idx; i < len(r.services); i++ {
+		r.index[r.services[i].Host] = i
+	}
+	return true
+}
+
+// shard holds the services of the names hashed to it. Each shard has its own
+// reaper so that scheduling deadlines does not contend across shards.
+type shard struct {
+	names  map[string]*replicas
+	reaper *reaper
+	mutex  *sync.RWMutex
+}
+
+// put adds or replaces a service in the shard. If renew is true a replaced
+// service keeps its Drain.
+func (s *shard) put(service Service, renew bool) {
+	set, ok := s.names[service.Name]
+	if !ok {
+		set = &replicas{index: make(map[string]int)}
+		s.names[service.Name] = set
+	}
+	if idx, ok := set.index[service.Host]; ok {
+		if renew {
+			service.Drain = set.services[idx].Drain
+		}
+		set.services[idx] = service
+	} else {
+		set.index[service.Host] = len(set.services)
+		set.services = append(set.services, service)
+	}
+}
+
+// shardedRegistry implements Registry by keeping services in memory indexed by
+// name and host. Names are spread over shards that are locked independently so
+// that registrations and lookups of different services do not contend.
+type shardedRegistry struct {
+	shards    []*shard
+	policies  map[string]TrafficPolicy
+	timeout   time.Duration
+	keep      time.Duration
+	mutex     *sync.RWMutex
+	observers []func(expiry Expiry)
+	clock     Clock
+}
+
+// shardOf gets the shard holding services with the name.
+func (r *shardedRegistry) shardOf(name string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return r.shards[hash.Sum32()%uint32(len(r.shards))]
+}
+
+// settings gets the registry timeout and keep durations and clock.
+func (r *shardedRegistry) settings() (time.Duration, time.Duration, Clock) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.timeout, r.keep, r.clock
+}
+
+// schedule sets the deadlines at which the service in the shard expires and is
+// removed.
+func (s *shard) schedule(service Service, timeout, keep time.Duration) {
+	ttl, keep := service.lifetime(timeout, keep)
+	key := serviceKey(service)
+	s.reaper.schedule(key, service.Added.Add(ttl), false)
+	s.reaper.schedule(key, service.Added.Add(keep), true)
+}
+
+// scheduleAll sets the deadlines of every service after the registry timeout
+// or keep duration changes.
+func (r *shardedRegistry) scheduleAll() {
+	timeout, keep, _ := r.settings()
+	for _, s := range r.shards {
+		s.mutex.RLock()
+		for _, replicas := range s.names {
+			for _, service := range replicas.services {
+				s.schedule(service, timeout, keep)
+			}
+		}
+		s.mutex.RUnlock()
+	}
+}
+
+// reap raises an expiry event for the service with the key if its deadline has
+// passed, removing the service if remove is true.
+func (r *shardedRegistry) reap(key string, remove bool) {
+	name, host := parseServiceKey(key)
+	timeout, keep, clock := r.settings()
+	now := clock.Now()
+	s := r.shardOf(name)
+	s.mutex.Lock()
+	replicas, ok := s.names[name]
+	if !ok {
+		s.mutex.Unlock()
+		return
+	}
+	idx, ok := replicas.index[host]
+	if !ok {
+		s.mutex.Unlock()
+		return
+	}
+	service := replicas.services[idx]
+	ttl, keepFor := service.lifetime(timeout, keep)
+	age := now.Sub(service.Added)
+	if (!remove && age < ttl) || (remove && age < keepFor) {
+		s.mutex.Unlock()
+		return
+	}
+	if remove {
+		replicas.remove(host)
+		if len(replicas.services) == 0 {
+			delete(s.names, name)
+		}
+		s.reaper.cancel(key)
+	}
+	s.mutex.Unlock()
+	expiry := Expiry{Service: deriveStatus(service, timeout, keep, now),
+		Removed: remove}
+	r.mutex.RLock()
+	observers := r.observers
+	r.mutex.RUnlock()
+	for _, observer := range observers {
+		observer(expiry)
+	}
+}
+
+// collect appends the services of the replicas matching the filter at the
+// specified time. Optionally includes inactive services if inactive is true.
+func collect(services []Service, replicas *replicas, filter Filter,
+	inactive bool, timeout, keep time.Duration, now time.Time) []Service {
+	for _, service := range replicas.services {
+		_, keepFor := service.lifetime(timeout, keep)
+		if now.Sub(service.Added) > keepFor {
+			continue
+		}
+		service = deriveStatus(service, timeout, keep, now)
+		if filter.Matches(service) && (inactive || service.Status.Active()) {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// getAll gets all active services matching the filter. Optionally includes
+// inactive services if inactive is true. A filter by name reads a single shard;
+// otherwise services are returned ordered by name.
+func (r *shardedRegistry) getAll(filter Filter, inactive bool) []Service {
+	timeout, keep, clock := r.settings()
+	now := clock.Now()
+	var services []Service
+	if filter.Name != "" {
+		s := r.shardOf(filter.Name)
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		if replicas, ok := s.names[filter.Name]; ok {
+			services = collect(services, replicas, filter, inactive, timeout,
+				keep, now)
+		}
+		return services
+	}
+	for _, s := range r.shards {
+		s.mutex.RLock()
+		for _, replicas := range s.names {
+			services = collect(services, replicas, filter, inactive, timeout,
+				keep, now)
+		}
+		s.mutex.RUnlock()
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+func (r *shardedRegistry) Add(service Service) {
+	timeout, keep, clock := r.settings()
+	s := r.shardOf(service.Name)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	service.Added = clock.Now()
+	s.put(service, true)
+	s.schedule(service, timeout, keep)
+}
+
+func (r *shardedRegistry) Restore(service Service) {
+	timeout, keep, _ := r.settings()
+	s := r.shardOf(service.Name)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.put(service, false)
+	s.schedule(service, timeout, keep)
+}
+
+func (r *shardedRegistry) Records() []Service {
+	timeout, keep, _ := r.settings()
+	var services []Service
+	for _, s := range r.shards {
+		s.mutex.RLock()
+		for _, replicas := range s.names {
+			for _, service := range replicas.services {
+				ttl, keepFor := service.lifetime(timeout, keep)
+				service.TTL, service.Keep = Duration(ttl), Duration(keepFor)
+				services = append(services, service)
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+func (r *shardedRegistry) Remove(service Service) {
+	s := r.shardOf(service.Name)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if replicas, ok := s.names[service.Name]; ok &&
+		replicas.remove(service.Host) && len(replicas.services) == 0 {
+		delete(s.names, service.Name)
+	}
+	s.reaper.cancel(serviceKey(service))
+}
+
+func (r *shardedRegistry) Drain(service Service, drain bool) error {
+	s := r.shardOf(service.Name)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if replicas, ok := s.names[service.Name]; ok {
+		if idx, ok := replicas.index[service.Host]; ok {
+			replicas.services[idx].Drain = drain
+			return nil
+		}
+	}
+	return fmt.Errorf("no such service '%s' on '%s'", service.Name,
+		service.Host)
+}
+
+func (r *shardedRegistry) Active(filter Filter) []Service {
+	return r.getAll(filter, false)
+}
+
+func (r *shardedRegistry) List(name string) []Service {
+	return r.ListMatching(Filter{Name: name})
+}
+
+func (r *shardedRegistry) ListMatching(filter Filter) []Service {
+	return r.getAll(filter, true)
+}
+
+func (r *shardedRegistry) SetPolicy(policy TrafficPolicy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.policies[policy.Name] = policy
+}
+
+func (r *shardedRegistry) RemovePolicy(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.policies, name)
+}
+
+func (r *shardedRegistry) Policies(name string) []TrafficPolicy {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var policies []TrafficPolicy
+	for _, policy := range r.policies {
+		if name == "" || name == policy.Name {
+			policies = append(policies, policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+	return policies
+}
+
+func (r *shardedRegistry) SetTimeout(timeout time.Duration) {
+	r.mutex.Lock()
+	r.timeout = timeout
+	r.mutex.Unlock()
+	r.scheduleAll()
+}
+
+func (r *shardedRegistry) SetKeep(keep time.Duration) {
+	r.mutex.Lock()
+	r.keep = keep
+	r.mutex.Unlock()
+	r.scheduleAll()
+}
+
+func (r *shardedRegistry) OnExpire(observer func(expiry Expiry)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.observers = append(r.observers, observer)
+}
+
+func (r *shardedRegistry) SetClock(clock Clock) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock = clock
+	for _, s := range r.shards {
+		s.reaper.setClock(clock)
+	}
+}
+
+func (r *shardedRegistry) Stop() {
+	for _, s := range r.shards {
+		s.reaper.stop()
+	}
+}
+
+// NewShardedRegistry creates an in-memory Registry indexed by service name and
+// host with independently locked shards. It behaves like the registry created
+// by NewRandomRegistry but scales to large fleets.
+func NewShardedRegistry(timeout time.Duration, keep time.Duration) Registry {
+	registry := &shardedRegistry{
+		shards:   make([]*shard, defaultShards),
+		policies: make(map[string]TrafficPolicy),
+		timeout:  timeout,
+		keep:     keep,
+		mutex:    &sync.RWMutex{},
+		clock:    SystemClock,
+	}
+	for i := range registry.shards {
+		registry.shards[i] = &shard{
+			names:  make(map[string]*replicas),
+			reaper: newReaper(registry.reap),
+			mutex:  &sync.RWMutex{},
+		}
+	}
+	return registry
+}
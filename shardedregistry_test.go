@@ -0,0 +1,224 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// TestShardedRegistry tests adding, renewing, draining and removing services.
+func TestShardedRegistry(t *testing.T) {
+	registry := NewShardedRegistry(time.Hour, 2*time.Hour)
+	defer registry.Stop()
+	for i := 1; i <= 3; i++ {
+		for j := 1; j <= 3; j++ {
+			registry.Add(Service{Name: fmt.Sprintf("service%d", i),
+				Host: fmt.Sprintf("host%d", j)})
+		}
+	}
+	registry.Add(Service{Name: "service2", Host: "host1",
+		Tags: []string{"canary"}})
+	if err := registry.Drain(Service{Name: "service2", Host: "host2"},
+		true); err != nil {
+		t.Fatalf("failed to drain service: %v", err)
+	}
+	if err := registry.Drain(Service{Name: "service2", Host: "hostX"},
+		true); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	registry.Remove(Service{Name: "service3", Host: "host2"})
+	registry.Remove(Service{Name: "serviceX", Host: "host1"})
+	table := []struct {
+		filter        Filter
+		inactive      bool
+		expectedHosts []string
+	}{
+		{filter: Filter{Name: "service1"},
+			expectedHosts: []string{"host1", "host2", "host3"}},
+		{filter: Filter{Name: "service2"},
+			expectedHosts: []string{"host1", "host3"}},
+		{filter: Filter{Name: "service2"}, inactive: true,
+			expectedHosts: []string{"host1", "host2", "host3"}},
+		{filter: Filter{Name: "service3"},
+			expectedHosts: []string{"host1", "host3"}},
+		{filter: Filter{Tags: []string{"canary"}},
+			expectedHosts: []string{"host1"}},
+		{filter: Filter{Name: "serviceX"}},
+	}
+	for _, row := range table {
+		services := registry.Active(row.filter)
+		if row.inactive {
+			services = registry.ListMatching(row.filter)
+		}
+		if len(services) != len(row.expectedHosts) {
+			t.Fatalf("expected: %v, got: %v", row.expectedHosts, services)
+		}
+		for i, service := range services {
+			if service.Host != row.expectedHosts[i] {
+				t.Fatalf("expected: %v, got: %v", row.expectedHosts, services)
+			}
+		}
+	}
+	services := registry.List("")
+	if len(services) != 8 {
+		t.Fatalf("expected: 8 services, got: %v", services)
+	}
+	for i := 1; i < len(services); i++ {
+		if services[i-1].Name > services[i].Name {
+			t.Fatalf("expected services ordered by name, got: %v", services)
+		}
+	}
+}
+
+// TestShardedRegistryExpire tests expiring and removing services from a
+// sharded registry.
+func TestShardedRegistryExpire(t *testing.T) {
+	registry := NewShardedRegistry(time.Hour, 2*time.Hour)
+	defer registry.Stop()
+	events := make(chan Expiry, 10)
+	registry.OnExpire(func(expiry Expiry) {
+		events <- expiry
+	})
+	registry.Add(Service{Name: "service1", Host: "host1"})
+	registry.Add(Service{Name: "service1", Host: "host2",
+		TTL: Duration(time.Minute)})
+	registry.SetTimeout(10 * time.Millisecond)
+	registry.SetKeep(30 * time.Millisecond)
+	expected := []bool{false, true}
+	for _, removed := range expected {
+		select {
+		case expiry := <-events:
+			if expiry.Removed != removed || expiry.Service.Host != "host1" {
+				t.Fatalf("expected removed: %t for host1, got: %v", removed,
+					expiry)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected expiry event, removed: %t", removed)
+		}
+	}
+	services := registry.List("service1")
+	if len(services) != 1 || services[0].Host != "host2" {
+		t.Fatalf("expected only the service with a TTL of 1m to be kept, "+
+			"got: %v", services)
+	}
+}
+
+// TestShardedRegistryRestore tests restoring services into a sharded
+// registry.
+func TestShardedRegistryRestore(t *testing.T) {
+	registry := NewShardedRegistry(time.Minute, time.Hour)
+	defer registry.Stop()
+	testRestore(t, registry)
+}
+
+// benchmarkRegistries runs the benchmark against each in-memory registry
+// holding fleets of increasing size. Each service has ten replicants.
+func benchmarkRegistries(b *testing.B,
+	benchmark func(b *testing.B, registry Registry, services []Service)) {
+	registries := []struct {
+		name   string
+		create func(timeout, keep time.Duration) Registry
+	}{
+		{"random", NewRandomRegistry},
+		{"sharded", NewShardedRegistry},
+	}
+	for _, size := range []int{100, 1000, 5000} {
+		services := make([]Service, size)
+		for i := range services {
+			services[i] = Service{Name: fmt.Sprintf("service%d", i/10),
+				Host: fmt.Sprintf("host%d", i%10)}
+		}
+		for _, r := range registries {
+			b.Run(fmt.Sprintf("%s/%d", r.name, size), func(b *testing.B) {
+				registry := r.create(time.Hour, 2*time.Hour)
+				defer registry.Stop()
+				for _, service := range services {
+					registry.Add(service)
+				}
+				b.ResetTimer()
+				benchmark(b, registry, services)
+			})
+		}
+	}
+}
+
+// BenchmarkRegistryAdd benchmarks renewing registrations.
+func BenchmarkRegistryAdd(b *testing.B) {
+	benchmarkRegistries(b, func(b *testing.B, registry Registry,
+		services []Service) {
+		for i := 0; i < b.N; i++ {
+			registry.Add(services[rand.Intn(len(services))])
+		}
+	})
+}
+
+// BenchmarkRegistryActive benchmarks looking up the replicants of a service.
+func BenchmarkRegistryActive(b *testing.B) {
+	benchmarkRegistries(b, func(b *testing.B, registry Registry,
+		services []Service) {
+		for i := 0; i < b.N; i++ {
+			registry.Active(Filter{
+				Name: services[rand.Intn(len(services))].Name})
+		}
+	})
+}
+
+// BenchmarkRegistryParallel benchmarks concurrent lookups with one renewal for
+// every nine lookups.
+func BenchmarkRegistryParallel(b *testing.B) {
+	benchmarkRegistries(b, func(b *testing.B, registry Registry,
+		services []Service) {
+		b.RunParallel(func(pb *testing.PB) {
+			random := rand.New(rand.NewSource(time.Now().UnixNano()))
+			for i := 0; pb.Next(); i++ {
+				service := services[random.Intn(len(services))]
+				if i%10 == 0 {
+					registry.Add(service)
+				} else {
+					registry.Active(Filter{Name: service.Name})
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkRegistryParallelAdd benchmarks concurrent renewals.
+func BenchmarkRegistryParallelAdd(b *testing.B) {
+	benchmarkRegistries(b, func(b *testing.B, registry Registry,
+		services []Service) {
+		b.RunParallel(func(pb *testing.PB) {
+			random := rand.New(rand.NewSource(time.Now().UnixNano()))
+			for pb.Next() {
+				registry.Add(services[random.Intn(len(services))])
+			}
+		})
+	})
+}
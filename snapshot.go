@@ -0,0 +1,348 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// snapshotFile is the name of the snapshot file within the data directory.
+const snapshotFile = "registry.snapshot"
+
+// snapshot is the state of a registry written to disk.
+type snapshot struct {
+	Taken    time.Time       `json:"taken"`
+	Services []Service       `json:"services"`
+	Policies []TrafficPolicy `json:"policies"`
+	index    map[string]int  // index locates services by key during replay.
+}
+
+// apply updates the snapshot with a mutation from the write-ahead log. The
+// snapshot is taken as of the time of the mutation.
+func (snap *snapshot) apply(record walRecord) {
+	if record.At.After(snap.Taken) {
+		snap.Taken = record.At
+	}
+	switch record.Op {
+	case walAdd, walRemove, walDrain, walUndrain:
+		if record.Service != nil {
+			snap.applyService(record.Op, *record.Service, record.At)
+		}
+	case walSetPolicy, walRemovePolicy:
+		if record.Policy != nil {
+			snap.applyPolicy(record.Op, *record.Policy)
+		}
+	}
+}
+
+// applyService adds, removes or drains a service of the snapshot the way the
+// registry did when the mutation was recorded.
+func (snap *snapshot) applyService(op walOp, service Service, at time.Time) {
+	if snap.index == nil {
+		snap.index = make(map[string]int)
+		for i, existing := range snap.Services {
+			snap.index[serviceKey(existing)] = i
+		}
+	}
+	key := serviceKey(service)
+	idx, ok := snap.index[key]
+	switch {
+	case op == walAdd && ok:
+		service.Added, service.Drain = at, snap.Services[idx].Drain
+		snap.Services[idx] = service
+	case op == walAdd:
+		service.Added = at
+		snap.index[key] = len(snap.Services)
+		snap.Services = append(snap.Services, service)
+	case op == walRemove && ok:
+		last := len(snap.Services) - 1
+		snap.Services[idx] = snap.Services[last]
+		snap.index[serviceKey(snap.Services[idx])] = idx
+		snap.Services = snap.Services[:last]
+		delete(snap.index, key)
+	case ok:
+		snap.Services[idx].Drain = op == walDrain
+	}
+}
+
+// applyPolicy sets or removes a traffic policy of the snapshot.
+func (snap *snapshot) applyPolicy(op walOp, policy TrafficPolicy) {
+	for i, existing := range snap.Policies {
+		if existing.Name == policy.Name {
+			snap.Policies = append(snap.Policies[:i], snap.Policies[i+1:]...)
+			break
+		}
+	}
+	if op == walSetPolicy {
+		snap.Policies = append(snap.Policies, policy)
+	}
+}
+
+// Snapshotter writes the services and traffic policies of a registry to a file
+// in a data directory and restores them when a server starts. Changes made
+// between snapshots are appended to a write-ahead log in the same directory,
+// which is replayed over the snapshot on restore and emptied by each snapshot.
+type Snapshotter struct {
+	registry Registry
+	dir      string
+	clock    Clock
+	mutex    *sync.Mutex
+	running  bool
+	done     chan struct{}
+	stopped  chan struct{}
+	wal      *writeAheadLog
+	walMutex *sync.Mutex
+}
+
+// path gets the path of the snapshot file.
+func (s *Snapshotter) path() string {
+	return filepath.Join(s.dir, snapshotFile)
+}
+
+// SetClock sets the clock snapshots are timed by.
+func (s *Snapshotter) SetClock(clock Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clock = clock
+}
+
+// getClock thread-safe way of getting the clock of this snapshotter.
+func (s *Snapshotter) getClock() Clock {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.clock
+}
+
+// append records a registry mutation in the write-ahead log, returning once
+// it is synced to disk.
+func (s *Snapshotter) append(record walRecord) error {
+	record.At = s.getClock().Now()
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		log.Printf("failed to write ahead: %s\n", err.Error())
+		return err
+	}
+	if err := s.wal.append(record); err != nil {
+		log.Printf("failed to write ahead: %s\n", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Save writes a snapshot of the registry and compacts the write-ahead log. The
+// snapshot is written to a temporary file that replaces the previous snapshot
+// once it is complete, so a crash while saving leaves the previous snapshot
+// and the log intact.
+func (s *Snapshotter) Save() error {
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	raw, err := json.Marshal(snapshot{
+		Taken:    s.getClock().Now(),
+		Services: s.registry.Records(),
+		Policies: s.registry.Policies(""),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(), raw); err != nil {
+		return err
+	}
+	return s.wal.compact()
+}
+
+// writeFileAtomic writes data to a temporary file that replaces the file at
+// the path once it is synced to disk, so a crash while writing leaves the
+// previous file intact.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	file, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory to disk so that a file renamed into it persists.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// load reads the latest snapshot and replays the write-ahead log over it.
+func (s *Snapshotter) load() (snapshot, error) {
+	snap := snapshot{}
+	raw, err := ioutil.ReadFile(s.path())
+	if err != nil && !os.IsNotExist(err) {
+		return snap, err
+	} else if err == nil {
+		if err := json.Unmarshal(raw, &snap); err != nil {
+			return snap, err
+		}
+	}
+	return snap, s.wal.replay(snap.apply)
+}
+
+// Restore reads the latest snapshot and the changes logged since into the
+// registry, returning the number of services restored. Services that had not
+// expired by the last change are kept active for at least the grace period so
+// that they have time to renew with the restarted server. A missing snapshot
+// and log restore nothing.
+func (s *Snapshotter) Restore(grace time.Duration) (int, error) {
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	snap, err := s.load()
+	if err != nil {
+		return 0, err
+	}
+	for _, policy := range snap.Policies {
+		s.registry.SetPolicy(policy)
+	}
+	restored := make(map[string]bool)
+	for _, service := range snap.Services {
+		s.registry.Restore(service)
+		restored[serviceKey(service)] = true
+	}
+	// the registry fills in the TTL of services logged without one
+	now := s.getClock().Now()
+	for _, service := range s.registry.Records() {
+		if restored[serviceKey(service)] {
+			s.registry.Restore(restoreWithGrace(service, snap.Taken, now,
+				grace))
+		}
+	}
+	return len(snap.Services), nil
+}
+
+// restoreWithGrace gets a service restored at the specified time from a
+// snapshot taken at the specified time. If the service had not expired when the
+// snapshot was taken its Added time is moved forward so that it does not expire
+// until the grace period has passed.
+func restoreWithGrace(service Service, taken, now time.Time,
+	grace time.Duration) Service {
+	ttl := time.Duration(service.TTL)
+	if taken.Sub(service.Added) >= ttl {
+		return service
+	}
+	if earliest := now.Add(grace - ttl); service.Added.Before(earliest) {
+		service.Added = earliest
+	}
+	return service
+}
+
+// Start saves a snapshot on the interval until the snapshotter is stopped.
+func (s *Snapshotter) Start(interval time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.running {
+		return
+	}
+	s.running = true
+	s.done = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.run(interval, s.done, s.stopped)
+}
+
+// run saves snapshots on the interval until done is closed.
+func (s *Snapshotter) run(interval time.Duration, done,
+	stopped chan struct{}) {
+	defer close(stopped)
+	for {
+		select {
+		case <-s.getClock().After(interval):
+			if err := s.Save(); err != nil {
+				log.Printf("failed to save snapshot: %s\n", err.Error())
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Stop stops saving snapshots on an interval, saves a final snapshot and
+// closes the write-ahead log.
+func (s *Snapshotter) Stop() error {
+	s.mutex.Lock()
+	if s.running {
+		s.running = false
+		close(s.done)
+		stopped := s.stopped
+		s.mutex.Unlock()
+		<-stopped
+	} else {
+		s.mutex.Unlock()
+	}
+	err := s.Save()
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	if cerr := s.wal.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// NewSnapshotter returns a snapshotter that saves the registry to a snapshot
+// file and write-ahead log in the data directory.
+func NewSnapshotter(registry Registry, dir string) *Snapshotter {
+	return &Snapshotter{
+		registry: registry,
+		dir:      dir,
+		clock:    SystemClock,
+		mutex:    &sync.Mutex{},
+		wal:      newWriteAheadLog(filepath.Join(dir, walFile)),
+		walMutex: &sync.Mutex{},
+	}
+}
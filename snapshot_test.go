@@ -0,0 +1,375 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempDir creates a temporary data directory for a test.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatalf("failed to create data directory: %v", err)
+	}
+	return dir
+}
+
+// TestRestoreWithGrace tests extending the registrations of restored services.
+func TestRestoreWithGrace(t *testing.T) {
+	taken := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := taken.Add(time.Hour)
+	table := []struct {
+		added    time.Time
+		ttl      time.Duration
+		expected time.Time
+	}{
+		{added: taken.Add(-time.Second), ttl: time.Minute,
+			expected: now.Add(-30 * time.Second)},
+		{added: taken.Add(-time.Minute), ttl: time.Minute,
+			expected: taken.Add(-time.Minute)},
+		{added: taken.Add(-time.Second), ttl: 2 * time.Hour,
+			expected: taken.Add(-time.Second)},
+		{added: taken.Add(-time.Second), ttl: 20 * time.Second,
+			expected: now.Add(10 * time.Second)},
+	}
+	for i, row := range table {
+		service := restoreWithGrace(Service{Added: row.added,
+			TTL: Duration(row.ttl)}, taken, now, 30*time.Second)
+		if !service.Added.Equal(row.expected) {
+			t.Fatalf("expected added: %v, got: %v; row %d", row.expected,
+				service.Added, i)
+		}
+	}
+}
+
+// TestSnapshotter tests saving a registry and restoring it into another.
+func TestSnapshotter(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	clock := NewFakeClock(time.Now())
+	registry := NewRandomRegistry(time.Minute, time.Hour)
+	registry.SetClock(clock)
+	defer registry.Stop()
+	registry.Add(Service{Name: "service1", Host: "host1",
+		Tags: []string{"canary"}})
+	registry.Add(Service{Name: "service1", Host: "host2"})
+	registry.Drain(Service{Name: "service1", Host: "host2"}, true)
+	registry.SetPolicy(TrafficPolicy{Name: "service1",
+		Splits: []Split{{Tag: "canary", Weight: 1}}})
+	snapshotter := NewSnapshotter(registry, dir)
+	snapshotter.SetClock(clock)
+	if count, err := snapshotter.Restore(time.Minute); err != nil ||
+		count != 0 {
+		t.Fatalf("expected nothing restored, got: %d, %v", count, err)
+	}
+	if err := snapshotter.Save(); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+	clock.Advance(5 * time.Minute)
+	restored := NewRandomRegistry(time.Minute, time.Hour)
+	restored.SetClock(clock)
+	defer restored.Stop()
+	snapshotter = NewSnapshotter(restored, dir)
+	snapshotter.SetClock(clock)
+	count, err := snapshotter.Restore(30 * time.Second)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 services restored, got: %d, %v", count, err)
+	}
+	services := restored.Active(Filter{Name: "service1"})
+	if len(services) != 1 || services[0].Host != "host1" ||
+		len(services[0].Tags) != 1 {
+		t.Fatalf("expected canary host1 active, got: %v", services)
+	}
+	if services := restored.List("service1"); len(services) != 2 ||
+		!services[1].Drain {
+		t.Fatalf("expected draining host2 listed, got: %v", services)
+	}
+	if policies := restored.Policies("service1"); len(policies) != 1 {
+		t.Fatalf("expected policy restored, got: %v", policies)
+	}
+	clock.Advance(30 * time.Second)
+	if services := restored.Active(Filter{Name: "service1"}); len(services) != 0 {
+		t.Fatalf("expected grace period over, got: %v", services)
+	}
+}
+
+// TestSnapshotterStart tests saving snapshots on an interval and on stop.
+func TestSnapshotterStart(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	clock := NewFakeClock(time.Now())
+	registry := NewRandomRegistry(time.Minute, time.Hour)
+	defer registry.Stop()
+	snapshotter := NewSnapshotter(registry, dir)
+	snapshotter.SetClock(clock)
+	snapshotter.Start(time.Minute)
+	snapshotter.Start(time.Minute)
+	path := filepath.Join(dir, snapshotFile)
+	advanceUntil(t, clock, time.Minute, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove snapshot: %v", err)
+	}
+	if err := snapshotter.Stop(); err != nil {
+		t.Fatalf("failed to stop snapshotter: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected final snapshot, got: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("expected only the snapshot file, got: %d files", len(files))
+	}
+}
+
+// TestServerSnapshots tests restoring registrations across server restarts.
+func TestServerSnapshots(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	server := NewRandomServer(64646, NullAuthenticator)
+	if _, err := server.EnableSnapshots(dir, time.Hour, time.Minute); err != nil {
+		t.Fatalf("failed to enable snapshots: %v", err)
+	}
+	if _, err := server.EnableSnapshots(dir, time.Hour, time.Minute); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	server.registry.Add(Service{Name: "service1", Host: "host1"})
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down server: %v", err)
+	}
+	server = NewRandomServer(64646, NullAuthenticator)
+	defer server.Shutdown(context.Background())
+	count, err := server.EnableSnapshots(dir, time.Hour, time.Minute)
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 service restored, got: %d, %v", count, err)
+	}
+	if services := server.registry.Active(Filter{}); len(services) != 1 {
+		t.Fatalf("expected restored service active, got: %v", services)
+	}
+}
+
+// TestSnapshotterCorrupt tests restoring from an unreadable snapshot.
+func TestSnapshotterCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	err := ioutil.WriteFile(filepath.Join(dir, snapshotFile), []byte("{"),
+		0600)
+	if err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	registry := NewRandomRegistry(time.Minute, time.Hour)
+	defer registry.Stop()
+	if _, err := NewSnapshotter(registry, dir).Restore(0); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+// TestSnapshotApply tests replaying logged mutations over a snapshot.
+func TestSnapshotApply(t *testing.T) {
+	taken := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := taken.Add(time.Minute)
+	snap := snapshot{Taken: taken, Services: []Service{
+		{Name: "service1", Host: "host1", Added: taken, Drain: true},
+		{Name: "service1", Host: "host2", Added: taken},
+		{Name: "service1", Host: "host3", Added: taken},
+	}, Policies: []TrafficPolicy{{Name: "service1"}}}
+	records := []walRecord{
+		{Op: walAdd, Service: &Service{Name: "service1", Host: "host1",
+			Tags: []string{"canary"}}},
+		{Op: walRemove, Service: &Service{Name: "service1", Host: "host2"}},
+		{Op: walAdd, Service: &Service{Name: "service2", Host: "host1"}},
+		{Op: walDrain, Service: &Service{Name: "service2", Host: "host1"}},
+		{Op: walUndrain, Service: &Service{Name: "service1", Host: "host1"}},
+		{Op: walDrain, Service: &Service{Name: "serviceX", Host: "host1"}},
+		{Op: walRemovePolicy, Policy: &TrafficPolicy{Name: "service1"}},
+		{Op: walSetPolicy, Policy: &TrafficPolicy{Name: "service2"}},
+	}
+	for _, record := range records {
+		record.At = at
+		snap.apply(record)
+	}
+	table := []struct {
+		host     string
+		name     string
+		added    time.Time
+		drain    bool
+		tags     int
+		expected bool
+	}{
+		{name: "service1", host: "host1", added: at, tags: 1, expected: true},
+		{name: "service1", host: "host2"},
+		{name: "service1", host: "host3", added: taken, expected: true},
+		{name: "service2", host: "host1", added: at, drain: true,
+			expected: true},
+		{name: "serviceX", host: "host1"},
+	}
+	services := make(map[string]Service)
+	for _, service := range snap.Services {
+		services[serviceKey(service)] = service
+	}
+	for _, row := range table {
+		service, ok := services[serviceKey(Service{Name: row.name,
+			Host: row.host})]
+		if ok != row.expected || (ok && (!service.Added.Equal(row.added) ||
+			service.Drain != row.drain || len(service.Tags) != row.tags)) {
+			t.Fatalf("expected %s at %s present: %t, got: %v", row.name,
+				row.host, row.expected, service)
+		}
+	}
+	if len(snap.Services) != 3 || !snap.Taken.Equal(at) {
+		t.Fatalf("expected 3 services taken at %v, got: %v", at, snap)
+	}
+	if len(snap.Policies) != 1 || snap.Policies[0].Name != "service2" {
+		t.Fatalf("expected policy for service2, got: %v", snap.Policies)
+	}
+}
+
+// TestServerWriteAhead tests restoring changes made after the last snapshot
+// when the server stops without saving one.
+func TestServerWriteAhead(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	server := NewRandomServer(64646, NullAuthenticator)
+	defer server.registry.Stop()
+	if _, err := server.EnableSnapshots(dir, time.Hour, time.Minute); err != nil {
+		t.Fatalf("failed to enable snapshots: %v", err)
+	}
+	requests := []struct {
+		handler http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{handler: server.handleRegister, method: "POST",
+			body: `{"name":"service1","host":"host1"}`},
+		{handler: server.handleRegister, method: "POST",
+			body: `{"name":"service1","host":"host2"}`},
+		{handler: server.handleRegister, method: "POST",
+			body: `{"name":"service2","host":"host1"}`},
+		{handler: server.handleDrain, method: "POST",
+			body: `{"name":"service1","host":"host2"}`},
+		{handler: server.handleDeregister, method: "DELETE",
+			body: `{"name":"service2","host":"host1"}`},
+		{handler: server.handlePolicy, method: "POST",
+			body: `{"name":"service1","splits":[{"tag":"x","weight":1}]}`},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, "/",
+			bytes.NewBufferString(request.body))
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		request.handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v; %v", http.StatusOK, rr.Code,
+				request)
+		}
+	}
+	restarted := NewRandomServer(64646, NullAuthenticator)
+	defer restarted.Shutdown(context.Background())
+	count, err := restarted.EnableSnapshots(dir, time.Hour, time.Minute)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 services restored, got: %d, %v", count, err)
+	}
+	services := restarted.registry.List("")
+	if len(services) != 2 || services[0].Drain || !services[1].Drain {
+		t.Fatalf("expected host1 and draining host2, got: %v", services)
+	}
+	if policies := restarted.registry.Policies(""); len(policies) != 1 {
+		t.Fatalf("expected policy restored, got: %v", policies)
+	}
+}
+
+// TestServerWriteAheadFailure tests refusing changes that cannot be written
+// to the write-ahead log.
+func TestServerWriteAheadFailure(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	server := NewRandomServer(64646, NullAuthenticator)
+	defer server.registry.Stop()
+	if _, err := server.EnableSnapshots(dir, time.Hour, time.Minute); err != nil {
+		t.Fatalf("failed to enable snapshots: %v", err)
+	}
+	// a directory in place of the log cannot be opened for writing
+	path := filepath.Join(dir, walFile)
+	os.Remove(path)
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	server.registry.Add(Service{Name: "service1", Host: "host1"})
+	requests := []struct {
+		handler http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{handler: server.handleRegister, method: "POST",
+			body: `{"name":"service2","host":"host1"}`},
+		{handler: server.handleDrain, method: "POST",
+			body: `{"name":"service1","host":"host1"}`},
+		{handler: server.handleDeregister, method: "DELETE",
+			body: `{"name":"service1","host":"host1"}`},
+		{handler: server.handlePolicy, method: "POST",
+			body: `{"name":"service1","splits":[{"tag":"x","weight":1}]}`},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, "/",
+			bytes.NewBufferString(request.body))
+		if err != nil {
+			t.Fatalf("failed to create mock request: %s", err.Error())
+		}
+		rr := httptest.NewRecorder()
+		request.handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected: %v, got: %v; %v",
+				http.StatusServiceUnavailable, rr.Code, request)
+		}
+	}
+	services := server.registry.List("")
+	if len(services) != 1 || services[0].Name != "service1" ||
+		services[0].Drain {
+		t.Fatalf("expected registry unchanged, got: %v", services)
+	}
+	if policies := server.registry.Policies(""); len(policies) != 0 {
+		t.Fatalf("expected no policies, got: %v", policies)
+	}
+}
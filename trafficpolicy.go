@@ -0,0 +1,110 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"errors"
+	"math/rand"
+)
+
+// TrafficPolicy splits the discovery traffic for a service name between
+// groups of replicants. For example a policy with splits of 5 to the canary
+// tag and 95 to the stable tag sends 5% of traffic to canary replicants.
+type TrafficPolicy struct {
+	Name   string  `json:"name"`
+	Splits []Split `json:"splits"`
+}
+
+// Split sends a share of traffic, relative to the other splits of a policy, to
+// the replicants carrying a tag.
+type Split struct {
+	Tag    string  `json:"tag"`
+	Weight float64 `json:"weight"`
+}
+
+// validate returns an error if the policy cannot be applied.
+func (policy TrafficPolicy) validate() error {
+	if policy.Name == "" {
+		return errors.New("policy requires a service name")
+	}
+	if len(policy.Splits) == 0 {
+		return errors.New("policy requires at least one split")
+	}
+	total := 0.0
+	for _, split := range policy.Splits {
+		if split.Tag == "" {
+			return errors.New("policy split requires a tag")
+		}
+		if split.Weight < 0 {
+			return errors.New("policy split weight must not be negative")
+		}
+		total += split.Weight
+	}
+	if total <= 0 {
+		return errors.New("policy requires a positive split weight")
+	}
+	return nil
+}
+
+// apply chooses a split at random by weight and gets the services in it. Splits
+// without replicants are skipped so their share goes to the remaining splits.
+// If no split has replicants all services are returned.
+func (policy TrafficPolicy) apply(services []Service) []Service {
+	groups := make([][]Service, len(policy.Splits))
+	total := 0.0
+	for i, split := range policy.Splits {
+		for _, service := range services {
+			if service.hasTag(split.Tag) {
+				groups[i] = append(groups[i], service)
+			}
+		}
+		if len(groups[i]) > 0 {
+			total += split.Weight
+		}
+	}
+	if total <= 0 {
+		return services
+	}
+	choice := rand.Float64() * total
+	for i, split := range policy.Splits {
+		if len(groups[i]) == 0 || split.Weight <= 0 {
+			continue
+		}
+		if choice < split.Weight {
+			return groups[i]
+		}
+		choice -= split.Weight
+	}
+	// floating point rounding can leave a sliver past the last split
+	for i := len(groups) - 1; i >= 0; i-- {
+		if len(groups[i]) > 0 && policy.Splits[i].Weight > 0 {
+			return groups[i]
+		}
+	}
+	return services
+}
@@ -0,0 +1,92 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"testing"
+)
+
+// TestTrafficPolicyValidate tests the TrafficPolicy.validate function.
+func TestTrafficPolicyValidate(t *testing.T) {
+	table := []struct {
+		policy      TrafficPolicy
+		expectedErr bool
+	}{
+		{policy: TrafficPolicy{Name: "service1", Splits: []Split{
+			{Tag: "canary", Weight: 5}, {Tag: "stable", Weight: 95}}}},
+		{policy: TrafficPolicy{Splits: []Split{{Tag: "canary", Weight: 5}}},
+			expectedErr: true},
+		{policy: TrafficPolicy{Name: "service1"}, expectedErr: true},
+		{policy: TrafficPolicy{Name: "service1", Splits: []Split{
+			{Weight: 5}}}, expectedErr: true},
+		{policy: TrafficPolicy{Name: "service1", Splits: []Split{
+			{Tag: "canary", Weight: -5}}}, expectedErr: true},
+		{policy: TrafficPolicy{Name: "service1", Splits: []Split{
+			{Tag: "canary"}}}, expectedErr: true},
+	}
+	for _, row := range table {
+		if err := row.policy.validate(); (err != nil) != row.expectedErr {
+			t.Fatalf("expected error: %t, got: %v; %v", row.expectedErr, err,
+				row)
+		}
+	}
+}
+
+// TestTrafficPolicyApply tests the TrafficPolicy.apply function.
+func TestTrafficPolicyApply(t *testing.T) {
+	services := generateTestServices(4)
+	services[0].Tags = []string{"canary"}
+	for i := 1; i < 4; i++ {
+		services[i].Tags = []string{"stable"}
+	}
+	policy := TrafficPolicy{Name: "service1", Splits: []Split{
+		{Tag: "canary", Weight: 10}, {Tag: "stable", Weight: 90}}}
+	canary := 0
+	for i := 0; i < 10000; i++ {
+		group := policy.apply(services)
+		if len(group) == 1 && group[0].Host == "host1" {
+			canary++
+		} else if len(group) != 3 {
+			t.Fatalf("unexpected group: %v", group)
+		}
+	}
+	if canary < 800 || canary > 1200 {
+		t.Fatalf("expected about 1000 canary selections, got: %d", canary)
+	}
+	// a split without replicants gives its share to the others
+	for i := 0; i < 100; i++ {
+		if group := policy.apply(services[1:]); len(group) != 3 {
+			t.Fatalf("expected stable group, got: %v", group)
+		}
+	}
+	// a policy with no matching replicants leaves services unchanged
+	untagged := generateTestServices(2)
+	if group := policy.apply(untagged); len(group) != 2 {
+		t.Fatalf("expected all services, got: %v", group)
+	}
+}
@@ -0,0 +1,234 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// walFile is the name of the write-ahead log within the data directory.
+const walFile = "registry.wal"
+
+// walHeader is the size of the length and checksum preceding each record.
+const walHeader = 8
+
+// walMaxRecord is the largest record read back. A larger length can only come
+// from a corrupt header.
+const walMaxRecord = 1 << 24
+
+// errTornRecord is returned reading a record that was not completely written.
+var errTornRecord = errors.New("torn write-ahead log record")
+
+// walOp is a registry mutation recorded in the write-ahead log.
+type walOp string
+
+// walAdd and the following constants are the mutations recorded.
+const (
+	walAdd          walOp = "add"
+	walRemove       walOp = "remove"
+	walDrain        walOp = "drain"
+	walUndrain      walOp = "undrain"
+	walSetPolicy    walOp = "set_policy"
+	walRemovePolicy walOp = "remove_policy"
+)
+
+// walRecord is a mutation applied to the registry at a point in time.
+type walRecord struct {
+	Op      walOp          `json:"op"`
+	At      time.Time      `json:"at"`
+	Service *Service       `json:"service,omitempty"`
+	Policy  *TrafficPolicy `json:"policy,omitempty"`
+}
+
+// valid returns true if the record is a known mutation with its subject.
+func (record walRecord) valid() bool {
+	switch record.Op {
+	case walSetPolicy, walRemovePolicy:
+		return record.Policy != nil
+	case walAdd, walRemove, walDrain, walUndrain:
+		return record.Service != nil
+	}
+	return false
+}
+
+// writeAheadLog appends registry mutations to a file so that changes made since
+// the latest snapshot survive a restart. Each record is framed by its length
+// and a CRC-32 checksum so that a record torn by a crash can be detected and
+// discarded.
+type writeAheadLog struct {
+	path string
+	file *os.File
+}
+
+// newWriteAheadLog returns a write-ahead log kept at the specified path. The
+// file is opened on the first append.
+func newWriteAheadLog(path string) *writeAheadLog {
+	return &writeAheadLog{path: path}
+}
+
+// append writes a record to the end of the log and syncs it to disk, so that
+// a change is durable before it is acknowledged.
+func (w *writeAheadLog) append(record walRecord) error {
+	if w.file == nil {
+		file, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE,
+			0600)
+		if err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(w.path)); err != nil {
+			file.Close()
+			return err
+		}
+		w.file = file
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(encodeFrame(payload)); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// encodeFrame frames a payload with its length and a CRC-32 checksum. Records
+// of the write-ahead log and of key/value stores are written as frames.
+func encodeFrame(payload []byte) []byte {
+	frame := make([]byte, walHeader+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	copy(frame[walHeader:], payload)
+	return frame
+}
+
+// readFrame reads the payload of the next frame. Returns io.EOF at the end of
+// the input and errTornRecord if the next frame is incomplete or corrupt.
+func readFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, walHeader)
+	if _, err := io.ReadFull(reader, header); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errTornRecord
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > walMaxRecord {
+		return nil, errTornRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errTornRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errTornRecord
+	}
+	return payload, nil
+}
+
+// readRecord reads the next record of the log. Returns io.EOF at the end of
+// the log and errTornRecord if the next record is incomplete or corrupt.
+func readRecord(reader io.Reader) (walRecord, int, error) {
+	record := walRecord{}
+	payload, err := readFrame(reader)
+	if err != nil {
+		return record, 0, err
+	}
+	if json.Unmarshal(payload, &record) != nil {
+		return record, 0, errTornRecord
+	}
+	return record, walHeader + len(payload), nil
+}
+
+// replay applies each record of the log in order. A torn record ends the log:
+// it and anything after it are truncated so that later appends follow the last
+// complete record. A missing log replays nothing.
+func (w *writeAheadLog) replay(apply func(walRecord)) error {
+	file, err := os.OpenFile(w.path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		record, n, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		} else if err == errTornRecord {
+			log.Printf("truncating torn write-ahead log at offset %d\n",
+				offset)
+			if err := file.Truncate(offset); err != nil {
+				return err
+			}
+			return file.Sync()
+		} else if err != nil {
+			return err
+		}
+		offset += int64(n)
+		apply(record)
+	}
+}
+
+// compact empties the log once its records are captured by a snapshot.
+func (w *writeAheadLog) compact() error {
+	if w.file == nil {
+		err := os.Truncate(w.path, 0)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// close flushes the log to disk and closes it.
+func (w *writeAheadLog) close() error {
+	if w.file == nil {
+		return nil
+	}
+	file := w.file
+	w.file = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
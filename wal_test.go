@@ -0,0 +1,152 @@
+// This is free and unencumbered software released into the public domain.
+
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <https://unlicense.org>
+
+// Package discovery implements a service registry for tracking the location of
+// distributed microservices.
+package discovery
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWriteAheadLog tests appending records and replaying them in order.
+func TestWriteAheadLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	wal := newWriteAheadLog(filepath.Join(dir, walFile))
+	if err := wal.replay(func(record walRecord) {
+		t.Fatalf("unexpected record: %v", record)
+	}); err != nil {
+		t.Fatalf("failed to replay missing log: %v", err)
+	}
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	expected := []walRecord{
+		{Op: walAdd, At: at, Service: &Service{Name: "service1",
+			Host: "host1"}},
+		{Op: walSetPolicy, At: at, Policy: &TrafficPolicy{Name: "service1"}},
+		{Op: walRemove, At: at.Add(time.Second), Service: &Service{
+			Name: "service1", Host: "host1"}},
+	}
+	for _, record := range expected {
+		if err := wal.append(record); err != nil {
+			t.Fatalf("failed to append record: %v", err)
+		}
+	}
+	var records []walRecord
+	if err := wal.replay(func(record walRecord) {
+		records = append(records, record)
+	}); err != nil {
+		t.Fatalf("failed to replay log: %v", err)
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got: %v", len(expected), records)
+	}
+	for i, record := range records {
+		if record.Op != expected[i].Op || !record.At.Equal(expected[i].At) {
+			t.Fatalf("expected: %v, got: %v; record %d", expected[i], record,
+				i)
+		}
+	}
+	if err := wal.compact(); err != nil {
+		t.Fatalf("failed to compact log: %v", err)
+	}
+	if err := wal.close(); err != nil {
+		t.Fatalf("failed to close log: %v", err)
+	}
+	if info, err := os.Stat(wal.path); err != nil || info.Size() != 0 {
+		t.Fatalf("expected empty log, got: %v, %v", info, err)
+	}
+}
+
+// TestWriteAheadLogTorn tests discarding a record torn by a crash.
+func TestWriteAheadLogTorn(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	table := []struct {
+		tear     func(raw []byte) []byte // tear damages the end of the log.
+		expected int                     // expected is the records kept.
+	}{
+		{tear: func(raw []byte) []byte { return raw[:len(raw)-1] },
+			expected: 1},
+		{tear: func(raw []byte) []byte { return raw[:len(raw)-20] },
+			expected: 1},
+		{tear: func(raw []byte) []byte {
+			raw[len(raw)-2] ^= 0xff
+			return raw
+		}, expected: 1},
+		{tear: func(raw []byte) []byte { return append(raw, 0, 0, 0) },
+			expected: 2},
+		{tear: func(raw []byte) []byte {
+			return append(raw, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0)
+		}, expected: 2},
+	}
+	for i, row := range table {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		wal := newWriteAheadLog(filepath.Join(dir, walFile))
+		var sizes []int64
+		for _, host := range []string{"host1", "host2"} {
+			wal.append(walRecord{Op: walAdd, Service: &Service{
+				Name: "service1", Host: host}})
+			info, _ := wal.file.Stat()
+			sizes = append(sizes, info.Size())
+		}
+		wal.close()
+		raw, err := ioutil.ReadFile(wal.path)
+		if err != nil {
+			t.Fatalf("failed to read log: %v", err)
+		}
+		if err := ioutil.WriteFile(wal.path, row.tear(raw), 0600); err != nil {
+			t.Fatalf("failed to tear log: %v", err)
+		}
+		count := 0
+		if err := wal.replay(func(record walRecord) {
+			count++
+		}); err != nil {
+			t.Fatalf("failed to replay log: %v; row %d", err, i)
+		}
+		info, _ := os.Stat(wal.path)
+		size := sizes[row.expected-1]
+		if count != row.expected || info.Size() != size {
+			t.Fatalf("expected %d records in %d bytes, got %d in %d; row %d",
+				row.expected, size, count, info.Size(), i)
+		}
+		wal.append(walRecord{Op: walRemove, Service: &Service{
+			Name: "service1", Host: "host1"}})
+		wal.close()
+		var ops []walOp
+		wal.replay(func(record walRecord) {
+			ops = append(ops, record.Op)
+		})
+		if len(ops) != count+1 || ops[count] != walRemove {
+			t.Fatalf("expected append after last complete record, got: %v; "+
+				"row %d", ops, i)
+		}
+	}
+}